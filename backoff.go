@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// How many times withRetry tries a write, and how long it waits before the
+// first retry; the wait doubles after that
+const (
+	busyRetries = 4
+	busyBackoff = 50 * time.Millisecond
+)
+
+// How long to wait after the given number of consecutive failures: base for
+// the first, doubling for each one after that, and never more than max
+func backoffDelay(base time.Duration, streak int, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < streak && delay < max; i++ {
+		delay *= 2
+	}
+	return min(delay, max)
+}
+
+// Sleep for d, returning ctx's error early if it's done first, so shutdown
+// never waits out a delay
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Run a database write, retrying it a few times with a short backoff while
+// SQLite reports the database as busy or locked by another connection. Any
+// other error, or the busy error from the last try, is returned as is, and
+// ctx's error if it's done while waiting to retry.
+func withRetry(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if !isBusy(err) || attempt == busyRetries {
+			return err
+		}
+		delay := backoffDelay(busyBackoff, attempt, time.Second)
+		debugf("Database busy, retrying in %v: %v", delay, err)
+		if err := sleepCtx(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// Report whether err is SQLite's SQLITE_BUSY or SQLITE_LOCKED
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
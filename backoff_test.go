@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Open the database at path twice: a connection that holds its write lock
+// until release is called, and a database to write to meanwhile, which fails
+// straight away rather than waiting out SQLite's busy timeout
+func lockedTestDB(t *testing.T) (db *sql.DB, release func()) {
+	t.Helper()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "locked.db")
+
+	holder, err := initDB(ctx, path, "off")
+	if err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+	t.Cleanup(func() { holder.Close() })
+	db, err = initDB(ctx, path+"?_busy_timeout=0", "off")
+	if err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	conn, err := holder.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE;"); err != nil {
+		t.Fatalf("lock the database: %v", err)
+	}
+	released := false
+	release = func() {
+		if !released {
+			released = true
+			conn.ExecContext(ctx, "COMMIT;")
+			conn.Close()
+		}
+	}
+	t.Cleanup(release)
+	return db, release
+}
+
+func testListing() Listing {
+	now := time.Now().UTC()
+	return Listing{Title: "Couch", Posted: now, ScrapedAt: now, ListingURL: "https://sfbay.craigslist.org/fuo/d/couch/111.html", PostID: "111"}
+}
+
+func TestWithRetryWaitsOutALock(t *testing.T) {
+	db, release := lockedTestDB(t)
+	time.AfterFunc(2*busyBackoff, release)
+
+	isNew, err := insertListing(context.Background(), db, testListing())
+	if err != nil {
+		t.Fatalf("insertListing while the lock was released: %v", err)
+	}
+	if !isNew {
+		t.Error("insertListing reported the listing as not new")
+	}
+}
+
+func TestWithRetryGivesUp(t *testing.T) {
+	db, _ := lockedTestDB(t)
+
+	_, err := insertListing(context.Background(), db, testListing())
+	if !isBusy(err) {
+		t.Fatalf("insertListing against a held lock = %v, want a busy error", err)
+	}
+}
+
+func TestWithRetryStopsOnCancel(t *testing.T) {
+	db, _ := lockedTestDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(busyBackoff/2, cancel)
+
+	tries := 0
+	start := time.Now()
+	err := withRetry(ctx, func() error {
+		tries++
+		// Not bound to ctx, so only the wait between tries can be cut short
+		_, err := db.Exec(`INSERT INTO seen_posts (post_id) VALUES ('111');`)
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("withRetry after cancel = %v, want context.Canceled", err)
+	}
+	if tries != 1 {
+		t.Errorf("withRetry tried %d times after cancel, want 1", tries)
+	}
+	if elapsed := time.Since(start); elapsed >= busyBackoff {
+		t.Errorf("withRetry took %v to notice the cancel", elapsed)
+	}
+}
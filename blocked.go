@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Returned when Craigslist serves its block or captcha page instead of results
+var ErrBlocked = errors.New("blocked by Craigslist")
+
+// Phrases from Craigslist's block and captcha pages, lowercased
+var blockMarkers = []string{
+	"this ip has been automatically blocked",
+	"your request has been blocked",
+	"blocked due to abuse",
+	"complete the security check",
+}
+
+// The first backoff after being blocked; it doubles with each block after that
+const blockBackoffMin = 5 * time.Minute
+
+// Report whether a page is Craigslist's block or captcha page rather than a
+// results page
+func isBlockedPage(htmlContent string) bool {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlContent))
+	if err != nil {
+		return false
+	}
+	text := strings.ToLower(doc.Find("title").Text() + " " + doc.Find("body").Text())
+	text = strings.Join(strings.Fields(text), " ")
+	for _, marker := range blockMarkers {
+		if strings.Contains(text, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A saved copy of the page Craigslist serves to a blocked IP
+const fixtureBlockedPage = `<!DOCTYPE html>
+<html><head><title>blocked</title></head>
+<body>
+<h1>blocked</h1>
+<p>This IP has been automatically blocked.
+If you have questions, please email: blocks-b1703581@craigslist.org</p>
+</body></html>`
+
+func TestIsBlockedPage(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		page    string
+		blocked bool
+	}{
+		{"block page", fixtureBlockedPage, true},
+		{"captcha page", `<html><body><p>Please complete the
+			security check to continue.</p></body></html>`, true},
+		{"results page", fixtureResultsPage, false},
+		{"empty page", ``, false},
+	} {
+		if got := isBlockedPage(tc.page); got != tc.blocked {
+			t.Errorf("%s: isBlockedPage = %v, want %v", tc.name, got, tc.blocked)
+		}
+	}
+}
+
+// The block page comes with a 403, but is reported as ErrBlocked rather than
+// as a failed load
+func TestHTTPScraperBlocked(t *testing.T) {
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fixtureBlockedPage))
+	}))
+	defer page.Close()
+
+	hs := httpScraper{testCycleConfig(t, &recordingNotifier{}), page.URL}
+	if _, err := hs.Scrape(context.Background()); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Scrape of the block page: %v, want ErrBlocked", err)
+	}
+}
+
+func TestBlockBackoff(t *testing.T) {
+	maxBackoff := time.Hour
+	for streak, want := range []time.Duration{1: 5 * time.Minute, 2: 10 * time.Minute, 3: 20 * time.Minute, 4: 40 * time.Minute, 5: time.Hour, 6: time.Hour} {
+		if streak == 0 {
+			continue
+		}
+		if got := backoffDelay(blockBackoffMin, streak, maxBackoff); got != want {
+			t.Errorf("backoff after %d blocks = %v, want %v", streak, got, want)
+		}
+	}
+}
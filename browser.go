@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/chromedp/chromedp"
+)
+
+// Build the allocator options for Chrome: chromedp's defaults, then
+// -accept-language, -proxy, and every -chrome-flag. Chrome refuses to start its sandbox
+// as root, which is how most Docker containers run, so as root --no-sandbox
+// is added unless -chrome-flag already sets it.
+func chromeAllocatorOptions(cfg Config) []chromedp.ExecAllocatorOption {
+	flags := slices.Clone(cfg.ChromeFlags)
+	noSandboxSet := slices.ContainsFunc(flags, func(f chromeFlag) bool { return f.Name == "no-sandbox" })
+	if os.Geteuid() == 0 && !noSandboxSet {
+		fmt.Println("Running as root, so starting Chrome with --no-sandbox (set -chrome-flag no-sandbox=false to override)")
+		flags = append(flags, chromeFlag{Name: "no-sandbox", Value: true})
+	}
+
+	opts := append(chromedp.DefaultExecAllocatorOptions[:], chromedp.Flag("accept-lang", cfg.AcceptLanguage))
+	if cfg.Proxy != "" {
+		opts = append(opts, chromedp.ProxyServer(cfg.Proxy))
+	}
+	for _, f := range flags {
+		opts = append(opts, chromedp.Flag(f.Name, f.Value))
+	}
+	debugf("Chrome flags on top of chromedp's defaults: --accept-lang=%s %v", cfg.AcceptLanguage, flags)
+	return opts
+}
+
+// Explain the usual reasons Chrome fails to start, or return "" if the error
+// doesn't look like one of them
+func browserStartHint(err error) string {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "sandbox"):
+		return "Chrome's sandbox couldn't start; in a container, try -chrome-flag no-sandbox"
+	case strings.Contains(msg, "executable file not found"):
+		return "Chrome isn't installed or isn't on the PATH; install Chrome or Chromium, or use -engine http"
+	case strings.Contains(msg, "dev/shm") || strings.Contains(msg, "crashed"):
+		return "Chrome crashed on startup; in a container, try -chrome-flag disable-dev-shm-usage"
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/chromedp/chromedp"
+)
+
+// Shutting down the way main does, browser first and then allocator, leaves
+// no Chrome process behind. Needs Chrome, so it's skipped where there's none.
+func TestBrowserShutdownLeavesNoChrome(t *testing.T) {
+	found := false
+	for _, name := range []string{"google-chrome", "google-chrome-stable", "chromium", "chromium-browser", "headless_shell"} {
+		if _, err := exec.LookPath(name); err == nil {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Skip("Chrome isn't installed")
+	}
+
+	cfg := testCycleConfig(t, &recordingNotifier{})
+	allocCtx, cancelAlloc := chromedp.NewExecAllocator(context.Background(), chromeAllocatorOptions(cfg)...)
+	browserCtx, cancelBrowser := chromedp.NewContext(allocCtx)
+	if err := chromedp.Run(browserCtx, chromedp.Navigate("about:blank")); err != nil {
+		cancelBrowser()
+		cancelAlloc()
+		t.Fatalf("start Chrome: %v", err)
+	}
+	process := chromedp.FromContext(browserCtx).Browser.Process()
+
+	cancelBrowser()
+	cancelAlloc()
+
+	// The allocator waits for Chrome to exit, so it should be gone already.
+	// Signal 0 checks that a process exists without signalling it.
+	if err := process.Signal(syscall.Signal(0)); err == nil {
+		t.Errorf("Chrome (pid %d) still running after shutdown", process.Pid)
+	}
+}
@@ -0,0 +1,885 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The default notification text, fed the fields of notificationData. Priced
+// listings are notified too when they're under -below-avg-pct, and saved
+// searches match on their own criteria, so neither is called free or unknown.
+const (
+	defaultNotifyTemplate       = "{{if .BelowAverage}}New below-average price listing!{{else}}New free or unknown price listing!{{end}} {{.Title}} ({{.Price}}) {{.City}}, posted {{.Age}}"
+	defaultSearchNotifyTemplate = "New listing! {{.Title}} ({{.Price}}) {{.City}}, posted {{.Age}}"
+)
+
+// Notification modes
+const (
+	notifyOnce   = "once"
+	notifyRepeat = "repeat"
+)
+
+// Values for -recency-basis
+const (
+	recencyPosted  = "posted"
+	recencyUpdated = "updated"
+)
+
+// Values for -scam-action
+const (
+	scamLow  = "low"
+	scamSkip = "skip"
+)
+
+// A US ZIP code, as accepted by -postal
+var postalRegexp = regexp.MustCompile(`^[0-9]{5}$`)
+
+// Seller types accepted by Craigslist's purveyor filter
+const (
+	sellerAll    = "all"
+	sellerOwner  = "owner"
+	sellerDealer = "dealer"
+)
+
+// Result orders accepted by Craigslist's sort parameter. Pages follow the
+// order, which matters for -backfill: with date, listings posted mid-backfill
+// only push results onto later pages, where they're skipped as already seen,
+// but with the other orders they can also move unseen results onto a page
+// that was already scraped.
+var sortOrders = []string{"date", "rel", "priceasc", "pricedsc"}
+
+// Settings for -sqlite-sync, SQLite's PRAGMA synchronous. With full, committed
+// writes survive a power loss or OS crash. With normal, the last few may be
+// lost, and without a WAL journal the database can be corrupted. With off,
+// writes are fastest but anything short of the bot itself crashing can
+// corrupt the database.
+var sqliteSyncModes = []string{"off", "normal", "full"}
+
+// CSS selectors for the parts of a search results page. Craigslist changes its
+// markup from time to time; these can be adjusted without a rebuild.
+type Selectors struct {
+	Result       string // one search result; also what the scraper waits for
+	Link         string // within a result
+	Price        string // within a result
+	Compensation string // within a result, for jobs and gigs
+	Meta         string // within a result; holds the city
+	Location     string // within a result; holds just the city, and takes precedence over Meta when set
+	Thumbnail    string // within a result; the image (src or data-src) shown for it
+	Posted       string // within a result; when it was posted, in a datetime or title attribute
+	Sponsored    string // matched by a result itself when it's an ad or a nearby-area result rather than a true hit
+	Nearby       string // anywhere on the page; the links to nearby areas, for -nearby
+}
+
+// The selectors matching Craigslist's current gallery layout
+var defaultSelectors = Selectors{
+	Result:       "li.cl-search-result",
+	Link:         "a",
+	Price:        ".priceinfo",
+	Compensation: ".compensation",
+	Meta:         ".meta",
+	Thumbnail:    "img",
+	Posted:       "time[datetime], .meta span[title]",
+	Sponsored:    ".sponsored, .nearby, [data-sponsored]",
+	Nearby:       ".cl-nearby-areas a, .nearby-areas a",
+}
+
+// The selectors matching the static results page served to clients without
+// JavaScript, which is what the http engine sees
+var staticSelectors = Selectors{
+	Result:       "li.cl-static-search-result",
+	Link:         "a",
+	Price:        ".price",
+	Compensation: ".price",
+	Meta:         ".details",
+	Location:     ".location",
+	Thumbnail:    "img",
+	Posted:       "time[datetime]",
+	Sponsored:    ".sponsored, .nearby, [data-sponsored]",
+	Nearby:       ".cl-nearby-areas a, .nearby-areas a",
+}
+
+// Values for -engine
+const (
+	engineChromedp = "chromedp"
+	engineHTTP     = "http"
+	engineAuto     = "auto" // http, falling back to chromedp when it finds nothing
+)
+
+// A Chrome command line flag from -chrome-flag. The value is a bool for a
+// bare flag, or for true and false, where false removes one of chromedp's
+// default flags; otherwise it's a string.
+type chromeFlag struct {
+	Name  string
+	Value any
+}
+
+// The flag as it appears on Chrome's command line, for logging
+func (f chromeFlag) String() string {
+	if f.Value == true {
+		return "--" + f.Name
+	}
+	return fmt.Sprintf("--%s=%v", f.Name, f.Value)
+}
+
+// Parse a -chrome-flag value: key=value, or a bare key, with or without the
+// leading dashes
+func parseChromeFlag(s string) (chromeFlag, error) {
+	name, value, hasValue := strings.Cut(strings.TrimLeft(s, "-"), "=")
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return chromeFlag{}, fmt.Errorf("must be key=value or key, e.g. no-sandbox or window-size=1280,800")
+	}
+	switch {
+	case !hasValue || value == "true":
+		return chromeFlag{Name: name, Value: true}, nil
+	case value == "false":
+		return chromeFlag{Name: name, Value: false}, nil
+	}
+	return chromeFlag{Name: name, Value: value}, nil
+}
+
+// Set from -debug; see debugf
+var debugLogging bool
+
+// Print a message only when -debug is set
+func debugf(format string, args ...any) {
+	if debugLogging {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+// Config holds the settings parsed from the command line and the -config file
+type Config struct {
+	Debug bool
+
+	ConfigPath string
+	Searches   []SavedSearch
+	Notifiers  map[string]Notifier // by name; always includes defaultNotifierName
+	Profiles   []Config            // run alongside this one, each with its own database
+
+	Name       string // the profile's name; empty for the main monitor
+	Interval   time.Duration
+	StartDelay time.Duration
+	RunFor     time.Duration
+
+	DBPath     string
+	Import     string
+	SQLiteSync string
+	Partition  bool // -partition-by-city: one database file per site
+	MaxRows    int
+	NoDelete   bool
+	Retention  time.Duration
+	JSONLOut   string
+
+	CategoryRetention map[string]time.Duration // from the -config file's retention, overriding -retention
+
+	City       string
+	Region     string
+	Sites      []string            // the sites to scrape: just City, or the Region's
+	Nearby     bool                // also scrape the nearby areas their pages suggest
+	Regions    map[string][]string // presets plus the -config file's regions
+	Category   string
+	SellerType string
+	Sort       string
+	Query      string
+	TitlesOnly bool
+
+	Postal         string
+	SearchDistance int
+
+	Engine           string
+	AcceptLanguage   string
+	ChromeFlags      []chromeFlag
+	RequireImage     bool
+	BlockAlert       string
+	ReportNotify     string
+	QuietHours       *quietHours // nil without -quiet-hours
+	QuietDigest      bool
+	MaxBackoff       time.Duration
+	Selectors        Selectors // for the chromedp engine
+	StaticSelectors  Selectors // for the http engine
+	WaitTimeout      time.Duration
+	MaxScrolls       int
+	Proxy            string // -proxy, checked by parseProxy; empty for a direct connection
+	DumpHTMLDir      string
+	Replay           string
+	PrintURL         bool
+	SendTest         bool
+	ResolveRedirects bool
+
+	ListenAddr string
+	TLSCert    string
+	TLSKey     string
+	APIUser    string
+	APIPass    string
+
+	Backfill      bool
+	BackfillPages int
+
+	Enrich               bool
+	EnrichInterval       time.Duration
+	EnrichQueue          int
+	MaxConcurrentDetails int
+	ImageStore           imageStore // nil unless -image-store is set
+
+	NtfyServer string
+	NtfyTopic  string
+	NtfyToken  string
+
+	NotifyMode      string
+	RenotifyAfter   time.Duration
+	NotifyRate      int
+	NotifyDedup     time.Duration
+	NotifySpool     string
+	SuppressInitial bool
+	BelowAvgPct     int
+	ScamThreshold   int
+	ScamAction      string
+	RecencyBasis    string
+	NotifyTemplate  *template.Template
+	DisplayTZ       *time.Location // posted times are stored in UTC and shown in this zone
+
+	// The -notify-template text, and whether it was given, for loadConfig
+	notifyTemplateText string
+	notifyTemplateSet  bool
+
+	SuppressReposts  bool
+	ExcludeSponsored bool
+	MinTitleLength   int
+	DedupCrosspost   bool
+	RepostWindow     time.Duration
+
+	KeywordWeights map[string]int // from the -config file; scoring is off without them
+	HighScore      int
+	MinScore       int
+
+	PricePriorities []PricePriority // from the -config file; nil means defaultPricePriorities
+}
+
+// Parse and validate the command line flags. The -config file is applied
+// separately, by loadConfig.
+func parseFlags() (Config, error) {
+	cfg := Config{Selectors: defaultSelectors, Regions: regionPresets}
+
+	flag.BoolVar(&cfg.Debug, "debug", false, "print debug messages")
+	flag.StringVar(&cfg.ConfigPath, "config", "", "JSON file with saved searches, notifiers, and profiles (see fileConfig); a notifier's url and token can instead come from CRAIGSLIST_NOTIFIER_<NAME>_URL and _TOKEN")
+	flag.DurationVar(&cfg.Interval, "interval", time.Minute, "time between scrapes")
+	flag.DurationVar(&cfg.StartDelay, "start-delay", 0, "time to wait before the first scrape, e.g. for a VPN or proxy to come up")
+	flag.DurationVar(&cfg.RunFor, "run-for", 0, "exit after scraping for this long, letting a cycle in progress finish first (0 to run until stopped)")
+	flag.StringVar(&cfg.DBPath, "db-path", "./craigslist.db", "path to the SQLite database, or :memory: for an ephemeral in-memory database")
+	flag.StringVar(&cfg.Import, "import", "", "insert the listings in a JSON array file, such as saved GET /listings output, into the database and exit")
+	flag.StringVar(&cfg.SQLiteSync, "sqlite-sync", "full", "SQLite synchronous mode: off, normal, or full; off and normal write faster but are less crash-safe (see sqliteSyncModes)")
+	flag.IntVar(&cfg.MaxRows, "max-rows", 0, "maximum number of listings to keep, pruning the oldest beyond it (0 for no limit); with -partition-by-city it covers every partition together")
+	flag.BoolVar(&cfg.Partition, "partition-by-city", false, "store each site's listings in a database file of its own next to -db-path, e.g. craigslist-sfbay.db, moving any already in -db-path over; ignored for :memory:")
+	flag.BoolVar(&cfg.NoDelete, "no-delete", false, "keep listings forever instead of deleting them after -retention; the database then grows without bound unless -max-rows is set")
+	flag.DurationVar(&cfg.Retention, "retention", time.Hour, "how long to keep listings after they're scraped; the -config file's retention can set it per category")
+	flag.StringVar(&cfg.JSONLOut, "jsonl-out", "", "file to append each newly inserted listing to as a JSON line, or - for stdout (disabled when empty)")
+	flag.StringVar(&cfg.City, "city", "charlotte", "Craigslist site (subdomain) to search")
+	flag.BoolVar(&cfg.Nearby, "nearby", false, "also scrape the nearby areas each site's results page suggests, one level deep and at most 10 per cycle; saved searches only match the sites they list")
+	flag.StringVar(&cfg.Region, "region", "", "named group of sites to search instead of -city: "+regionNames(regionPresets)+", or one from the -config file")
+	flag.StringVar(&cfg.Category, "category", "sss", "Craigslist category code to search")
+	flag.StringVar(&cfg.SellerType, "seller-type", sellerAll, "seller type to search: all, owner, or dealer")
+	flag.StringVar(&cfg.Sort, "sort", "date", "result order: date (newest first), rel (relevance), priceasc, or pricedsc; use date for -backfill, since other orders can skip listings posted while it runs")
+	flag.StringVar(&cfg.Query, "query", "", "keywords for Craigslist to search for, narrowing results before saved searches see them")
+	flag.BoolVar(&cfg.TitlesOnly, "titles-only", false, "match -query against titles only, not posting bodies")
+	flag.StringVar(&cfg.Postal, "postal", "", "5-digit ZIP code to center the search on")
+	flag.IntVar(&cfg.SearchDistance, "search-distance", 0, "search radius in miles around -postal (0 for the whole site)")
+	flag.StringVar(&cfg.Engine, "engine", engineChromedp, "how to load search pages: chromedp (headless Chrome, for the JavaScript gallery view), http (plain requests against the static results page, much lighter), or auto (http, falling back to chromedp when a page yields no listings)")
+	flag.StringVar(&cfg.AcceptLanguage, "accept-language", "en-US", "Accept-Language sent with page loads by either engine, for localized pages in non-English regions")
+	flag.StringVar(&cfg.BlockAlert, "block-alert", "", "notifier to alert when Craigslist blocks the bot, e.g. ntfy (disabled when empty)")
+	flag.StringVar(&cfg.ReportNotify, "report-notify", "", "notifier to send the run summary to on shutdown, e.g. ntfy (disabled when empty)")
+	quietHours := flag.String("quiet-hours", "", "daily window in the -display-tz zone during which no notifications are sent, e.g. 22:00-07:00; listings are still scraped and stored")
+	flag.BoolVar(&cfg.QuietDigest, "quiet-digest", false, "send each notifier a digest of the listings held back once -quiet-hours end, instead of dropping them")
+	flag.DurationVar(&cfg.MaxBackoff, "max-backoff", time.Hour, "longest to wait between attempts while scraping keeps failing or being blocked")
+	flag.StringVar(&cfg.Selectors.Result, "result-selector", defaultSelectors.Result, "CSS selector for one search result; the scraper waits for it to appear")
+	flag.StringVar(&cfg.Selectors.Link, "link-selector", defaultSelectors.Link, "CSS selector for the link within a result")
+	flag.StringVar(&cfg.Selectors.Price, "price-selector", defaultSelectors.Price, "CSS selector for the price within a result")
+	flag.StringVar(&cfg.Selectors.Compensation, "compensation-selector", defaultSelectors.Compensation, "CSS selector for the compensation within a job or gig result")
+	flag.StringVar(&cfg.Selectors.Meta, "meta-selector", defaultSelectors.Meta, "CSS selector for the meta text (date and city) within a result")
+	flag.StringVar(&cfg.Selectors.Location, "location-selector", defaultSelectors.Location, "CSS selector for just the city within a result, used instead of the meta text when set")
+	flag.StringVar(&cfg.Selectors.Thumbnail, "thumbnail-selector", defaultSelectors.Thumbnail, "CSS selector for the thumbnail image within a result")
+	flag.StringVar(&cfg.Selectors.Posted, "posted-selector", defaultSelectors.Posted, "CSS selector for the element within a result whose datetime or title attribute says when it was posted; results without one are taken to be posted when scraped")
+	flag.StringVar(&cfg.Selectors.Sponsored, "sponsored-selector", defaultSelectors.Sponsored, "CSS selector a result matches when it's sponsored or from a nearby area rather than a true search hit; empty to treat every result as organic")
+	flag.StringVar(&cfg.Selectors.Nearby, "nearby-selector", defaultSelectors.Nearby, "CSS selector for the links to nearby areas on a results page, followed by -nearby")
+	flag.BoolVar(&cfg.RequireImage, "require-image", false, "drop listings whose result has no thumbnail image, whatever Craigslist's own has-picture filter says")
+	flag.StringVar(&cfg.Proxy, "proxy", "", "proxy for every outgoing request, both engines' page loads included: http://, https://, or socks5://host:port; with Tor, use socks5://127.0.0.1:9050 so lookups go through it too")
+	flag.DurationVar(&cfg.WaitTimeout, "wait-timeout", time.Minute, "how long to wait for search results to appear before giving up")
+	flag.IntVar(&cfg.MaxScrolls, "max-scrolls", 0, "with the chromedp engine, scroll to the bottom of the results up to this many times so the gallery lazy-loads more, stopping once a scroll loads nothing new (0 to disable)")
+	flag.StringVar(&cfg.DumpHTMLDir, "dump-html-dir", "", "directory to save the page's HTML to when results fail to load (disabled when empty)")
+	flag.StringVar(&cfg.Replay, "replay", "", "parse a saved page, e.g. from -dump-html-dir, print the listings found, and exit")
+	flag.BoolVar(&cfg.PrintURL, "print-url", false, "print the search URL of every site each profile scrapes, and exit")
+	flag.BoolVar(&cfg.SendTest, "send-test-notification", false, "send a test message through every configured notifier, report which ones delivered it, and exit")
+	flag.BoolVar(&cfg.ResolveRedirects, "resolve-redirects", false, "replace redirect/tracking result links with the posting URL they lead to")
+	flag.StringVar(&cfg.ListenAddr, "listen", "", "address for the HTTP API, e.g. localhost:8080 (disabled when empty)")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "TLS certificate file for the API; without -tls-cert/-tls-key the API is plain HTTP and should sit behind a reverse proxy if exposed")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "TLS private key file for the API")
+	flag.StringVar(&cfg.APIUser, "api-user", "", "username required for the API (basic auth; /healthz stays open) (env CRAIGSLIST_API_USER)")
+	flag.StringVar(&cfg.APIPass, "api-pass", "", "password required for the API (env CRAIGSLIST_API_PASS)")
+	flag.BoolVar(&cfg.Backfill, "backfill", false, "scrape every available results page once, store everything, and exit; pages load in Chrome, so not with -engine http. Follow it with -no-delete or a long -retention, or the next run deletes what it stored")
+	flag.IntVar(&cfg.BackfillPages, "backfill-pages", 0, "maximum number of pages to backfill (0 for no limit)")
+	flag.BoolVar(&cfg.Enrich, "enrich", false, "fetch each new listing's detail page (description, images, attributes) in the background")
+	flag.DurationVar(&cfg.EnrichInterval, "enrich-interval", 10*time.Second, "minimum time between detail page fetches")
+	flag.IntVar(&cfg.MaxConcurrentDetails, "max-concurrent-details", 1, "maximum number of detail pages fetched at once; each fetch still waits its turn under -enrich-interval")
+	flag.IntVar(&cfg.EnrichQueue, "enrich-queue", 100, "maximum number of listings waiting for enrichment; extras are skipped")
+	imageStore := flag.String("image-store", "", "directory, or s3://bucket/prefix (credentials from the AWS_* environment), to keep copies of listing images in; requires -enrich")
+	flag.StringVar(&cfg.NtfyServer, "ntfy-server", "https://ntfy.sh", "ntfy server to publish notifications to (env CRAIGSLIST_NTFY_SERVER)")
+	flag.StringVar(&cfg.NtfyTopic, "ntfy-topic", "charlottecraig", "ntfy topic to publish notifications to (env CRAIGSLIST_NTFY_TOPIC)")
+	flag.StringVar(&cfg.NtfyToken, "ntfy-token", "", "ntfy access token for protected topics (env CRAIGSLIST_NTFY_TOKEN)")
+	flag.StringVar(&cfg.NotifyMode, "notify-mode", notifyOnce, "when to notify: once (first time a listing is seen) or repeat (every scrape it matches)")
+	flag.DurationVar(&cfg.RenotifyAfter, "renotify-after", 30*time.Minute, "minimum time between repeated notifications for the same listing (repeat mode only)")
+	flag.IntVar(&cfg.NotifyRate, "notify-rate", 0, "maximum notifications per minute; extras wait in a queue (0 for no limit)")
+	flag.StringVar(&cfg.NotifySpool, "notify-spool", "", "file to queue notifications that fail to send in, retried every minute and across restarts until delivered (disabled when empty)")
+	flag.DurationVar(&cfg.NotifyDedup, "notify-dedup-window", 2*time.Minute, "drop a notification identical to one sent via the same notifier this recently (0 to disable)")
+	flag.IntVar(&cfg.ScamThreshold, "scam-threshold", 0, "flag listings priced under this percent of their category's median as suspected scams, or under twice that with a title of a word or two (0 to disable)")
+	flag.StringVar(&cfg.RecencyBasis, "recency-basis", recencyPosted, "which time notifications show as .Posted and .Age: posted (when the listing was first posted) or updated (when the seller last edited or bumped it, once -enrich has fetched it)")
+	flag.StringVar(&cfg.ScamAction, "scam-action", scamLow, "what to do with suspected scams: low (notify at low priority) or skip (don't notify)")
+	flag.IntVar(&cfg.BelowAvgPct, "below-avg-pct", 0, "also notify about listings priced this many percent under the median of their category's recent prices on that site (0 to disable)")
+	flag.BoolVar(&cfg.SuppressInitial, "suppress-initial", false, "store the first scrape after startup without notifying, so a fresh database doesn't flood alerts")
+	flag.BoolVar(&cfg.SuppressReposts, "suppress-reposts", false, "skip notifications for listings that look like reposts of a recent listing")
+	flag.BoolVar(&cfg.ExcludeSponsored, "exclude-sponsored", false, "skip notifications for sponsored and nearby-area results (see -sponsored-selector); they're still stored")
+	flag.IntVar(&cfg.MinTitleLength, "min-title-length", 0, "skip notifications for listings whose title is shorter than this many characters or the \""+placeholderTitle+"\" placeholder; they're still stored (0 to disable)")
+	flag.BoolVar(&cfg.DedupCrosspost, "dedup-crosspost", false, "skip notifications for listings with the same title and price as one already notified within -repost-window, whatever its city or URL")
+	flag.DurationVar(&cfg.RepostWindow, "repost-window", 24*time.Hour, "how long a listing's fingerprint is remembered for repost and cross-post detection")
+	flag.IntVar(&cfg.HighScore, "high-score", 10, "keyword score at or above which notifications are sent at high priority or more, whatever price_priorities says (only with keyword_weights in -config)")
+	flag.IntVar(&cfg.MinScore, "min-score", 0, "keyword score below which listings aren't notified at all (only with keyword_weights in -config)")
+	flag.Func("chrome-flag", "extra Chrome flag as key=value or key, e.g. no-sandbox and disable-dev-shm-usage, which containers usually need; repeatable", func(s string) error {
+		f, err := parseChromeFlag(s)
+		if err != nil {
+			return err
+		}
+		cfg.ChromeFlags = append(cfg.ChromeFlags, f)
+		return nil
+	})
+	displayTZ := flag.String("display-tz", "Local", "time zone posted times are shown in by notifications and the API, e.g. America/Los_Angeles; Local is the machine's zone. They're stored in UTC either way")
+	notifyTemplate := flag.String("notify-template", defaultNotifyTemplate, "Go text/template for notification messages; fields: .Title .Price .City .URL .Posted .Age .Score .BelowAverage .SuspectedScam")
+	flag.Parse()
+	debugLogging = cfg.Debug
+
+	// Secrets are better kept out of the process list, so these can also come
+	// from the environment. A flag given on the command line always wins.
+	//
+	//	CRAIGSLIST_API_USER     -api-user
+	//	CRAIGSLIST_API_PASS     -api-pass
+	//	CRAIGSLIST_NTFY_SERVER  -ntfy-server
+	//	CRAIGSLIST_NTFY_TOPIC   -ntfy-topic
+	//	CRAIGSLIST_NTFY_TOKEN   -ntfy-token
+	//
+	// The -config file's notifiers can take their URL and token from the
+	// environment too; see notifierEnv.
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	envOrFlag(setFlags, "api-user", "CRAIGSLIST_API_USER", &cfg.APIUser)
+	envOrFlag(setFlags, "api-pass", "CRAIGSLIST_API_PASS", &cfg.APIPass)
+	envOrFlag(setFlags, "ntfy-server", "CRAIGSLIST_NTFY_SERVER", &cfg.NtfyServer)
+	envOrFlag(setFlags, "ntfy-topic", "CRAIGSLIST_NTFY_TOPIC", &cfg.NtfyTopic)
+	envOrFlag(setFlags, "ntfy-token", "CRAIGSLIST_NTFY_TOKEN", &cfg.NtfyToken)
+
+	switch cfg.Engine {
+	case engineChromedp, engineHTTP, engineAuto:
+	default:
+		return cfg, fmt.Errorf("invalid -engine %q: must be %q, %q, or %q", cfg.Engine, engineChromedp, engineHTTP, engineAuto)
+	}
+	if strings.TrimSpace(cfg.AcceptLanguage) == "" || strings.ContainsAny(cfg.AcceptLanguage, "\r\n") {
+		return cfg, fmt.Errorf("invalid -accept-language %q", cfg.AcceptLanguage)
+	}
+	// The static page has its own markup; selectors given on the command line still win
+	cfg.StaticSelectors = staticSelectorsFor(setFlags, cfg.Selectors)
+	switch cfg.SellerType {
+	case sellerAll, sellerOwner, sellerDealer:
+	default:
+		return cfg, fmt.Errorf("invalid -seller-type %q: must be %q, %q, or %q", cfg.SellerType, sellerAll, sellerOwner, sellerDealer)
+	}
+	if !slices.Contains(sqliteSyncModes, cfg.SQLiteSync) {
+		return cfg, fmt.Errorf("invalid -sqlite-sync %q: must be one of %s", cfg.SQLiteSync, strings.Join(sqliteSyncModes, ", "))
+	}
+	if !slices.Contains(sortOrders, cfg.Sort) {
+		return cfg, fmt.Errorf("invalid -sort %q: must be one of %s", cfg.Sort, strings.Join(sortOrders, ", "))
+	}
+	if cfg.Postal != "" && !postalRegexp.MatchString(cfg.Postal) {
+		return cfg, fmt.Errorf("invalid -postal %q: must be a 5-digit ZIP code", cfg.Postal)
+	}
+	if cfg.SearchDistance < 0 || cfg.SearchDistance > 1000 {
+		return cfg, fmt.Errorf("invalid -search-distance %d: must be between 0 and 1000 miles", cfg.SearchDistance)
+	}
+	if cfg.SearchDistance > 0 && cfg.Postal == "" {
+		return cfg, fmt.Errorf("-search-distance requires -postal")
+	}
+	if *quietHours != "" {
+		q, err := parseQuietHours(*quietHours)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -quiet-hours %q: %v", *quietHours, err)
+		}
+		cfg.QuietHours = q
+	}
+	if cfg.QuietDigest && cfg.QuietHours == nil {
+		return cfg, fmt.Errorf("-quiet-digest requires -quiet-hours")
+	}
+	if cfg.TitlesOnly && cfg.Query == "" {
+		return cfg, fmt.Errorf("-titles-only requires -query; it only applies to keyword searches")
+	}
+	switch cfg.NotifyMode {
+	case notifyOnce, notifyRepeat:
+	default:
+		return cfg, fmt.Errorf("invalid -notify-mode %q: must be %q or %q", cfg.NotifyMode, notifyOnce, notifyRepeat)
+	}
+	if cfg.NtfyServer == "" || cfg.NtfyTopic == "" {
+		return cfg, fmt.Errorf("-ntfy-server and -ntfy-topic must not be empty")
+	}
+	if cfg.MaxBackoff <= 0 {
+		return cfg, fmt.Errorf("invalid -max-backoff %v: must be positive", cfg.MaxBackoff)
+	}
+	if cfg.Interval <= 0 {
+		return cfg, fmt.Errorf("invalid -interval %v: must be positive", cfg.Interval)
+	}
+	if cfg.StartDelay < 0 {
+		return cfg, fmt.Errorf("invalid -start-delay %v: must not be negative", cfg.StartDelay)
+	}
+	if cfg.RunFor < 0 {
+		return cfg, fmt.Errorf("invalid -run-for %v: must not be negative", cfg.RunFor)
+	}
+	if cfg.WaitTimeout <= 0 {
+		return cfg, fmt.Errorf("invalid -wait-timeout %v: must be positive", cfg.WaitTimeout)
+	}
+	if cfg.Retention <= 0 {
+		return cfg, fmt.Errorf("invalid -retention %v: must be positive", cfg.Retention)
+	}
+	if cfg.MaxScrolls < 0 {
+		return cfg, fmt.Errorf("invalid -max-scrolls %d: must not be negative", cfg.MaxScrolls)
+	}
+	if cfg.MaxRows < 0 {
+		return cfg, fmt.Errorf("invalid -max-rows %d: must not be negative", cfg.MaxRows)
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return cfg, fmt.Errorf("-tls-cert and -tls-key must be set together")
+	}
+	if (cfg.APIUser == "") != (cfg.APIPass == "") {
+		return cfg, fmt.Errorf("-api-user and -api-pass must be set together")
+	}
+	if cfg.BackfillPages < 0 {
+		return cfg, fmt.Errorf("invalid -backfill-pages %d: must not be negative", cfg.BackfillPages)
+	}
+	// Pages are only numbered in the URL fragment, which a plain request never sends
+	if cfg.Backfill && cfg.Engine == engineHTTP {
+		return cfg, fmt.Errorf("-backfill can't page through results with -engine http; use -engine chromedp or auto")
+	}
+	if cfg.EnrichInterval <= 0 {
+		return cfg, fmt.Errorf("invalid -enrich-interval %v: must be positive", cfg.EnrichInterval)
+	}
+	if cfg.MaxConcurrentDetails < 1 {
+		return cfg, fmt.Errorf("invalid -max-concurrent-details %d: must be at least 1", cfg.MaxConcurrentDetails)
+	}
+	if cfg.EnrichQueue < 1 {
+		return cfg, fmt.Errorf("invalid -enrich-queue %d: must be at least 1", cfg.EnrichQueue)
+	}
+	if *imageStore != "" {
+		if !cfg.Enrich {
+			return cfg, fmt.Errorf("-image-store requires -enrich")
+		}
+		store, err := newImageStore(*imageStore)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ImageStore = store
+	}
+	if cfg.RenotifyAfter < 0 {
+		return cfg, fmt.Errorf("invalid -renotify-after %v: must not be negative", cfg.RenotifyAfter)
+	}
+	if cfg.NotifyRate < 0 {
+		return cfg, fmt.Errorf("invalid -notify-rate %d: must not be negative", cfg.NotifyRate)
+	}
+	if cfg.MinTitleLength < 0 {
+		return cfg, fmt.Errorf("invalid -min-title-length %d: must not be negative", cfg.MinTitleLength)
+	}
+	if cfg.NotifyDedup < 0 {
+		return cfg, fmt.Errorf("invalid -notify-dedup-window %v: must not be negative", cfg.NotifyDedup)
+	}
+	if cfg.NotifyDedup > 0 {
+		recentNotifications = newNotifyDedup(cfg.NotifyDedup)
+	}
+	if cfg.NotifySpool != "" {
+		queue, err := openFileQueue(cfg.NotifySpool)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -notify-spool %q: %v", cfg.NotifySpool, err)
+		}
+		notifySpool = queue
+	}
+	if cfg.Proxy != "" {
+		proxy, err := parseProxy(cfg.Proxy)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -proxy %q: %v", cfg.Proxy, err)
+		}
+		useProxy(proxy)
+	}
+	if cfg.ScamThreshold < 0 || cfg.ScamThreshold > 99 {
+		return cfg, fmt.Errorf("invalid -scam-threshold %d: must be between 0 and 99", cfg.ScamThreshold)
+	}
+	switch cfg.RecencyBasis {
+	case recencyPosted, recencyUpdated:
+	default:
+		return cfg, fmt.Errorf("invalid -recency-basis %q: must be %q or %q", cfg.RecencyBasis, recencyPosted, recencyUpdated)
+	}
+	switch cfg.ScamAction {
+	case scamLow, scamSkip:
+	default:
+		return cfg, fmt.Errorf("invalid -scam-action %q: must be %q or %q", cfg.ScamAction, scamLow, scamSkip)
+	}
+	if cfg.BelowAvgPct < 0 || cfg.BelowAvgPct > 99 {
+		return cfg, fmt.Errorf("invalid -below-avg-pct %d: must be between 0 and 99", cfg.BelowAvgPct)
+	}
+	if cfg.RepostWindow <= 0 {
+		return cfg, fmt.Errorf("invalid -repost-window %v: must be positive", cfg.RepostWindow)
+	}
+	var err error
+	if cfg.DisplayTZ, err = time.LoadLocation(*displayTZ); err != nil {
+		return cfg, fmt.Errorf("invalid -display-tz %q: %v", *displayTZ, err)
+	}
+
+	cfg.notifyTemplateText = *notifyTemplate
+	cfg.notifyTemplateSet = setFlags["notify-template"]
+
+	return cfg, nil
+}
+
+// Apply the -config file on top of the settings from the flags, building the
+// notifiers, searches, templates, and profiles. Called once at startup and
+// again whenever the config is reloaded.
+func loadConfig(cfg Config) (Config, error) {
+	cfg.Notifiers = map[string]Notifier{
+		defaultNotifierName: ntfyNotifier{
+			topicURL: strings.TrimSuffix(cfg.NtfyServer, "/") + "/" + cfg.NtfyTopic,
+			token:    cfg.NtfyToken,
+		},
+	}
+
+	var profiles []ProfileConfig
+	var err error
+	if cfg.ConfigPath != "" {
+		profiles, err = loadConfigFile(cfg.ConfigPath, &cfg)
+		if err != nil {
+			return cfg, err
+		}
+	} else if err := resolveRegion(&cfg, cfg.Regions); err != nil {
+		return cfg, err
+	}
+	spoolNotifiers(cfg.Notifiers)
+	if cfg.BlockAlert != "" && cfg.Notifiers[cfg.BlockAlert] == nil {
+		return cfg, fmt.Errorf("invalid -block-alert %q: no such notifier", cfg.BlockAlert)
+	}
+	if cfg.ReportNotify != "" && cfg.Notifiers[cfg.ReportNotify] == nil {
+		return cfg, fmt.Errorf("invalid -report-notify %q: no such notifier", cfg.ReportNotify)
+	}
+
+	// Without -notify-template, searches get a message that doesn't claim the price is free
+	templateFor := func(searches []SavedSearch) string {
+		if len(searches) > 0 && !cfg.notifyTemplateSet {
+			return defaultSearchNotifyTemplate
+		}
+		return cfg.notifyTemplateText
+	}
+	cfg.NotifyTemplate, err = parseNotifyTemplate(templateFor(cfg.Searches))
+	if err != nil {
+		return cfg, err
+	}
+
+	dbPaths := map[string]bool{cfg.DBPath: true}
+	for _, pc := range profiles {
+		profile, err := newProfile(cfg, pc)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid config file %s: %v", cfg.ConfigPath, err)
+		}
+		spoolNotifiers(profile.Notifiers)
+		if profile.DBPath != ":memory:" && dbPaths[profile.DBPath] {
+			return cfg, fmt.Errorf("invalid config file %s: profile %q: db_path %q is already in use", cfg.ConfigPath, pc.Name, profile.DBPath)
+		}
+		dbPaths[profile.DBPath] = true
+		profile.NotifyTemplate, err = parseNotifyTemplate(templateFor(profile.Searches))
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Profiles = append(cfg.Profiles, profile)
+	}
+
+	return cfg, nil
+}
+
+// Parse the notification template, rendering a sample so unknown fields are
+// reported now rather than on the first match
+func parseNotifyTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -notify-template: %v", err)
+	}
+	if _, err := renderNotification(tmpl, Listing{}, time.UTC, recencyPosted); err != nil {
+		return nil, fmt.Errorf("invalid -notify-template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// Prefix for log lines about this monitor and its cycles: the run ID, so a
+// line can be matched with its run's summary and /stats, and the profile
+// name, so profiles can be told apart
+func (cfg Config) logPrefix() string {
+	if cfg.Name == "" {
+		return "[" + currentRun.id + "] "
+	}
+	return "[" + currentRun.id + " " + cfg.Name + "] "
+}
+
+// The layout of the -config file, e.g.
+//
+//	{
+//	  "notifiers": [
+//	    {"name": "discord", "type": "discord", "url": "https://discord.com/api/webhooks/..."}
+//	  ],
+//	  "searches": [
+//	    {"name": "couches", "keywords": ["couch", "sofa"], "max_price": 100, "notifiers": ["discord"]},
+//	    {"name": "free stuff", "city": "raleigh", "max_price": 0, "notifiers": ["ntfy", "discord"]}
+//	  ],
+//	  "regions": {
+//	    "triad": ["greensboro", "winstonsalem"]
+//	  },
+//	  "keyword_weights": {"vintage": 5, "mid century": 10, "broken": -10},
+//	  "retention": {"apa": "72h", "zip": "30m"},
+//	  "price_priorities": [
+//	    {"max_price": 0, "priority": "urgent"},
+//	    {"max_price": 50, "priority": "high"},
+//	    {"unknown": true, "priority": "high"},
+//	    {"priority": "default"}
+//	  ],
+//	  "profiles": [
+//	    {"name": "business", "db_path": "./business.db", "category": "bfs", "interval": "5m"}
+//	  ]
+//	}
+//
+// The notifier named "ntfy" is the one set up by the -ntfy-* flags.
+type fileConfig struct {
+	Notifiers []NotifierConfig `json:"notifiers"`
+	Searches  []SavedSearch    `json:"searches"`
+	Profiles  []ProfileConfig  `json:"profiles"`
+
+	Regions map[string][]string `json:"regions"` // more -region presets, by name
+
+	KeywordWeights map[string]int `json:"keyword_weights"` // keyword scores, see scoreListing
+
+	PricePriorities []PricePriority `json:"price_priorities"` // notification priority by price; defaults to defaultPricePriorities
+
+	Retention map[string]string `json:"retention"` // how long to keep listings by category, e.g. "apa": "72h"
+}
+
+// An independent monitor from the -config file, run alongside the main one.
+// It shares the browser and the command line flags, but has its own database,
+// notifiers, and searches; the top-level notifiers and searches don't apply.
+type ProfileConfig struct {
+	Name      string           `json:"name"`
+	DBPath    string           `json:"db_path"`  // required, and distinct from -db-path and other profiles
+	City      string           `json:"city"`     // defaults to -city
+	Region    string           `json:"region"`   // instead of city; defaults to -region
+	Category  string           `json:"category"` // defaults to -category
+	Interval  string           `json:"interval"` // e.g. "5m"; defaults to -interval
+	Notifiers []NotifierConfig `json:"notifiers"`
+	Searches  []SavedSearch    `json:"searches"`
+}
+
+// Build a profile's Config on top of the main one. The notify template is left
+// for the caller.
+func newProfile(base Config, pc ProfileConfig) (Config, error) {
+	if pc.Name == "" {
+		return base, fmt.Errorf("profile with no name")
+	}
+	if pc.DBPath == "" {
+		return base, fmt.Errorf("profile %q has no db_path", pc.Name)
+	}
+
+	profile := base
+	profile.Name = pc.Name
+	profile.DBPath = pc.DBPath
+	profile.Profiles = nil
+	if pc.City != "" && pc.Region != "" {
+		return base, fmt.Errorf("profile %q: city and region can't both be set", pc.Name)
+	}
+	if pc.City != "" {
+		profile.City = pc.City
+		profile.Region = ""
+		profile.Sites = []string{pc.City}
+	}
+	if pc.Region != "" {
+		profile.Region = pc.Region
+		if err := resolveRegion(&profile, base.Regions); err != nil {
+			return base, fmt.Errorf("profile %q: %v", pc.Name, err)
+		}
+	}
+	if pc.Category != "" {
+		profile.Category = pc.Category
+	}
+	if pc.Interval != "" {
+		interval, err := time.ParseDuration(pc.Interval)
+		if err != nil || interval <= 0 {
+			return base, fmt.Errorf("profile %q: invalid interval %q", pc.Name, pc.Interval)
+		}
+		profile.Interval = interval
+	}
+
+	profile.Notifiers = map[string]Notifier{defaultNotifierName: base.Notifiers[defaultNotifierName]}
+	if err := addNotifiers(profile.Notifiers, pc.Notifiers); err != nil {
+		return base, fmt.Errorf("profile %q: %v", pc.Name, err)
+	}
+	if err := validateSearches(pc.Searches, profile.Sites, profile.Regions, profile.Notifiers); err != nil {
+		return base, fmt.Errorf("profile %q: %v", pc.Name, err)
+	}
+	profile.Searches = pc.Searches
+	if base.BlockAlert != "" && profile.Notifiers[base.BlockAlert] == nil {
+		return base, fmt.Errorf("profile %q has no notifier %q for -block-alert", pc.Name, base.BlockAlert)
+	}
+
+	return profile, nil
+}
+
+// Read and validate the -config file into cfg. Profiles are returned for the
+// caller to build once the rest of cfg is complete.
+func loadConfigFile(path string, cfg *Config) ([]ProfileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var fc fileConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fc); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	if err := addNotifiers(cfg.Notifiers, fc.Notifiers); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	cfg.Regions, err = mergeRegions(fc.Regions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	if err := resolveRegion(cfg, cfg.Regions); err != nil {
+		return nil, err
+	}
+	if err := validateSearches(fc.Searches, cfg.Sites, cfg.Regions, cfg.Notifiers); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	cfg.Searches = fc.Searches
+	for keyword := range fc.KeywordWeights {
+		if strings.TrimSpace(keyword) == "" {
+			return nil, fmt.Errorf("invalid config file %s: empty keyword in keyword_weights", path)
+		}
+	}
+	cfg.KeywordWeights = fc.KeywordWeights
+	cfg.CategoryRetention = make(map[string]time.Duration, len(fc.Retention))
+	for category, s := range fc.Retention {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid config file %s: retention for %q must be a positive duration like 72h, not %q", path, category, s)
+		}
+		cfg.CategoryRetention[category] = d
+	}
+	if err := validatePricePriorities(fc.PricePriorities); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	cfg.PricePriorities = fc.PricePriorities
+
+	names := make(map[string]bool)
+	for _, pc := range fc.Profiles {
+		if names[pc.Name] {
+			return nil, fmt.Errorf("invalid config file %s: duplicate profile name %q", path, pc.Name)
+		}
+		names[pc.Name] = true
+	}
+
+	return fc.Profiles, nil
+}
+
+// Build the configured notifiers into notifiers, which already holds the default one
+func addNotifiers(notifiers map[string]Notifier, configs []NotifierConfig) error {
+	for _, nc := range configs {
+		if nc.Name == "" {
+			return fmt.Errorf("notifier with no name")
+		}
+		if nc.Name == defaultNotifierName {
+			return fmt.Errorf("notifier name %q is reserved for the -ntfy-* flags", nc.Name)
+		}
+		if notifiers[nc.Name] != nil {
+			return fmt.Errorf("duplicate notifier name %q", nc.Name)
+		}
+		notifierEnv(&nc)
+		notifier, err := newNotifier(nc)
+		if err != nil {
+			return err
+		}
+		notifiers[nc.Name] = notifier
+	}
+	return nil
+}
+
+// Fill in a -config notifier's url and token from the environment where the
+// file leaves them out, so Discord and Slack webhook URLs and Telegram bot
+// tokens needn't be written down. For a notifier named "deals" these are
+//
+//	CRAIGSLIST_NOTIFIER_DEALS_URL    url
+//	CRAIGSLIST_NOTIFIER_DEALS_TOKEN  token
+//
+// with the name upper-cased and anything but letters and digits replaced by
+// underscores.
+func notifierEnv(nc *NotifierConfig) {
+	prefix := "CRAIGSLIST_NOTIFIER_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(nc.Name)) + "_"
+	if nc.URL == "" {
+		nc.URL = os.Getenv(prefix + "URL")
+	}
+	if nc.Token == "" {
+		nc.Token = os.Getenv(prefix + "TOKEN")
+	}
+}
+
+// Override a flag's value from an environment variable, unless the flag was
+// given explicitly on the command line
+func envOrFlag(setFlags map[string]bool, name, env string, value *string) {
+	if setFlags[name] {
+		return
+	}
+	if v, ok := os.LookupEnv(env); ok {
+		*value = v
+	}
+}
+
+// Return staticSelectors, with any selectors given on the command line taking their place
+func staticSelectorsFor(setFlags map[string]bool, given Selectors) Selectors {
+	sel := staticSelectors
+	fields := []struct {
+		flag  string
+		value *string
+		given string
+	}{
+		{"result-selector", &sel.Result, given.Result},
+		{"link-selector", &sel.Link, given.Link},
+		{"price-selector", &sel.Price, given.Price},
+		{"compensation-selector", &sel.Compensation, given.Compensation},
+		{"meta-selector", &sel.Meta, given.Meta},
+		{"location-selector", &sel.Location, given.Location},
+		{"thumbnail-selector", &sel.Thumbnail, given.Thumbnail},
+		{"posted-selector", &sel.Posted, given.Posted},
+		{"sponsored-selector", &sel.Sponsored, given.Sponsored},
+		{"nearby-selector", &sel.Nearby, given.Nearby},
+	}
+	for _, f := range fields {
+		if setFlags[f.flag] {
+			*f.value = f.given
+		}
+	}
+	return sel
+}
@@ -3,9 +3,22 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"net/http"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/PuerkitoBio/goquery"
@@ -14,20 +27,105 @@ import (
 )
 
 type Listing struct {
-	Title      string
-	Price      string
-	City       string
-	Posted     time.Time
-	ListingURL string
+	Title           string      `json:"title"`
+	Price           string      `json:"price"`                 // Normalized: a range's lower bound, and empty for "call for price"
+	PriceText       string      `json:"price_text,omitempty"`  // The price exactly as shown, when it differs
+	PriceCents      *int        `json:"price_cents,omitempty"` // Price parsed to cents; nil when unknown
+	PriceInferred   bool        `json:"price_inferred"`        // Price was taken from the title rather than the price element
+	City            string      `json:"city"`
+	Site            string      `json:"site"`          // The Craigslist site (subdomain) it was found on
+	Section         string      `json:"section"`       // Craigslist section code from the URL, e.g. "fuo"
+	LikelyRepost    bool        `json:"likely_repost"` // Matches the fingerprint of a different recent listing
+	Posted          time.Time   `json:"posted"`
+	Updated         *time.Time  `json:"updated,omitempty"` // When the seller last edited or bumped it, from the detail page
+	ScrapedAt       time.Time   `json:"scraped_at"`        // When the bot saw it, whenever it was posted
+	ListingURL      string      `json:"listing_url"`
+	PostID          string      `json:"post_id"`
+	SearchURL       string      `json:"search_url,omitempty"`       // The search page it was scraped from
+	Thumbnail       string      `json:"thumbnail,omitempty"`        // The image shown in the search results, if any
+	Score           int         `json:"score,omitempty"`            // keyword score, see scoreListing
+	BelowAverage    bool        `json:"below_average,omitempty"`    // priced -below-avg-pct under its category's median
+	SuspectedScam   bool        `json:"suspected_scam,omitempty"`   // priced implausibly low, see isSuspectedScam
+	Sponsored       bool        `json:"sponsored,omitempty"`        // An ad or nearby-area result mixed in with the search hits
+	MatchedKeywords keywordList `json:"matched_keywords,omitempty"` // The saved searches' keywords found in its title
+
+	// Filled in from the detail page by the enrichment worker
+	Description      string            `json:"description,omitempty"`
+	SellerProfileURL string            `json:"seller_profile_url,omitempty"` // "more ads by this user"
+	Images           []string          `json:"images,omitempty"`
+	Attributes       map[string]string `json:"attributes,omitempty"`
+}
+
+// When a listing was last posted: with recencyUpdated, when the seller last
+// updated it if they have, and otherwise when it was originally posted
+func (l Listing) recency(basis string) time.Time {
+	if basis == recencyUpdated && l.Updated != nil {
+		return *l.Updated
+	}
+	return l.Posted
+}
+
+// The title used when a result has none
+const placeholderTitle = "No title"
+
+// Check that a listing is worth storing: it needs an absolute http(s) URL, and
+// a placeholder title with no price is treated as a broken result.
+func (l Listing) Valid() error {
+	if l.ListingURL == "" {
+		return errors.New("missing listing URL")
+	}
+	u, err := url.Parse(l.ListingURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid listing URL %q", l.ListingURL)
+	}
+	if (l.Title == "" || l.Title == placeholderTitle) && l.Price == "" {
+		return errors.New("no title and no price")
+	}
+	return nil
+}
+
+// Categories whose results carry compensation instead of a price: jobs and gigs
+var compensationCategories = map[string]bool{
+	"jjj": true,
+	"ggg": true,
 }
 
-// Initialize the SQLite3 database
-func initDB() (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", "./craigslist.db")
+// The free stuff category, whose results have no price at all
+const freeCategory = "zip"
+
+// Matches the numeric post ID at the end of a listing URL
+var postIDRegexp = regexp.MustCompile(`/(\d+)\.html$`)
+
+// Matches an amount such as "$50", "£1,200", or "€1.200"
+var titlePriceRegexp = regexp.MustCompile(`[$£€][0-9][0-9,.]*`)
+
+// Sent by -engine http; some sites refuse Go's default User-Agent
+const httpUserAgent = "Mozilla/5.0 (X11; Linux x86_64) craigslist_bot"
+
+// Initialize the SQLite3 database at the given path (or ":memory:"), with
+// PRAGMA synchronous set to sync (see sqliteSyncModes)
+func initDB(ctx context.Context, path, sync string) (*sql.DB, error) {
+	// Foreign keys and the synchronous mode are per connection in SQLite, so
+	// set them in the DSN
+	params := "_foreign_keys=on&_sync=" + sync
+	dsn := path + "?" + params
+	if strings.Contains(path, "?") {
+		dsn = path + "&" + params
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
+	// An in-memory database lives only as long as its connection, so keep exactly one
+	if path == ":memory:" {
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(0)
+		db.SetConnMaxIdleTime(0)
+	}
+
 	// Create table if it doesn't exist
 	createTableQuery := `
 	CREATE TABLE IF NOT EXISTS listings (
@@ -38,161 +136,1710 @@ func initDB() (*sql.DB, error) {
 		posted DATETIME,
 		listing_url TEXT UNIQUE
 	);
+	CREATE TABLE IF NOT EXISTS fingerprints (
+		fingerprint TEXT PRIMARY KEY,
+		listing_url TEXT,
+		seen_at DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS notified_fingerprints (
+		fingerprint TEXT PRIMARY KEY,
+		listing_url TEXT,
+		notified_at DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS seen_posts (
+		post_id TEXT PRIMARY KEY,
+		content_hash TEXT,
+		first_seen DATETIME,
+		last_seen DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS images (
+		listing_id INTEGER REFERENCES listings(id) ON DELETE CASCADE,
+		url TEXT
+	);
+	CREATE TABLE IF NOT EXISTS price_stats (
+		category TEXT PRIMARY KEY,
+		avg_price REAL,
+		samples INTEGER,
+		updated_at DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS price_samples (
+		category TEXT,
+		price INTEGER,
+		seen_at DATETIME
+	);
+	CREATE INDEX IF NOT EXISTS price_samples_category ON price_samples (category);
+	CREATE TABLE IF NOT EXISTS attributes (
+		listing_id INTEGER REFERENCES listings(id) ON DELETE CASCADE,
+		key TEXT,
+		value TEXT,
+		PRIMARY KEY (listing_id, key)
+	);
 	`
-	_, err = db.Exec(createTableQuery)
+	_, err = db.ExecContext(ctx, createTableQuery)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create table: %v", err)
 	}
 
+	// Add columns introduced after the original schema
+	migrations := []struct{ column, definition string }{
+		{"last_notified", "DATETIME"},
+		{"price_inferred", "BOOLEAN DEFAULT 0"},
+		{"section", "TEXT"},
+		{"likely_repost", "BOOLEAN DEFAULT 0"},
+		{"post_id", "TEXT"},
+		{"description", "TEXT"},
+		{"enriched_at", "DATETIME"},
+		{"site", "TEXT"},
+		{"search_url", "TEXT"},
+		{"price_text", "TEXT"},
+		{"price_cents", "INTEGER"},
+		{"sponsored", "BOOLEAN DEFAULT 0"},
+		{"scraped_at", "DATETIME"},
+		{"matched_keywords", "TEXT"},
+		{"seller_profile_url", "TEXT"},
+		{"updated", "DATETIME"},
+	}
+	for _, m := range migrations {
+		err = addColumn(ctx, db, "listings", m.column, m.definition)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate table: %v", err)
+		}
+	}
+	err = addColumn(ctx, db, "images", "stored_path", "TEXT")
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate table: %v", err)
+	}
+	err = addColumn(ctx, db, "price_stats", "median_price", "REAL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate table: %v", err)
+	}
+
+	// Fill in price_cents for listings stored before it existed. Unknown
+	// prices stay NULL and don't match, so this only does work once.
+	backfillQuery := `
+	UPDATE listings
+	SET price_cents = CASE WHEN LOWER(TRIM(price)) = 'free' THEN 0
+		ELSE CAST(REPLACE(REPLACE(TRIM(price), '$', ''), ',', '') AS INTEGER) * 100 END
+	WHERE price_cents IS NULL AND (LOWER(TRIM(price)) = 'free' OR TRIM(price) GLOB '$[0-9]*');
+	`
+	_, err = db.ExecContext(ctx, backfillQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate table: %v", err)
+	}
+
+	// Posted times used to be stored in local time, with its offset. Cleanup
+	// compares them as text against UTC, so convert any left over.
+	utcQuery := `
+	UPDATE listings
+	SET posted = strftime('%Y-%m-%d %H:%M:%f+00:00', posted)
+	WHERE posted NOT LIKE '%+00:00' AND strftime('%Y-%m-%d %H:%M:%f+00:00', posted) IS NOT NULL;
+	`
+	_, err = db.ExecContext(ctx, utcQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate table: %v", err)
+	}
+
+	// Listings stored before scraped_at existed were posted when they were scraped
+	scrapedQuery := `
+	UPDATE listings SET scraped_at = posted WHERE scraped_at IS NULL;
+	`
+	_, err = db.ExecContext(ctx, scrapedQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to migrate table: %v", err)
+	}
+
 	return db, nil
 }
 
-// Insert a new listing into the database
-func insertListing(db *sql.DB, listing Listing) error {
+// Add a column to a table unless it already exists
+func addColumn(ctx context.Context, db *sql.DB, table, column, definition string) error {
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition))
+	return err
+}
+
+// Insert a new listing into the database, reporting whether it was new
+func insertListing(ctx context.Context, db *sql.DB, listing Listing) (bool, error) {
 	insertQuery := `
-	INSERT INTO listings (title, price, city, posted, listing_url)
-	VALUES (?, ?, ?, ?, ?)
+	INSERT INTO listings (title, price, price_text, price_cents, price_inferred, city, site, section, sponsored, matched_keywords, posted, updated, scraped_at, listing_url, post_id, search_url)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	ON CONFLICT(listing_url) DO NOTHING;
 	`
-	_, err := db.Exec(insertQuery, listing.Title, listing.Price, listing.City, listing.Posted, listing.ListingURL)
+	var result sql.Result
+	err := withRetry(ctx, func() (err error) {
+		result, err = db.ExecContext(ctx, insertQuery, listing.Title, listing.Price, listing.PriceText, listing.PriceCents, listing.PriceInferred, listing.City, listing.Site, listing.Section, listing.Sponsored, listing.MatchedKeywords, listing.Posted, listing.Updated, listing.ScrapedAt, listing.ListingURL, listing.PostID, listing.SearchURL)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Record that a notification was just sent for a listing
+func markNotified(ctx context.Context, db *sql.DB, listingURL string) error {
+	updateQuery := `
+	UPDATE listings
+	SET last_notified = ?
+	WHERE listing_url = ?;
+	`
+	_, err := db.ExecContext(ctx, updateQuery, time.Now(), listingURL)
 	return err
 }
 
-// Delete listings older than an hour from the database
-func deleteOldListings(db *sql.DB) error {
+// Fill in a listing's posted and updated times from its stored row
+func loadPostTimes(ctx context.Context, db *sql.DB, listing *Listing) error {
+	selectQuery := `
+	SELECT posted, updated FROM listings
+	WHERE listing_url = ?;
+	`
+	return db.QueryRowContext(ctx, selectQuery, listing.ListingURL).Scan(&listing.Posted, &listing.Updated)
+}
+
+// Report whether a listing was notified within the given duration
+func notifiedWithin(ctx context.Context, db *sql.DB, listingURL string, d time.Duration) (bool, error) {
+	var lastNotified sql.NullTime
+	selectQuery := `
+	SELECT last_notified FROM listings
+	WHERE listing_url = ?;
+	`
+	err := db.QueryRowContext(ctx, selectQuery, listingURL).Scan(&lastNotified)
+	if err != nil {
+		return false, err
+	}
+	return lastNotified.Valid && time.Since(lastNotified.Time) < d, nil
+}
+
+// Filters, ordering, and paging for queryListings
+type listingQuery struct {
+	Section   string
+	SearchURL string
+	MinCents  *int   // nil for no lower bound
+	MaxCents  *int   // nil for no upper bound
+	Sort      string // a key of listingSortColumns
+	Desc      bool
+	Limit     int
+	Offset    int
+}
+
+// The columns /listings can be sorted by. ORDER BY clauses are only ever built
+// from these values, never from request input. Unknown prices sort last.
+var listingSortColumns = map[string]string{
+	"posted":  "posted",
+	"updated": "COALESCE(updated, posted)", // posted when it's never been updated
+	"price":   "price_cents",
+}
+
+// Fetch a page of listings, along with the total number matching the filters
+func queryListings(ctx context.Context, db *sql.DB, q listingQuery) ([]Listing, int, error) {
+	where := `WHERE (? = '' OR section = ?) AND (? = '' OR search_url = ?)
+	AND (? IS NULL OR price_cents >= ?) AND (? IS NULL OR price_cents <= ?)`
+	args := []any{q.Section, q.Section, q.SearchURL, q.SearchURL, q.MinCents, q.MinCents, q.MaxCents, q.MaxCents}
+
+	var total int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM listings `+where+`;`, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	column, ok := listingSortColumns[q.Sort]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown sort field %q", q.Sort)
+	}
+	direction := "ASC"
+	if q.Desc {
+		direction = "DESC"
+	}
+
+	selectQuery := `
+	SELECT COALESCE(title, ''), COALESCE(price, ''), COALESCE(price_text, ''), price_cents, COALESCE(price_inferred, 0), COALESCE(city, ''), COALESCE(site, ''), COALESCE(section, ''), COALESCE(likely_repost, 0), COALESCE(sponsored, 0), matched_keywords, posted, updated, scraped_at, listing_url, COALESCE(post_id, ''), COALESCE(search_url, '')
+	FROM listings
+	` + where + `
+	ORDER BY ` + column + ` ` + direction + ` NULLS LAST, id ` + direction + `
+	LIMIT ? OFFSET ?;
+	`
+	rows, err := db.QueryContext(ctx, selectQuery, append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	listings := []Listing{}
+	for rows.Next() {
+		var listing Listing
+		err := rows.Scan(&listing.Title, &listing.Price, &listing.PriceText, &listing.PriceCents, &listing.PriceInferred, &listing.City, &listing.Site, &listing.Section, &listing.LikelyRepost, &listing.Sponsored, &listing.MatchedKeywords, &listing.Posted, &listing.Updated, &listing.ScrapedAt, &listing.ListingURL, &listing.PostID, &listing.SearchURL)
+		if err != nil {
+			return nil, 0, err
+		}
+		listings = append(listings, listing)
+	}
+	return listings, total, rows.Err()
+}
+
+// Look up one listing by post ID, with its description, images, and
+// attributes if it has been enriched. Rows stored before post IDs were
+// recorded are matched by URL. Returns sql.ErrNoRows if there's none.
+func getListingByPostID(ctx context.Context, db *sql.DB, postID string) (Listing, error) {
+	var listing Listing
+	var id int64
+	selectQuery := `
+	SELECT id, COALESCE(title, ''), COALESCE(price, ''), COALESCE(price_text, ''), price_cents, COALESCE(price_inferred, 0), COALESCE(city, ''), COALESCE(site, ''), COALESCE(section, ''), COALESCE(likely_repost, 0), COALESCE(sponsored, 0), matched_keywords, posted, updated, scraped_at, listing_url, COALESCE(post_id, ''), COALESCE(search_url, ''), COALESCE(description, ''), COALESCE(seller_profile_url, '')
+	FROM listings
+	WHERE post_id = ? OR (COALESCE(post_id, '') = '' AND substr(listing_url, -length(?)) = ?)
+	ORDER BY id DESC
+	LIMIT 1;
+	`
+	suffix := "/" + postID + ".html"
+	err := db.QueryRowContext(ctx, selectQuery, postID, suffix, suffix).Scan(&id, &listing.Title, &listing.Price, &listing.PriceText, &listing.PriceCents, &listing.PriceInferred, &listing.City, &listing.Site, &listing.Section, &listing.LikelyRepost, &listing.Sponsored, &listing.MatchedKeywords, &listing.Posted, &listing.Updated, &listing.ScrapedAt, &listing.ListingURL, &listing.PostID, &listing.SearchURL, &listing.Description, &listing.SellerProfileURL)
+	if err != nil {
+		return listing, err
+	}
+	if listing.PostID == "" {
+		listing.PostID = parsePostID(listing.ListingURL)
+	}
+
+	imageQuery := `
+	SELECT url FROM images WHERE listing_id = ? ORDER BY rowid;
+	`
+	rows, err := db.QueryContext(ctx, imageQuery, id)
+	if err != nil {
+		return listing, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var imageURL string
+		if err := rows.Scan(&imageURL); err != nil {
+			return listing, err
+		}
+		listing.Images = append(listing.Images, imageURL)
+	}
+	if err := rows.Err(); err != nil {
+		return listing, err
+	}
+
+	attributeQuery := `
+	SELECT key, value FROM attributes WHERE listing_id = ?;
+	`
+	attrRows, err := db.QueryContext(ctx, attributeQuery, id)
+	if err != nil {
+		return listing, err
+	}
+	defer attrRows.Close()
+	for attrRows.Next() {
+		var key, value string
+		if err := attrRows.Scan(&key, &value); err != nil {
+			return listing, err
+		}
+		if listing.Attributes == nil {
+			listing.Attributes = make(map[string]string)
+		}
+		listing.Attributes[key] = value
+	}
+	return listing, attrRows.Err()
+}
+
+// Delete listings scraped longer ago than their category's retention, or
+// retention for categories without one of their own, returning how many were
+// removed. A listing's category is its section, or category for rows without.
+func deleteOldListings(ctx context.Context, db *sql.DB, category string, retention time.Duration, byCategory map[string]time.Duration) (int64, error) {
+	// A single pass, with a CASE arm for each category that has its own
+	age := func(d time.Duration) string {
+		return fmt.Sprintf("-%d seconds", int64(d.Seconds()))
+	}
+	cutoff := "datetime('now', ?)"
+	var args []any
+	if len(byCategory) > 0 {
+		cutoff = "CASE COALESCE(NULLIF(section, ''), ?)"
+		args = append(args, category)
+		for _, c := range slices.Sorted(maps.Keys(byCategory)) {
+			cutoff += " WHEN ? THEN datetime('now', ?)"
+			args = append(args, c, age(byCategory[c]))
+		}
+		cutoff += " ELSE datetime('now', ?) END"
+	}
+	args = append(args, age(retention))
+
 	deleteQuery := `
 	DELETE FROM listings
-	WHERE posted < datetime('now', '-1 hour');
+	WHERE scraped_at < ` + cutoff + `;
 	`
-	_, err := db.Exec(deleteQuery)
-	return err
+	var result sql.Result
+	err := withRetry(ctx, func() (err error) {
+		result, err = db.ExecContext(ctx, deleteQuery, args...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
 
-func scrapeListings(ctx context.Context) ([]Listing, error) {
-	var listings []Listing
+// Count the listings stored in the database
+func countListings(ctx context.Context, db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM listings;`).Scan(&n)
+	return n, err
+}
+
+// Count the listings stored from each site, e.g. "sfbay". Rows stored before
+// the site was recorded are counted under "".
+func countListingsByCity(ctx context.Context, db *sql.DB) (map[string]int, error) {
+	selectQuery := `
+	SELECT COALESCE(site, ''), COUNT(*) FROM listings GROUP BY COALESCE(site, '');
+	`
+	rows, err := db.QueryContext(ctx, selectQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	url := "https://charlotte.craigslist.org/search/sss#search=1~gallery~0~0"
+	counts := make(map[string]int)
+	for rows.Next() {
+		var site string
+		var n int
+		if err := rows.Scan(&site, &n); err != nil {
+			return nil, err
+		}
+		counts[site] = n
+	}
+	return counts, rows.Err()
+}
 
-	var htmlContent string
+// Delete one listing by post ID, matching rows stored before post IDs were
+// recorded by URL like getListingByPostID. Returns how many were removed.
+func deleteListingByPostID(ctx context.Context, db *sql.DB, postID string) (int64, error) {
+	deleteQuery := `
+	DELETE FROM listings
+	WHERE post_id = ? OR (COALESCE(post_id, '') = '' AND substr(listing_url, -length(?)) = ?);
+	`
+	suffix := "/" + postID + ".html"
+	result, err := db.ExecContext(ctx, deleteQuery, postID, suffix, suffix)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
 
-	// Run the chromedp tasks to load the page and wait for the content
-	err := chromedp.Run(ctx,
-		chromedp.Navigate(url),
-		chromedp.WaitReady("li.cl-search-result"), // Wait until listings are loaded
-		chromedp.InnerHTML("body", &htmlContent),  // Get the full HTML content of the body
-	)
+// Delete every listing from a city, given either as the site it was found on
+// (e.g. "sfbay") or as the city shown in the results. Rows stored before the
+// site was recorded are matched by their URL's host. Returns how many were removed.
+// Values are compared exactly, never as patterns, so "%" matches nothing.
+func deleteListingsByCity(ctx context.Context, db *sql.DB, city string) (int64, error) {
+	deleteQuery := `
+	DELETE FROM listings
+	WHERE site = ? OR city = ? OR (site IS NULL AND substr(listing_url, 1, length(?)) = ?);
+	`
+	prefix := "https://" + city + ".craigslist.org/"
+	result, err := db.ExecContext(ctx, deleteQuery, city, city, prefix, prefix)
 	if err != nil {
-		return listings, fmt.Errorf("failed to load the page: %v", err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Delete the least recently scraped listings so that at most max rows remain
+// across dbs, which with -partition-by-city are the main database and every
+// partition. Returns how many were removed.
+func pruneToLimit(ctx context.Context, dbs []*sql.DB, max int) (int64, error) {
+	// Most cycles stay under the limit, so skip the delete when there's nothing to prune
+	total := 0
+	for _, db := range dbs {
+		n, err := countListings(ctx, db)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	if total <= max {
+		return 0, nil
+	}
+
+	// Only each database's newest max rows can be among the newest max
+	// overall; work out how many of those each database keeps
+	type stamp struct {
+		scrapedAt time.Time
+		db        int
+	}
+	var stamps []stamp
+	for i, db := range dbs {
+		rows, err := db.QueryContext(ctx, `SELECT scraped_at FROM listings ORDER BY scraped_at DESC, id DESC LIMIT ?;`, max)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			s := stamp{db: i}
+			if err := rows.Scan(&s.scrapedAt); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			stamps = append(stamps, s)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+	slices.SortStableFunc(stamps, func(a, b stamp) int { return b.scrapedAt.Compare(a.scrapedAt) })
+	keep := make([]int, len(dbs))
+	for _, s := range stamps[:min(max, len(stamps))] {
+		keep[s.db]++
+	}
+
+	pruneQuery := `
+	DELETE FROM listings
+	WHERE id NOT IN (
+		SELECT id FROM listings
+		ORDER BY scraped_at DESC, id DESC
+		LIMIT ?
+	);
+	`
+	var pruned int64
+	for i, db := range dbs {
+		result, err := db.ExecContext(ctx, pruneQuery, keep[i])
+		if err != nil {
+			return pruned, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return pruned, err
+		}
+		pruned += n
+	}
+	return pruned, nil
+}
+
+// Print the first-page search URL of every site the main config and each
+// profile scrape, one per line
+func printSearchURLs(cfg Config) {
+	for _, c := range append([]Config{cfg}, cfg.Profiles...) {
+		for _, site := range searchSites(c) {
+			siteCfg := c
+			siteCfg.City = site
+			fmt.Printf("%s%s\n", c.logPrefix(), buildSearchURL(siteCfg, 0))
+		}
+	}
+}
+
+// Build the gallery search URL for the configured city, category, and filters.
+// Pages are numbered from 0.
+func buildSearchURL(cfg Config, page int) string {
+	query := url.Values{}
+	query.Set("sort", cfg.Sort)
+	if cfg.Query != "" {
+		query.Set("query", cfg.Query)
+		if cfg.TitlesOnly {
+			query.Set("srchType", "T")
+		}
+	}
+	if cfg.SellerType != sellerAll {
+		query.Set("purveyor-input", cfg.SellerType)
+	}
+	if cfg.Postal != "" {
+		query.Set("postal", cfg.Postal)
+	}
+	if cfg.SearchDistance > 0 {
+		query.Set("search_distance", strconv.Itoa(cfg.SearchDistance))
+	}
+
+	u := url.URL{
+		Scheme:   "https",
+		Host:     cfg.City + ".craigslist.org",
+		Path:     "/search/" + cfg.Category,
+		RawQuery: query.Encode(),
+		Fragment: fmt.Sprintf("search=1~gallery~%d~0", page),
+	}
+	return u.String()
+}
+
+// Parse a loaded search results page, logging any results that had to be skipped
+func parseSearchPage(category string, sel Selectors, searchURL, htmlContent string) ([]Listing, error) {
+	listings, skipped, err := parseListings(strings.NewReader(htmlContent), category, sel)
+	if skipped > 0 {
+		fmt.Printf("Skipped %d malformed results on %s\n", skipped, searchURL)
+	}
+	return listings, err
+}
+
+// Get the HTML of whatever the browser is currently showing
+func capturePage(ctx context.Context) (string, error) {
+	captureCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var htmlContent string
+	err := chromedp.Run(captureCtx, chromedp.OuterHTML("html", &htmlContent))
+	return htmlContent, err
+}
+
+// Write a page's HTML to a timestamped file in dir
+func writePageDump(dir, htmlContent string) {
+	path := filepath.Join(dir, time.Now().Format("20060102-150405")+".html")
+	if err := os.WriteFile(path, []byte(htmlContent), 0o644); err != nil {
+		fmt.Printf("Failed to write page dump: %v\n", err)
+		return
 	}
+	fmt.Printf("Saved page dump to %s\n", path)
+}
+
+// Extract the listings from a search results page. Job and gig categories
+// show compensation where other categories show a price. A malformed result is
+// logged and skipped, so one bad element can't cost the whole page; the number
+// skipped is returned alongside the listings.
+func parseListings(r io.Reader, category string, sel Selectors) ([]Listing, int, error) {
+	var listings []Listing
+	skipped := 0
 
 	// Use goquery to parse the loaded HTML content
-	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlContent))
+	doc, err := goquery.NewDocumentFromReader(r)
 	if err != nil {
-		return listings, fmt.Errorf("failed to parse the page: %v", err)
+		return listings, 0, fmt.Errorf("failed to parse the page: %v", err)
 	}
 
 	// Extract listings
-	doc.Find("li.cl-search-result").Each(func(i int, s *goquery.Selection) {
-		title, exists := s.Attr("title")
-		if !exists {
-			title = "No title"
-		}
-		link, exists := s.Find("a").Attr("href")
-		if !exists {
+	doc.Find(sel.Result).Each(func(i int, s *goquery.Selection) {
+		listing, err := parseResult(s, category, sel)
+		if err != nil {
+			fmt.Printf("Skipping result %d: %v\n", i, err)
+			skipped++
 			return
 		}
-		price := strings.TrimSpace(s.Find(".priceinfo").Text())
-		metaText := strings.TrimSpace(s.Find(".meta").Text())
-		city := strings.Split(metaText, "·")[1] // Assuming city is after the separator
+		listings = append(listings, listing)
+	})
+
+	return listings, skipped, nil
+}
 
-		listing := Listing{
-			Title:      title,
-			Price:      price,
-			City:       strings.TrimSpace(city),
-			Posted:     time.Now(),
-			ListingURL: link,
+// Extract one listing from a search result element
+func parseResult(s *goquery.Selection, category string, sel Selectors) (listing Listing, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while parsing: %v", r)
 		}
+	}()
 
-		listings = append(listings, listing)
-	})
+	title, exists := s.Attr("title")
+	if !exists {
+		title = placeholderTitle
+	}
+	link, exists := s.Find(sel.Link).Attr("href")
+	if !exists || link == "" {
+		return listing, fmt.Errorf("no link in result %q", title)
+	}
+	price := strings.TrimSpace(s.Find(sel.Price).Text())
+	if compensationCategories[category] && price == "" {
+		price = strings.TrimSpace(s.Find(sel.Compensation).Text())
+	}
+	city := metaCity(strings.TrimSpace(s.Find(sel.Meta).Text()))
+	if sel.Location != "" {
+		city = strings.TrimSpace(s.Find(sel.Location).Text())
+	}
+
+	// Galleries lazy-load images, keeping the real URL in data-src until then
+	thumbnail := s.Find(sel.Thumbnail).First()
+	thumbnailURL, exists := thumbnail.Attr("src")
+	if !exists || thumbnailURL == "" || strings.HasPrefix(thumbnailURL, "data:") {
+		thumbnailURL = thumbnail.AttrOr("data-src", "")
+	}
+
+	// A result without a posted time of its own is taken to be posted now
+	now := time.Now().UTC()
+	posted, ok := resultPosted(s, sel.Posted, now)
+	if !ok {
+		posted = now
+	}
+	listing = Listing{
+		Title:      title,
+		Price:      price,
+		Thumbnail:  thumbnailURL,
+		City:       city,
+		Section:    parseSection(link),
+		Posted:     posted,
+		ScrapedAt:  now,
+		ListingURL: link,
+		PostID:     parsePostID(link),
+		Sponsored:  sel.Sponsored != "" && s.Is(sel.Sponsored),
+	}
+
+	// Everything in the free section is free, whatever the title says
+	if category == freeCategory {
+		listing.Price = "free"
+		listing.PriceCents = priceCents(listing.Price)
+		return listing, nil
+	}
 
-	return listings, nil
+	// Keep a range's lower bound as the price and treat "call for price" as
+	// no price, so both compare and sort like any other; the original stays in
+	// PriceText. Pay rates are left as shown.
+	if !compensationCategories[category] {
+		if normalized := normalizePrice(listing.Price); normalized != listing.Price {
+			listing.PriceText = listing.Price
+			listing.Price = normalized
+		}
+	}
+
+	// Fall back to a price mentioned in the title; pay rates in job titles
+	// ("$20/hr") aren't prices, so leave those alone
+	if listing.Price == "" && !compensationCategories[category] {
+		listing.Price, listing.PriceInferred = inferPrice(title)
+	}
+	if !compensationCategories[category] {
+		listing.PriceCents = priceCents(listing.Price)
+	}
+
+	return listing, nil
 }
 
-func sendNotification(message string) {
-	ntfyUrl := "https://ntfy.sh/charlottecraig"
+// The layouts of the posted times in search results: the datetime attribute
+// of a <time>, then the title of the gallery's date, e.g. "Mon Oct 14 2024
+// 10:05:32 GMT-0400 (Eastern Daylight Time)" with the zone name cut off.
+// Localized titles put the day before the month, e.g. "lun. 14 oct. 2024
+// 10:05:32 GMT-0400", once their names are made English. Times without a zone
+// are in the local time zone.
+var (
+	resultDatetimeLayouts = []string{time.RFC3339, detailTimeLayout, "2006-01-02 15:04:05", "2006-01-02 15:04"}
+	resultTitleLayouts    = []string{"Mon Jan 2 2006 15:04:05 GMT-0700", "Mon 2 Jan 2006 15:04:05 GMT-0700"}
+)
+
+// Weekday and month names, full and abbreviated, in the languages
+// -accept-language is likely to get pages in (Spanish, French, and German), by
+// their English abbreviation. They're kept apart since some abbreviations
+// mean both, e.g. "mar." for Tuesday and for March.
+var (
+	localizedWeekdays = map[string]string{
+		"lun": "Mon", "lunes": "Mon", "lundi": "Mon", "mo": "Mon", "montag": "Mon",
+		"mar": "Tue", "martes": "Tue", "mardi": "Tue", "di": "Tue", "dienstag": "Tue",
+		"mié": "Wed", "miércoles": "Wed", "mer": "Wed", "mercredi": "Wed", "mi": "Wed", "mittwoch": "Wed",
+		"jue": "Thu", "jueves": "Thu", "jeu": "Thu", "jeudi": "Thu", "do": "Thu", "donnerstag": "Thu",
+		"vie": "Fri", "viernes": "Fri", "ven": "Fri", "vendredi": "Fri", "fr": "Fri", "freitag": "Fri",
+		"sáb": "Sat", "sábado": "Sat", "sam": "Sat", "samedi": "Sat", "sa": "Sat", "samstag": "Sat",
+		"dom": "Sun", "domingo": "Sun", "dim": "Sun", "dimanche": "Sun", "so": "Sun", "sonntag": "Sun",
+	}
+	localizedMonths = map[string]string{
+		"ene": "Jan", "enero": "Jan", "janv": "Jan", "janvier": "Jan", "januar": "Jan",
+		"febrero": "Feb", "févr": "Feb", "février": "Feb", "februar": "Feb",
+		"marzo": "Mar", "mars": "Mar", "mär": "Mar", "märz": "Mar",
+		"abr": "Apr", "abril": "Apr", "avr": "Apr", "avril": "Apr",
+		"mayo": "May", "mai": "May",
+		"junio": "Jun", "juin": "Jun", "juni": "Jun",
+		"julio": "Jul", "juil": "Jul", "juillet": "Jul", "juli": "Jul",
+		"ago": "Aug", "agosto": "Aug", "août": "Aug",
+		"sept": "Sep", "septiembre": "Sep", "septembre": "Sep",
+		"octubre": "Oct", "octobre": "Oct", "okt": "Oct", "oktober": "Oct",
+		"noviembre": "Nov", "novembre": "Nov",
+		"dic": "Dec", "diciembre": "Dec", "déc": "Dec", "décembre": "Dec", "dez": "Dec", "dezember": "Dec",
+	}
+)
+
+// Replace the localized weekday and month names in a result's date title with
+// English ones, dropping the periods that abbreviate them, so that
+// resultTitleLayouts can parse it. The weekday comes first and the month is
+// one of the two words after it; names spelled as in English, like "oct", are
+// left for the parser since it ignores case. English titles come back unchanged.
+func englishDateNames(title string) string {
+	words := strings.Fields(title)
+	for i, word := range words {
+		names := localizedMonths
+		if i == 0 {
+			names = localizedWeekdays
+		} else if i > 2 {
+			break
+		}
+		words[i] = strings.TrimRight(word, ".,")
+		if english, ok := names[strings.ToLower(words[i])]; ok {
+			words[i] = english
+		}
+	}
+	return strings.Join(words, " ")
+}
 
-	req, err := http.NewRequest("POST", ntfyUrl, strings.NewReader(message))
+// Find when a search result was posted, from the datetime or title attribute
+// of the first element in it matching selector. A time after now, as from a
+// skewed clock, is taken to be now. Reports false if there's no usable time.
+func resultPosted(s *goquery.Selection, selector string, now time.Time) (time.Time, bool) {
+	if selector == "" {
+		return time.Time{}, false
+	}
+	el := s.Find(selector).First()
+	t, ok := parseResultTime(el.AttrOr("datetime", ""), resultDatetimeLayouts)
+	if !ok {
+		title, _, _ := strings.Cut(el.AttrOr("title", ""), " (")
+		t, ok = parseResultTime(englishDateNames(title), resultTitleLayouts)
+	}
+	if !ok {
+		return time.Time{}, false
+	}
+	if t.After(now) {
+		return now, true
+	}
+	return t.UTC(), true
+}
+
+// Parse s with the first of layouts that fits it
+func parseResultTime(s string, layouts []string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Extract the city from a result's meta text, e.g. "Matthews" from
+// "10/14·Matthews·". Job and gig results often have no city at all.
+func metaCity(metaText string) string {
+	parts := strings.Split(metaText, "·")
+	if len(parts) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(parts[1]) // Assuming city is after the separator
+}
+
+// Extract the post ID from a listing URL, e.g. "7781234567" from
+// https://charlotte.craigslist.org/fuo/d/charlotte-couch/7781234567.html
+func parsePostID(listingURL string) string {
+	u, err := url.Parse(listingURL)
 	if err != nil {
-		fmt.Println("Failed to create request:", err)
-		return
+		return ""
+	}
+	match := postIDRegexp.FindStringSubmatch(u.Path)
+	if match == nil {
+		return ""
 	}
-	req.Header.Set("Title", "Craigslist Alert")
-	req.Header.Set("Priority", "high")
+	return match[1]
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// Extract the section code from a listing URL, e.g. "fuo" from
+// https://charlotte.craigslist.org/fuo/d/charlotte-couch/7781234567.html
+func parseSection(listingURL string) string {
+	u, err := url.Parse(listingURL)
 	if err != nil {
-		fmt.Println("Failed to send notification:", err)
-		return
+		return ""
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	// Current URLs put the section just before the "d" (detail) segment
+	for i, segment := range segments {
+		if segment == "d" && i > 0 {
+			return segments[i-1]
+		}
+	}
+	// Older URLs end in /<section>/<postID>.html
+	if len(segments) >= 2 {
+		return segments[len(segments)-2]
+	}
+	return ""
+}
+
+// Report whether a URL is on craigslist.org or one of its subdomains. Links
+// taken from scraped pages are checked before they're fetched, so a
+// manipulated or offsite link can't send the bot to an arbitrary host.
+func isCraigslistURL(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.User != nil {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	return host == "craigslist.org" || strings.HasSuffix(host, ".craigslist.org")
+}
+
+// Extract a price from a listing title, e.g. "Couch - $50"
+func inferPrice(title string) (string, bool) {
+	price := titlePriceRegexp.FindString(title)
+	if price == "" {
+		return "", false
+	}
+	return strings.TrimRight(price, ",."), true
+}
+
+// The fields available to the notification template
+type notificationData struct {
+	Title  string
+	Price  string
+	City   string
+	URL    string
+	Posted time.Time // or when it was updated, with -recency-basis updated
+	Age    string    // how long ago that was, e.g. "3 minutes ago"
+	Score  int       // the keyword score, 0 without keyword_weights
+
+	BelowAverage  bool // priced -below-avg-pct under its category's median
+	SuspectedScam bool // priced under -scam-threshold, see isSuspectedScam
+}
+
+// Render the notification message for a listing, showing its posted or
+// updated time, as basis says, in loc
+func renderNotification(tmpl *template.Template, listing Listing, loc *time.Location, basis string) (string, error) {
+	recency := listing.recency(basis)
+	data := notificationData{
+		Title:  listing.Title,
+		Price:  listing.Price,
+		City:   listing.City,
+		URL:    listing.ListingURL,
+		Posted: recency.In(loc),
+		Age:    humanizeAge(recency),
+		Score:  listing.Score,
+
+		BelowAverage:  listing.BelowAverage,
+		SuspectedScam: listing.SuspectedScam,
+	}
+
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// Describe how long ago t was, e.g. "just now", "1 minute ago", "3 hours ago"
+func humanizeAge(t time.Time) string {
+	age := time.Since(t)
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", unit)
+		}
+		return fmt.Sprintf("%d %ss ago", n, unit)
+	}
+
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return plural(int(age/time.Minute), "minute")
+	case age < 24*time.Hour:
+		return plural(int(age/time.Hour), "hour")
+	default:
+		return plural(int(age/(24*time.Hour)), "day")
 	}
-	defer resp.Body.Close()
+}
+
+// Page through the search results once, storing every listing. Old listings
+// are kept and nothing is notified. Stops at the first page that yields no
+// listings not already seen during this pass (Craigslist repeats the last page
+// when asked for one past the end), or after cfg.BackfillPages pages if set.
+// Each page is scraped by the Scraper makeScraper returns for it.
+func backfill(ctx context.Context, cfg Config, db *sql.DB, feed *jsonlWriter, makeScraper func(cfg Config, searchURL string) Scraper) error {
+	// The page number is only in the URL fragment, which the http engine
+	// never sends, so every page would come back as the first and the pass
+	// would stop after it. With auto, Chrome loads every page instead.
+	if cfg.Engine == engineAuto {
+		cfg.Engine = engineChromedp
+	}
+	seen := make(map[string]bool)
+	total, inserted := 0, 0
+
+	for page := 0; cfg.BackfillPages == 0 || page < cfg.BackfillPages; page++ {
+		listings, err := makeScraper(cfg, buildSearchURL(cfg, page)).Scrape(ctx)
+		if err != nil {
+			return fmt.Errorf("page %d: %v", page, err)
+		}
+
+		fresh, pageInserted := 0, 0
+		for _, listing := range listings {
+			if seen[listing.ListingURL] {
+				continue
+			}
+			seen[listing.ListingURL] = true
+			fresh++
+
+			if err := listing.Valid(); err != nil {
+				debugf("Skipping invalid listing %q: %v", listing.Title, err)
+				continue
+			}
+			if cfg.RequireImage && listing.Thumbnail == "" {
+				debugf("Skipping listing without an image: %s", listing.Title)
+				continue
+			}
+			isNew, err := insertListing(ctx, db, listing)
+			if err != nil {
+				fmt.Printf("Failed to insert listing: %v\n", err)
+				continue
+			}
+			// So the monitor knows these posts once their rows are cleaned out
+			if _, err := recordSighting(ctx, db, listing); err != nil {
+				fmt.Printf("Failed to record sighting: %v\n", err)
+			}
+			if isNew {
+				pageInserted++
+				if feed != nil {
+					if err := feed.Write(listing); err != nil {
+						fmt.Printf("Failed to write listing to -jsonl-out: %v\n", err)
+					}
+				}
+			}
+		}
+		total += fresh
+		inserted += pageInserted
+		fmt.Printf("Backfill page %d: %d listings, %d new, %d inserted so far\n", page, fresh, pageInserted, inserted)
 
-	if resp.StatusCode != 200 {
-		fmt.Printf("Failed to send notification: Status code %d\n", resp.StatusCode)
-	} else {
-		fmt.Printf("Notification sent: %s\n", message)
+		if fresh == 0 {
+			break
+		}
+
+		// Delay to avoid IP bans
+		if err := sleepCtx(ctx, time.Duration(2+len(listings)%3)*time.Second); err != nil {
+			return err
+		}
 	}
+
+	fmt.Printf("Backfill complete: %d listings scraped, %d inserted\n", total, inserted)
+	return nil
 }
 
 func main() {
+	flagCfg, err := parseFlags()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	cfg, err := loadConfig(flagCfg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Replaying a saved page needs neither the database nor the browser
+	if cfg.Replay != "" {
+		if err := replayDump(cfg, cfg.Replay); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	// Print the search URLs to check them in a browser, without scraping
+	if cfg.PrintURL {
+		printSearchURLs(cfg)
+		return
+	}
+
+	// Check the notifiers before trusting them with real listings
+	if cfg.SendTest {
+		// Exit non-zero on failure, so scripts and CI can rely on the check
+		if failed := sendTestNotifications(context.Background(), cfg); failed > 0 {
+			fmt.Printf("%d notifiers failed\n", failed)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Cancelled on Ctrl-C or SIGTERM so the loop, queries, and browser wind down cleanly
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Logged at the start and in the shutdown summary, so runs can be told apart
+	runIDVar.Set(currentRun.id)
+	fmt.Printf("Starting run %s\n", currentRun.id)
+
+	// Keep retrying what -notify-spool holds, including what an earlier run left
+	if notifySpool != nil {
+		go notifySpool.drain(ctx)
+	}
+
 	// Initialize database
-	db, err := initDB()
+	db, err := initDB(ctx, cfg.DBPath, cfg.SQLiteSync)
 	if err != nil {
 		fmt.Printf("Failed to initialize database: %v\n", err)
 		return
 	}
 	defer db.Close()
 
-	// Create a new context with a timeout to ensure we don't wait forever
-	ctx, cancel := chromedp.NewContext(context.Background())
+	// An import loads listings into the database and stops there
+	if cfg.Import != "" {
+		f, err := os.Open(cfg.Import)
+		if err != nil {
+			fmt.Printf("Failed to open -import file: %v\n", err)
+			return
+		}
+		defer f.Close()
+		imported, err := importListings(ctx, db, f)
+		if err != nil {
+			fmt.Printf("Import failed after %d new listings: %v\n", imported, err)
+			return
+		}
+		fmt.Printf("Imported %d new listings from %s\n", imported, cfg.Import)
+		if !cfg.NoDelete {
+			fmt.Println("Listings older than -retention will be deleted on the next run unless it uses -no-delete")
+		}
+		return
+	}
+
+	// With -partition-by-city, each site's listings get a database of their own
+	partitions, err := openPartitions(ctx, cfg, db)
+	if err != nil {
+		fmt.Printf("Failed to initialize database partitions: %v\n", err)
+		return
+	}
+	defer closePartitions(partitions)
+
+	// Stream new listings to -jsonl-out alongside the database
+	var feed *jsonlWriter
+	if cfg.JSONLOut != "" {
+		feed, err = openJSONL(cfg.JSONLOut)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer feed.Close()
+	}
+
+	// Serve the API alongside the scrape loop
+	if cfg.ListenAddr != "" {
+		srv, err := startServer(cfg, partitionDBs(db, partitions))
+		if err != nil {
+			fmt.Printf("Failed to start API server: %v\n", err)
+			return
+		}
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				fmt.Printf("Failed to shut down API server: %v\n", err)
+			}
+		}()
+	}
+
+	// The allocator owns the Chrome process and the context owns the browser
+	// session inside it. On shutdown the browser is closed first, then the
+	// allocator waits for Chrome to exit and removes its profile directory.
+	// To check for leaks, stop the bot with Ctrl-C and run `pgrep -f chrome`;
+	// nothing started by the bot should remain.
+	allocCtx, cancelAlloc := chromedp.NewExecAllocator(context.Background(), chromeAllocatorOptions(cfg)...)
+	browserCtx, cancelBrowser := chromedp.NewContext(allocCtx)
+	defer func() {
+		cancelBrowser()
+		cancelAlloc()
+		fmt.Println("Browser closed")
+	}()
+
+	// Abort any in-flight page load as soon as shutdown starts
+	stopBrowserOnSignal := context.AfterFunc(ctx, cancelBrowser)
+	defer stopBrowserOnSignal()
+
+	// The browser is only needed for chromedp scraping (including the auto
+	// engine's fallback) and enrichment. Starting it up front means every
+	// profile's tab opens in this one browser rather than in a browser of its own.
+	if cfg.Engine != engineHTTP || cfg.Enrich {
+		if err := chromedp.Run(browserCtx); err != nil {
+			fmt.Printf("Failed to start browser: %v\n", err)
+			if hint := browserStartHint(err); hint != "" {
+				fmt.Println(hint)
+			}
+			return
+		}
+	}
+
+	// Profiles from the -config file get their own database and a tab of their own
+	monitors := []monitor{newMonitor(cfg, db, partitions, browserCtx)}
+	for _, profile := range cfg.Profiles {
+		profileDB, err := initDB(ctx, profile.DBPath, profile.SQLiteSync)
+		if err != nil {
+			fmt.Printf("Failed to initialize database for profile %s: %v\n", profile.Name, err)
+			return
+		}
+		defer profileDB.Close()
+		profilePartitions, err := openPartitions(ctx, profile, profileDB)
+		if err != nil {
+			fmt.Printf("Failed to initialize database partitions for profile %s: %v\n", profile.Name, err)
+			return
+		}
+		defer closePartitions(profilePartitions)
+		tabCtx, cancelTab := chromedp.NewContext(browserCtx)
+		defer cancelTab()
+		monitors = append(monitors, newMonitor(profile, profileDB, profilePartitions, tabCtx))
+	}
+
+	// A backfill is a one-off pass over every page instead of the steady-state loop
+	if cfg.Backfill {
+		for _, m := range monitors {
+			mcfg := *m.config.Load()
+			for _, site := range searchSites(mcfg) {
+				siteCfg := mcfg
+				siteCfg.City = site
+				if err := backfill(m.tabCtx, siteCfg, partitionFor(m.db, m.partitions, site), feed, newScraper); err != nil {
+					fmt.Printf("%sBackfill of %s failed: %v\n", mcfg.logPrefix(), site, err)
+				}
+			}
+		}
+		// Backfilled rows are stamped with when they were scraped, so the
+		// default hour of retention would clear them out on the next run
+		if !cfg.NoDelete {
+			fmt.Printf("Backfilled listings older than -retention (%v) will be deleted on the next run unless it uses -no-delete or a longer -retention\n", cfg.Retention)
+		}
+		return
+	}
+
+	// Reload the -config file on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go reloadOnSignal(ctx, hup, flagCfg, monitors)
+
+	// Give whatever the bot depends on time to come up before the first scrape
+	if cfg.StartDelay > 0 {
+		fmt.Printf("Waiting %v before the first scrape\n", cfg.StartDelay)
+		if err := sleepCtx(ctx, cfg.StartDelay); err != nil {
+			fmt.Println("Shutting down")
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, m := range monitors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runMonitor(ctx, m, feed)
+		}()
+	}
+	wg.Wait()
+
+	// Sum up the run; ctx is done by now, so the queries and the notification
+	// get a context of their own
+	summary := currentRun.summary()
+	stored := 0
+	for _, m := range monitors {
+		for _, mdb := range partitionDBs(m.db, m.partitions) {
+			n, err := countListings(context.Background(), mdb)
+			if err != nil {
+				fmt.Printf("Failed to count listings: %v\n", err)
+				continue
+			}
+			stored += n
+		}
+	}
+	summary += fmt.Sprintf("; %d listings stored", stored)
+	fmt.Println(summary)
+	if cfg.ReportNotify != "" {
+		dispatch(context.Background(), cfg.Notifiers, []string{cfg.ReportNotify}, Notification{Message: summary})
+	}
+}
+
+// One independent search loop: the main one from the flags, or a profile
+type monitor struct {
+	name   string                  // the profile's name; empty for the main monitor
+	config *atomic.Pointer[Config] // swapped by reloadOnSignal, and read at the start of each cycle
+	db     *sql.DB
+	tabCtx context.Context // the browser tab this monitor scrapes in
+
+	// With -partition-by-city, the database of each site at startup
+	partitions map[string]*sql.DB
+}
+
+func newMonitor(cfg Config, db *sql.DB, partitions map[string]*sql.DB, tabCtx context.Context) monitor {
+	m := monitor{name: cfg.Name, config: new(atomic.Pointer[Config]), db: db, partitions: partitions, tabCtx: tabCtx}
+	m.config.Store(&cfg)
+	return m
+}
+
+// Scrape, store, and notify every cfg.Interval until ctx is done. Settings
+// taken from the flags are fixed at startup; the rest follow config reloads
+// from the next cycle on.
+func runMonitor(ctx context.Context, m monitor, feed *jsonlWriter) {
+	cfg := *m.config.Load()
+	interval := cfg.Interval
+	state := &cycleState{browserCtx: m.tabCtx, newScraper: newScraper, feed: feed, partitions: m.partitions, firstCycle: true}
+
+	// Stops this monitor's background workers whichever way it returns
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	// Loop to check new listings every minute
-	checkTicker := time.NewTicker(1 * time.Minute)
+	// Fetch detail pages in the background so the list loop never waits on them
+	if cfg.Enrich {
+		queue := make(chan detailRequest, cfg.EnrichQueue)
+		enrich := func(req detailRequest) { enrichListing(m.tabCtx, req, cfg.ImageStore) }
+		go enrichListings(m.tabCtx, queue, cfg.EnrichInterval, cfg.MaxConcurrentDetails, enrich)
+		state.enrichQueue = queue
+	}
+
+	// With -notify-rate, notifications wait in a queue and go out at the allowed pace
+	if cfg.NotifyRate > 0 {
+		queue := make(chan pendingNotification, notifyQueueSize)
+		drained := make(chan struct{})
+		go func() {
+			drainNotifications(ctx, queue, cfg.NotifyRate)
+			close(drained)
+		}()
+		defer func() {
+			cancel()
+			<-drained
+		}()
+		state.notifyQueue = queue
+	}
+
+	// Ticks between cycles
+	checkTicker := time.NewTicker(interval)
 	defer checkTicker.Stop()
 
-	for {
-		select {
-		case <-checkTicker.C:
-			listings, err := scrapeListings(ctx)
+	// Consecutive cycles that Craigslist blocked or every site failed, and
+	// when scraping may resume after backing off for them
+	blockStreak, failStreak := 0, 0
+	var resumeAt time.Time
+
+	// With -run-for, stop once the time is up; it's only checked between
+	// cycles, so a cycle in progress always finishes
+	var runFor <-chan time.Time
+	if cfg.RunFor > 0 {
+		runFor = time.After(cfg.RunFor)
+	}
+
+	// Scrape once right away, then every interval
+	for first := true; ; first = false {
+		if !first {
+			select {
+			case <-ctx.Done():
+				fmt.Printf("%sShutting down\n", cfg.logPrefix())
+				return
+			case <-runFor:
+				fmt.Printf("%sRan for %v, stopping\n", cfg.logPrefix(), cfg.RunFor)
+				return
+			case <-checkTicker.C:
+			}
+		}
+
+		// The whole cycle runs with the config as it was when it started
+		cfg := *m.config.Load()
+		if cfg.Interval != interval {
+			interval = cfg.Interval
+			checkTicker.Reset(interval)
+		}
+
+		// Sit out the ticks while paused via the API or until a backoff has passed
+		if scrapingPaused.Load() {
+			debugf("%sPaused, skipping cycle", cfg.logPrefix())
+			continue
+		}
+		if time.Now().Before(resumeAt) {
+			continue
+		}
+
+		err := doCycle(ctx, cfg, m.db, state)
+		if ctx.Err() != nil {
+			fmt.Printf("%sShutting down\n", cfg.logPrefix())
+			return
+		}
+		currentRun.cycles.Add(1)
+		if errors.Is(err, ErrBlocked) {
+			currentRun.blockedCycles.Add(1)
+			blockStreak++
+			backoff := backoffDelay(blockBackoffMin, blockStreak, max(cfg.MaxBackoff, blockBackoffMin))
+			resumeAt = time.Now().Add(backoff)
+			fmt.Printf("%sBlocked by Craigslist, backing off for %v\n", cfg.logPrefix(), backoff)
+			if blockStreak == 1 && cfg.BlockAlert != "" {
+				n := Notification{Message: fmt.Sprintf("%sCraigslist is blocking the bot; pausing scrapes for %v", cfg.logPrefix(), backoff)}
+				dispatch(ctx, cfg.Notifiers, []string{cfg.BlockAlert}, n)
+			}
+			continue
+		}
+		// Back off while every site keeps failing: a normal interval after the
+		// first failed cycle, then doubling up to -max-backoff
+		if err != nil {
+			currentRun.failedCycles.Add(1)
+			failStreak++
+			backoff := backoffDelay(cfg.Interval, failStreak, max(cfg.MaxBackoff, cfg.Interval))
+			if backoff > cfg.Interval {
+				fmt.Printf("%sScraping failed %d cycles in a row, backing off for %v\n", cfg.logPrefix(), failStreak, backoff)
+				resumeAt = time.Now().Add(backoff)
+			}
+			continue
+		}
+		if failStreak > 1 {
+			fmt.Printf("%sScraping recovered after %d failed cycles, leaving backoff\n", cfg.logPrefix(), failStreak)
+		}
+		failStreak = 0
+		if blockStreak > 0 {
+			fmt.Printf("%sNo longer blocked by Craigslist\n", cfg.logPrefix())
+			blockStreak = 0
+		}
+	}
+}
+
+// What a monitor's cycles share: where listings go besides the database, and
+// whether the first successful cycle is still to come
+type cycleState struct {
+	browserCtx  context.Context                            // the tab to scrape in
+	newScraper  func(cfg Config, searchURL string) Scraper // makes each site's scraper: newScraper, or a fake
+	feed        *jsonlWriter                               // nil without -jsonl-out
+	enrichQueue chan<- detailRequest
+	notifyQueue chan<- pendingNotification // nil without -notify-rate
+	partitions  map[string]*sql.DB         // nil without -partition-by-city
+	digest      map[string][]string        // messages held back by -quiet-digest, by notifier
+
+	// With -suppress-initial, the first successful scrape only seeds the database
+	firstCycle bool
+}
+
+// Scrape every site cfg searches once, then store the listings and notify
+// cfg.Notifiers about the interesting ones. Returns ErrBlocked if Craigslist
+// blocked the scrape, or an error if every site failed; either way nothing
+// is stored.
+func doCycle(ctx context.Context, cfg Config, db *sql.DB, state *cycleState) error {
+	// Scrape every site a saved search needs, carrying on past failures.
+	// With -nearby, the areas their pages suggest are scraped after them.
+	sites := searchSites(cfg)
+	searched := len(sites)
+	var listings []Listing
+	failures := 0
+	for i := 0; i < len(sites); i++ {
+		site := sites[i]
+
+		// Delay between sites to avoid IP bans
+		if i > 0 {
+			if err := sleepCtx(ctx, time.Duration(2+len(listings)%3)*time.Second); err != nil {
+				return err
+			}
+		}
+
+		siteCfg := cfg
+		siteCfg.City = site
+		found, err := state.newScraper(siteCfg, buildSearchURL(siteCfg, 0)).Scrape(state.browserCtx)
+		if errors.Is(err, ErrBlocked) {
+			return err
+		}
+		if err != nil {
+			fmt.Printf("%sFailed to scrape listings from %s: %v\n", cfg.logPrefix(), site, err)
+			currentRun.siteErrors.Add(1)
+			if i < searched {
+				failures++
+			}
+		} else {
+			listings = append(listings, found...)
+		}
+
+		if cfg.Nearby && i == searched-1 && failures < searched {
+			nearby := nearbySites(sites)
+			if len(nearby) > 0 {
+				fmt.Printf("%sAlso scraping nearby areas: %s\n", cfg.logPrefix(), strings.Join(nearby, ", "))
+			}
+			sites = append(slices.Clip(sites), nearby...)
+		}
+	}
+	if failures == searched {
+		return fmt.Errorf("all %d sites failed", failures)
+	}
+
+	// Overlapping sites and nearby areas can turn up the same post more than
+	// once; it's stored, notified, and counted once, as the first site found it
+	listings, overlap := dedupListings(listings)
+	if overlap > 0 {
+		debugf("%sDropped %d listings found on more than one site", cfg.logPrefix(), overlap)
+	}
+	scrapedCount.Add(int64(len(listings)))
+
+	// With -partition-by-city, each site's listings go to its own database
+	var counts cycleCounts
+	for _, part := range partitionListings(listings, db, state.partitions) {
+		counts.add(storeListings(ctx, cfg, part.db, state, part.listings))
+	}
+
+	if state.firstCycle && cfg.SuppressInitial {
+		fmt.Printf("%sStored %d listings from the initial scrape without notifying\n", cfg.logPrefix(), len(listings))
+	}
+
+	// -max-rows caps the databases together, so it's applied once they're all stored
+	if cfg.MaxRows > 0 {
+		pruned, err := pruneToLimit(ctx, partitionDBs(db, state.partitions), cfg.MaxRows)
+		if err != nil {
+			fmt.Printf("%sFailed to prune listings: %v\n", cfg.logPrefix(), err)
+		}
+		counts.deleted += pruned
+	}
+
+	if err := updateStoredGauge(ctx, cfg, partitionDBs(db, state.partitions)); err != nil {
+		fmt.Printf("%sFailed to count stored listings: %v\n", cfg.logPrefix(), err)
+	}
+
+	// Send what quiet hours held back once they're over
+	if len(state.digest) > 0 && !cfg.quietNow() {
+		counts.notified += sendDigest(ctx, cfg, state)
+	}
+	state.firstCycle = false
+
+	// One heartbeat line per cycle
+	newest := "none"
+	if len(listings) > 0 {
+		newest = fmt.Sprintf("%q", listings[0].Title)
+	}
+	fmt.Printf("%sCycle complete: %d scraped, %d new, %d duplicate, %d filtered, %d notified, %d deleted, newest %s\n", cfg.logPrefix(), len(listings), counts.inserted, counts.duplicates, counts.filtered, counts.notified, counts.deleted, newest)
+
+	// Delay to avoid IP bans; the cycle's work is done, so being cut short
+	// by shutdown isn't a failure
+	sleepCtx(ctx, time.Duration(2+len(listings)%3)*time.Second)
+	return nil
+}
+
+// Drop the listings that repeat an earlier one's post ID, or its URL when it
+// has none, keeping the rest in order. Returns how many were dropped too.
+func dedupListings(listings []Listing) ([]Listing, int) {
+	seen := make(map[string]bool, len(listings))
+	unique := make([]Listing, 0, len(listings))
+	for _, listing := range listings {
+		key := listing.PostID
+		if key == "" {
+			key = listing.ListingURL
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, listing)
+	}
+	return unique, len(listings) - len(unique)
+}
+
+// What became of a cycle's listings, for the heartbeat line
+type cycleCounts struct {
+	inserted, duplicates, filtered, notified int
+	deleted                                  int64
+}
+
+func (cc *cycleCounts) add(other cycleCounts) {
+	cc.inserted += other.inserted
+	cc.duplicates += other.duplicates
+	cc.filtered += other.filtered
+	cc.notified += other.notified
+	cc.deleted += other.deleted
+}
+
+// Store scraped listings in db, notify about the interesting ones, and then
+// clear out what db no longer needs to keep
+func storeListings(ctx context.Context, cfg Config, db *sql.DB, state *cycleState, listings []Listing) cycleCounts {
+	var counts cycleCounts
+
+	// With -below-avg-pct or -scam-threshold, listings are compared against
+	// their category's median as it stood before this cycle, and new ones are
+	// then added to its sample
+	var priceStats map[string]priceStat
+	cyclePrices := make(map[string][]int)
+	if (cfg.BelowAvgPct > 0 || cfg.ScamThreshold > 0) && !compensationCategories[cfg.Category] {
+		var err error
+		priceStats, err = loadPriceStats(ctx, db)
+		if err != nil {
+			fmt.Printf("%sFailed to load price stats: %v\n", cfg.logPrefix(), err)
+		}
+	}
+
+	for _, listing := range listings {
+		if err := listing.Valid(); err != nil {
+			debugf("%sSkipping invalid listing %q: %v", cfg.logPrefix(), listing.Title, err)
+			continue
+		}
+		if cfg.RequireImage && listing.Thumbnail == "" {
+			debugf("%sSkipping listing without an image: %s", cfg.logPrefix(), listing.Title)
+			continue
+		}
+		cityCounts.Add(listing.City, 1)
+		if len(cfg.KeywordWeights) > 0 {
+			listing.Score = scoreListing(listing, cfg.KeywordWeights)
+		}
+		listing.MatchedKeywords = matchedKeywords(cfg.Searches, listing.Site, listing)
+
+		// Insert the listing into the database
+		isNew, err := insertListing(ctx, db, listing)
+		if err != nil {
+			fmt.Printf("%sFailed to insert listing: %v\n", cfg.logPrefix(), err)
+			continue
+		}
+		// A post whose row was cleaned out, or that was stored before a
+		// restart, only counts as new for notifying if seen_posts doesn't
+		// know it. One whose title or price was edited counts as new again.
+		seen, err := recordSighting(ctx, db, listing)
+		if err != nil {
+			fmt.Printf("%sFailed to record sighting: %v\n", cfg.logPrefix(), err)
+		}
+		fresh := (isNew && seen != sightingUnchanged) || seen == sightingChanged
+
+		// Priced listings are checked every cycle, not just when new, so
+		// repeat mode skips or flags a suspected scam each time it comes round.
+		// Free listings would drag the average down, so only prices count.
+		if price, ok := parsePrice(listing.Price); priceStats != nil && ok && price > 0 {
+			category := priceCategory(cfg, listing)
+			if cfg.BelowAvgPct > 0 {
+				listing.BelowAverage = belowMedian(priceStats, category, price, cfg.BelowAvgPct)
+			}
+			if stat, ok := priceStats[category]; cfg.ScamThreshold > 0 && ok && stat.samples >= priceStatsMinSamples {
+				listing.SuspectedScam = isSuspectedScam(listing, int(stat.median), cfg.ScamThreshold)
+			}
+			// Each listing's price joins the sample once, and scammers' not at all
+			if isNew && !listing.SuspectedScam {
+				cyclePrices[category] = append(cyclePrices[category], price)
+			}
+		}
+
+		if isNew {
+			countOutcome(insertedCount, insertedByCity, listing.City)
+			counts.inserted++
+
+			if state.enrichQueue != nil {
+				queueDetails(state.enrichQueue, db, listing)
+			}
+
+			listing.LikelyRepost, err = checkRepost(ctx, db, listing, cfg.RepostWindow)
 			if err != nil {
-				fmt.Printf("Failed to scrape listings: %v\n", err)
-				continue
+				fmt.Printf("%sFailed to check for repost: %v\n", cfg.logPrefix(), err)
 			}
 
-			for _, listing := range listings {
-				// Insert the listing into the database
-				err := insertListing(db, listing)
-				if err != nil {
-					fmt.Printf("Failed to insert listing: %v\n", err)
-					continue
+			if state.feed != nil {
+				if err := state.feed.Write(listing); err != nil {
+					fmt.Printf("%sFailed to write listing to -jsonl-out: %v\n", cfg.logPrefix(), err)
 				}
+			}
+		}
 
-				// If the price is free, empty, or unknown, send a notification
-				if strings.ToLower(listing.Price) == "free" || listing.Price == "" || listing.Price == "()" {
-					sendNotification(fmt.Sprintf("New free or unknown price listing! %s (%s) %s", listing.Title, listing.Price, listing.City))
-				}
+		if !isNew {
+			countOutcome(duplicateCount, duplicateByCity, listing.City)
+			counts.duplicates++
+
+			// Fingerprints are only checked on insert, so -suppress-reposts
+			// goes by what was found then
+			listing.LikelyRepost, err = storedRepost(ctx, db, listing.ListingURL)
+			if err != nil {
+				fmt.Printf("%sFailed to load repost flag: %v\n", cfg.logPrefix(), err)
+			}
+		}
+
+		if !shouldNotify(listing, cfg) {
+			countOutcome(filteredCount, filteredByCity, listing.City)
+			counts.filtered++
+			continue
+		}
+		matched := matchingSearches(cfg.Searches, listing.Site, listing)
+
+		// Record seeded listings as notified so repeat mode's cooldown applies to them too
+		if state.firstCycle && cfg.SuppressInitial {
+			if err := markNotified(ctx, db, listing.ListingURL); err != nil {
+				fmt.Printf("%sFailed to mark listing as notified: %v\n", cfg.logPrefix(), err)
 			}
+			continue
+		}
 
-			// Delete listings older than an hour
-			err = deleteOldListings(db)
+		if listing.LikelyRepost && cfg.SuppressReposts {
+			fmt.Printf("%sSkipping likely repost: %s\n", cfg.logPrefix(), listing.Title)
+			continue
+		}
+		if listing.Sponsored && cfg.ExcludeSponsored {
+			fmt.Printf("%sSkipping sponsored result: %s\n", cfg.logPrefix(), listing.Title)
+			continue
+		}
+		if listing.SuspectedScam && cfg.ScamAction == scamSkip {
+			fmt.Printf("%sSkipping suspected scam: %s\n", cfg.logPrefix(), listing.Title)
+			continue
+		}
+
+		// Listings we already know about are only re-sent in repeat mode, once the cooldown has passed
+		if !fresh {
+			if cfg.NotifyMode != notifyRepeat {
+				continue
+			}
+			recent, err := notifiedWithin(ctx, db, listing.ListingURL, cfg.RenotifyAfter)
+			if err != nil {
+				fmt.Printf("%sFailed to check last notification: %v\n", cfg.logPrefix(), err)
+				continue
+			}
+			if recent {
+				continue
+			}
+			// This scrape only knows when it was seen; the row has when it
+			// was posted and updated, from the detail page with -enrich
+			if err := loadPostTimes(ctx, db, &listing); err != nil {
+				fmt.Printf("%sFailed to load posted time: %v\n", cfg.logPrefix(), err)
+			}
+		}
+
+		if cfg.DedupCrosspost {
+			crosspost, err := crosspostNotified(ctx, db, listing, cfg.RepostWindow)
 			if err != nil {
-				fmt.Printf("Failed to delete old listings: %v\n", err)
+				fmt.Printf("%sFailed to check for cross-posts: %v\n", cfg.logPrefix(), err)
+			} else if crosspost {
+				fmt.Printf("%sSkipping cross-post of an already notified listing: %s\n", cfg.logPrefix(), listing.Title)
+				continue
 			}
+		}
 
-			// Delay to avoid IP bans
-			time.Sleep(time.Duration(2+len(listings)%3) * time.Second)
+		message, err := renderNotification(cfg.NotifyTemplate, listing, cfg.DisplayTZ, cfg.RecencyBasis)
+		if err != nil {
+			fmt.Printf("%sFailed to render notification: %v\n", cfg.logPrefix(), err)
+			continue
+		}
+		// During quiet hours the listing is only held for the digest, if
+		// there is one, but still counts as notified so it isn't sent later
+		priority := notificationPriority(cfg, listing)
+		quiet := cfg.quietNow()
+		for _, route := range notificationRoutes(matched) {
+			if quiet {
+				if cfg.QuietDigest {
+					state.holdForDigest(route.notifier, message)
+				}
+				continue
+			}
+			n := Notification{Message: message, Search: strings.Join(route.searches, ", "), Priority: priority, Listing: listing}
+			counts.notified += sendOrQueue(ctx, cfg.Notifiers, state.notifyQueue, []string{route.notifier}, n)
+		}
+		if quiet {
+			debugf("%sQuiet hours, not notifying about %s", cfg.logPrefix(), listing.Title)
+		} else {
+			countOutcome(notifiedListed, notifiedByCity, listing.City)
+		}
+		if err := markNotified(ctx, db, listing.ListingURL); err != nil {
+			fmt.Printf("%sFailed to mark listing as notified: %v\n", cfg.logPrefix(), err)
+		}
+		if cfg.DedupCrosspost {
+			if err := markFingerprintNotified(ctx, db, listing); err != nil {
+				fmt.Printf("%sFailed to record notified fingerprint: %v\n", cfg.logPrefix(), err)
+			}
+		}
+	}
+
+	if priceStats != nil {
+		if err := updatePriceStats(ctx, db, priceStats, cyclePrices); err != nil {
+			fmt.Printf("%sFailed to update price stats: %v\n", cfg.logPrefix(), err)
 		}
 	}
+
+	// Delete listings past their retention, unless we're keeping an archive
+	var err error
+	if !cfg.NoDelete {
+		counts.deleted, err = deleteOldListings(ctx, db, cfg.Category, cfg.Retention, cfg.CategoryRetention)
+		if err != nil {
+			fmt.Printf("%sFailed to delete old listings: %v\n", cfg.logPrefix(), err)
+		}
+	}
+	err = deleteOldFingerprints(ctx, db, cfg.RepostWindow)
+	if err != nil {
+		fmt.Printf("%sFailed to delete old fingerprints: %v\n", cfg.logPrefix(), err)
+	}
+	if err := deleteOldSightings(ctx, db); err != nil {
+		fmt.Printf("%sFailed to delete old sightings: %v\n", cfg.logPrefix(), err)
+	}
+
+	return counts
 }
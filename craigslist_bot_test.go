@@ -0,0 +1,582 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestDefaultNotifyTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("notify").Parse(defaultNotifyTemplate))
+	for _, tc := range []struct {
+		listing Listing
+		want    string
+	}{
+		{Listing{Title: "Chair", Price: "free", City: "Oakland"}, "New free or unknown price listing! Chair (free) Oakland"},
+		{Listing{Title: "Sofa", Price: "$150", City: "Oakland", BelowAverage: true}, "New below-average price listing! Sofa ($150) Oakland"},
+	} {
+		tc.listing.Posted = time.Now()
+		got, err := renderNotification(tmpl, tc.listing, time.UTC, recencyPosted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(got, tc.want) {
+			t.Errorf("renderNotification(%+v) = %q, want it to start with %q", tc.listing, got, tc.want)
+		}
+	}
+}
+
+func TestHumanizeAge(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		age  time.Duration
+		want string
+	}{
+		{0, "just now"},
+		{59 * time.Second, "just now"},
+		{time.Minute, "1 minute ago"},
+		{3*time.Minute + 20*time.Second, "3 minutes ago"},
+		{time.Hour, "1 hour ago"},
+		{23 * time.Hour, "23 hours ago"},
+		{24 * time.Hour, "1 day ago"},
+		{10 * 24 * time.Hour, "10 days ago"},
+	} {
+		if got := humanizeAge(now.Add(-tc.age)); got != tc.want {
+			t.Errorf("humanizeAge(now - %v) = %q, want %q", tc.age, got, tc.want)
+		}
+	}
+}
+
+func TestParseResultPosted(t *testing.T) {
+	page := `<ul>
+	<li class="cl-search-result" title="Gallery"><a href="https://sfbay.craigslist.org/fuo/d/a/1.html"></a>
+		<div class="meta"><span title="Mon Oct 14 2024 10:05:32 GMT-0400 (Eastern Daylight Time)">10/14</span>·Oakland·</div></li>
+	<li class="cl-search-result" title="Time"><a href="https://sfbay.craigslist.org/fuo/d/b/2.html"></a>
+		<time datetime="2024-10-14T09:00:00-0700">10/14</time></li>
+	<li class="cl-search-result" title="Undated"><a href="https://sfbay.craigslist.org/fuo/d/c/3.html"></a></li>
+	<li class="cl-search-result" title="Future"><a href="https://sfbay.craigslist.org/fuo/d/d/4.html"></a>
+		<time datetime="2999-01-01T00:00:00Z"></time></li>
+	<li class="cl-search-result" title="Spanish"><a href="https://sfbay.craigslist.org/fuo/d/e/5.html"></a>
+		<div class="meta"><span title="mar. 15 oct. 2024 10:05:32 GMT-0400 (hora de verano del este)">15/10</span>·Oakland·</div></li>
+	<li class="cl-search-result" title="French"><a href="https://sfbay.craigslist.org/fuo/d/f/6.html"></a>
+		<div class="meta"><span title="lundi 16 décembre 2024 10:05:32 GMT+0100 (heure normale d’Europe centrale)">16/12</span>·Oakland·</div></li>
+	<li class="cl-search-result" title="German"><a href="https://sfbay.craigslist.org/fuo/d/g/7.html"></a>
+		<div class="meta"><span title="Mo. 3. März 2025 10:05:32 GMT+0100 (Mitteleuropäische Normalzeit)">3.3.</span>·Oakland·</div></li>
+	</ul>`
+	before := time.Now().UTC()
+	listings, skipped, err := parseListings(strings.NewReader(page), "fuo", defaultSelectors)
+	if err != nil || skipped != 0 || len(listings) != 7 {
+		t.Fatalf("parseListings = %d listings, %d skipped, %v", len(listings), skipped, err)
+	}
+
+	for i, want := range map[int]time.Time{
+		0: time.Date(2024, 10, 14, 14, 5, 32, 0, time.UTC),
+		1: time.Date(2024, 10, 14, 16, 0, 0, 0, time.UTC),
+		4: time.Date(2024, 10, 15, 14, 5, 32, 0, time.UTC),
+		5: time.Date(2024, 12, 16, 9, 5, 32, 0, time.UTC),
+		6: time.Date(2025, 3, 3, 9, 5, 32, 0, time.UTC),
+	} {
+		if !listings[i].Posted.Equal(want) {
+			t.Errorf("%s: posted %v, want %v", listings[i].Title, listings[i].Posted, want)
+		}
+		if listings[i].ScrapedAt.Before(before) {
+			t.Errorf("%s: scraped_at %v is before the scrape", listings[i].Title, listings[i].ScrapedAt)
+		}
+	}
+	// Without a time of their own, or with one in the future, it's when they were scraped
+	for _, l := range listings[2:4] {
+		if !l.Posted.Equal(l.ScrapedAt) {
+			t.Errorf("%s: posted %v, want the scrape time %v", l.Title, l.Posted, l.ScrapedAt)
+		}
+	}
+}
+
+func TestEnglishDateNames(t *testing.T) {
+	for _, tc := range []struct {
+		title, want string
+	}{
+		{"Mon Oct 14 2024 10:05:32 GMT-0400", "Mon Oct 14 2024 10:05:32 GMT-0400"},
+		{"mar. 5 mar. 2024 10:05:32 GMT-0500", "Tue 5 mar 2024 10:05:32 GMT-0500"},
+		{"sáb. 7 dic. 2024 10:05:32 GMT-0500", "Sat 7 Dec 2024 10:05:32 GMT-0500"},
+		{"jeudi 1 août 2024 10:05:32 GMT+0200", "Thu 1 Aug 2024 10:05:32 GMT+0200"},
+		{"So. 1. Sept. 2024 10:05:32 GMT+0200", "Sun 1 Sep 2024 10:05:32 GMT+0200"},
+		{"Do 10 Okt 2024 10:05:32 GMT+0200", "Thu 10 Oct 2024 10:05:32 GMT+0200"},
+	} {
+		if got := englishDateNames(tc.title); got != tc.want {
+			t.Errorf("englishDateNames(%q) = %q, want %q", tc.title, got, tc.want)
+		}
+	}
+}
+
+// The dedup contract notifying depends on: a listing URL is stored once, and
+// only the first insert reports it as new
+func TestInsertListingOnConflict(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	listing := Listing{
+		Title:      "Couch",
+		Price:      "$50",
+		City:       "Oakland",
+		Site:       "sfbay",
+		Section:    "fuo",
+		Posted:     time.Now(),
+		ListingURL: "https://sfbay.craigslist.org/eby/fuo/d/oakland-couch/7781234567.html",
+		PostID:     "7781234567",
+	}
+
+	isNew, err := insertListing(ctx, db, listing)
+	if err != nil || !isNew {
+		t.Fatalf("first insertListing = %v, %v; want true", isNew, err)
+	}
+	listing.Title = "Couch, edited"
+	isNew, err = insertListing(ctx, db, listing)
+	if err != nil || isNew {
+		t.Fatalf("second insertListing = %v, %v; want false", isNew, err)
+	}
+
+	var n int
+	var title string
+	if err := db.QueryRow(`SELECT COUNT(*), MAX(title) FROM listings WHERE listing_url = ?;`, listing.ListingURL).Scan(&n, &title); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d rows for the listing URL, want 1", n)
+	}
+	if title != "Couch" {
+		t.Errorf("stored title %q, want the first insert's %q", title, "Couch")
+	}
+}
+
+// Backfill pages through the results until a page has nothing new, loading
+// them in Chrome even with -engine auto
+func TestBackfillPages(t *testing.T) {
+	db := newTestDB(t)
+	cfg := testCycleConfig(t, &recordingNotifier{})
+	cfg.Engine = engineAuto
+
+	last := []Listing{fakeListing("Table", "$80", "303"), fakeListing("Lamp", "$15", "304"), fakeListing("Rug", "$40", "305")}
+	pages := map[string][]Listing{
+		"0": {fakeListing("Couch", "$50", "301"), fakeListing("Chair", "$20", "302"), fakeListing("Desk", "$60", "306")},
+		"1": last,
+		// Past the end, Craigslist repeats the last page
+		"2": last,
+	}
+	var requested []string
+	makeScraper := func(cfg Config, searchURL string) Scraper {
+		if cfg.Engine != engineChromedp {
+			t.Errorf("backfill scraped with -engine %s, want chromedp", cfg.Engine)
+		}
+		u, err := url.Parse(searchURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page := strings.Split(u.Fragment, "~")[2]
+		requested = append(requested, page)
+		return fakeScraper{cfg, pages[page]}
+	}
+
+	if err := backfill(context.Background(), cfg, db, nil, makeScraper); err != nil {
+		t.Fatalf("backfill: %v", err)
+	}
+	if want := []string{"0", "1", "2"}; !slices.Equal(requested, want) {
+		t.Errorf("backfill requested pages %q, want %q", requested, want)
+	}
+	n, err := countListings(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("%d listings stored, want 6", n)
+	}
+}
+
+// An in-memory database keeps what's written to it for as long as it's open,
+// across every query, since initDB pins it to a single connection
+func TestInMemoryStore(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	listings := []Listing{
+		fakeListing("Couch", "$250", "401"),
+		fakeListing("Chair", "$40", "402"),
+	}
+	for i, listing := range listings {
+		listing.Posted = time.Date(2024, 10, 14, 10+i, 0, 0, 0, time.UTC)
+		listing.ScrapedAt = listing.Posted
+		listing.PriceCents = priceCents(listing.Price)
+		if _, err := insertListing(ctx, db, listing); err != nil {
+			t.Fatalf("insertListing: %v", err)
+		}
+	}
+
+	got, total, err := queryListings(ctx, db, listingQuery{Sort: "posted", Desc: true, Limit: 10})
+	if err != nil {
+		t.Fatalf("queryListings: %v", err)
+	}
+	if total != 2 || len(got) != 2 {
+		t.Fatalf("queryListings = %d listings of %d, want 2 of 2", len(got), total)
+	}
+	if got[0].Title != "Chair" || got[1].Title != "Couch" {
+		t.Errorf("queryListings order = %q, %q; want newest first", got[0].Title, got[1].Title)
+	}
+	if got[1].PriceCents == nil || *got[1].PriceCents != 25000 || got[1].PostID != "401" {
+		t.Errorf("queryListings round-tripped %+v", got[1])
+	}
+}
+
+// Parse a results page made of the given gallery results
+func parseTestResults(t *testing.T, category string, results ...string) []Listing {
+	t.Helper()
+	page := "<ol>" + strings.Join(results, "\n") + "</ol>"
+	listings, skipped, err := parseListings(strings.NewReader(page), category, defaultSelectors)
+	if err != nil || skipped != 0 {
+		t.Fatalf("parseListings: %d skipped, %v", skipped, err)
+	}
+	return listings
+}
+
+// A gallery result titled title, showing price unless it's empty
+func galleryResult(title, postID, price string) string {
+	priceInfo := ""
+	if price != "" {
+		priceInfo = `<span class="priceinfo">` + price + `</span>`
+	}
+	return `<li class="cl-search-result" title="` + title + `">
+		<a href="https://sfbay.craigslist.org/eby/fuo/d/oakland-item/` + postID + `.html"></a>` + priceInfo + `
+		<div class="meta">10/14·Oakland·</div></li>`
+}
+
+func TestInferPriceFromTitle(t *testing.T) {
+	listings := parseTestResults(t, "fuo",
+		galleryResult("Couch - $50", "501", ""),
+		galleryResult("Couch - $50", "502", "$45"),
+		galleryResult("Couch, make an offer", "503", ""),
+	)
+	for i, want := range []struct {
+		price    string
+		inferred bool
+	}{
+		{"$50", true},
+		{"$45", false},
+		{"", false},
+	} {
+		if l := listings[i]; l.Price != want.price || l.PriceInferred != want.inferred {
+			t.Errorf("%q (%s): price %q, inferred %v; want %q, %v", l.Title, l.PostID, l.Price, l.PriceInferred, want.price, want.inferred)
+		}
+	}
+
+	// Pay rates in job titles aren't prices
+	jobs := parseTestResults(t, "jjj", galleryResult("Mover needed $20/hr", "504", ""))
+	if jobs[0].Price != "" || jobs[0].PriceInferred {
+		t.Errorf("job title gave price %q, inferred %v", jobs[0].Price, jobs[0].PriceInferred)
+	}
+}
+
+// Pruning keeps the most recently scraped listings, and does nothing under the limit
+func TestPruneToLimit(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	for i := range 5 {
+		listing := fakeListing("Item", "$10", strconv.Itoa(900+i))
+		listing.ScrapedAt = time.Date(2024, 10, 14, 10+i, 0, 0, 0, time.UTC)
+		listing.Posted = listing.ScrapedAt
+		if _, err := insertListing(ctx, db, listing); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pruned, err := pruneToLimit(ctx, []*sql.DB{db}, 10); err != nil || pruned != 0 {
+		t.Errorf("pruneToLimit(10) with 5 rows = %d, %v; want 0", pruned, err)
+	}
+	pruned, err := pruneToLimit(ctx, []*sql.DB{db}, 2)
+	if err != nil || pruned != 3 {
+		t.Fatalf("pruneToLimit(2) with 5 rows = %d, %v; want 3", pruned, err)
+	}
+	for _, postID := range []string{"903", "904"} {
+		if _, err := getListingByPostID(ctx, db, postID); err != nil {
+			t.Errorf("listing %s, among the newest, was pruned: %v", postID, err)
+		}
+	}
+	if _, err := getListingByPostID(ctx, db, "902"); err != sql.ErrNoRows {
+		t.Errorf("listing 902, among the oldest, wasn't pruned: %v", err)
+	}
+}
+
+// With -partition-by-city, -max-rows caps the databases together, pruning
+// the oldest listings wherever they are
+func TestPruneToLimitAcrossPartitions(t *testing.T) {
+	ctx := context.Background()
+	dbs := []*sql.DB{newTestDB(t), newTestDB(t), newTestDB(t)}
+	// Hours at which each database's listings were scraped
+	for i, hours := range [][]int{{1, 5}, {2, 3, 6}, {4}} {
+		for _, hour := range hours {
+			listing := fakeListing("Item", "$10", strconv.Itoa(900+hour))
+			listing.ScrapedAt = time.Date(2024, 10, 14, hour, 0, 0, 0, time.UTC)
+			listing.Posted = listing.ScrapedAt
+			if _, err := insertListing(ctx, dbs[i], listing); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	pruned, err := pruneToLimit(ctx, dbs, 3)
+	if err != nil || pruned != 3 {
+		t.Fatalf("pruneToLimit(3) with 6 rows in 3 databases = %d, %v; want 3", pruned, err)
+	}
+	for i, want := range []int{1, 1, 1} {
+		if n, err := countListings(ctx, dbs[i]); err != nil || n != want {
+			t.Errorf("database %d has %d listings, %v; want %d", i, n, err, want)
+		}
+	}
+	for i, postID := range []string{"905", "906", "904"} {
+		if _, err := getListingByPostID(ctx, dbs[i], postID); err != nil {
+			t.Errorf("listing %s, among the newest, was pruned: %v", postID, err)
+		}
+	}
+}
+
+// Jobs and gigs show pay where other results show a price, and it's kept as shown
+func TestParseJobAndGigResults(t *testing.T) {
+	job := `<li class="cl-search-result" title="Warehouse associate">
+		<a href="https://sfbay.craigslist.org/eby/lab/d/oakland-warehouse-associate/7781230001.html"></a>
+		<div class="compensation">$25/hr - $30/hr</div>
+		<div class="meta">10/14··</div></li>`
+	gig := `<li class="cl-search-result" title="Help moving a couch $100">
+		<a href="https://sfbay.craigslist.org/sfc/lbg/d/san-francisco-help-moving/7781230002.html"></a>
+		<span class="priceinfo">$100-$150</span>
+		<div class="meta">10/14·Mission District·</div></li>`
+
+	jobs := parseTestResults(t, "jjj", job)
+	if l := jobs[0]; l.Price != "$25/hr - $30/hr" || l.PriceText != "" || l.PriceCents != nil || l.PriceInferred || l.City != "" || l.Section != "lab" {
+		t.Errorf("job parsed as price %q, price_text %q, price_cents %v, inferred %v, city %q, section %q", l.Price, l.PriceText, l.PriceCents, l.PriceInferred, l.City, l.Section)
+	}
+	gigs := parseTestResults(t, "ggg", gig)
+	if l := gigs[0]; l.Price != "$100-$150" || l.PriceCents != nil || l.City != "Mission District" {
+		t.Errorf("gig parsed as price %q, price_cents %v, city %q", l.Price, l.PriceCents, l.City)
+	}
+
+	// The same result for sale would have its range normalized
+	forSale := parseTestResults(t, "sss", gig)
+	if l := forSale[0]; l.Price != "$100" || l.PriceText != "$100-$150" {
+		t.Errorf("for-sale result parsed as price %q, price_text %q", l.Price, l.PriceText)
+	}
+}
+
+func TestListingValid(t *testing.T) {
+	for _, tc := range []struct {
+		listing Listing
+		ok      bool
+	}{
+		{Listing{Title: "Couch", ListingURL: "https://sfbay.craigslist.org/fuo/d/couch/1.html"}, true},
+		{Listing{Price: "$50", ListingURL: "https://sfbay.craigslist.org/fuo/d/couch/1.html"}, true},
+		{Listing{Title: placeholderTitle, Price: "$50", ListingURL: "http://sfbay.craigslist.org/fuo/1.html"}, true},
+		{Listing{Title: "Couch"}, false},
+		{Listing{Title: "Couch", ListingURL: "/fuo/d/couch/1.html"}, false},
+		{Listing{Title: "Couch", ListingURL: "javascript:alert(1)"}, false},
+		{Listing{Title: "Couch", ListingURL: "https://"}, false},
+		{Listing{Title: placeholderTitle, ListingURL: "https://sfbay.craigslist.org/fuo/d/couch/1.html"}, false},
+		{Listing{ListingURL: "https://sfbay.craigslist.org/fuo/d/couch/1.html"}, false},
+	} {
+		if err := tc.listing.Valid(); (err == nil) != tc.ok {
+			t.Errorf("Valid(title %q, price %q, url %q) = %v, want ok %v", tc.listing.Title, tc.listing.Price, tc.listing.ListingURL, err, tc.ok)
+		}
+	}
+}
+
+// -require-image keeps only results that show a thumbnail, however it's loaded
+func TestRequireImage(t *testing.T) {
+	withImage := `<li class="cl-search-result" title="Couch with photo">
+		<a href="https://sfbay.craigslist.org/eby/fuo/d/oakland-couch/7781240001.html"><img src="https://images.craigslist.org/00a0a_couch_300x300.jpg"></a>
+		<span class="priceinfo">$80</span><div class="meta">10/14·Oakland·</div></li>`
+	lazyImage := `<li class="cl-search-result" title="Chair with lazy photo">
+		<a href="https://sfbay.craigslist.org/eby/fuo/d/oakland-chair/7781240002.html"><img src="data:image/gif;base64,R0lGODlhAQABAAAAACw=" data-src="https://images.craigslist.org/00b0b_chair_300x300.jpg"></a>
+		<span class="priceinfo">$20</span><div class="meta">10/14·Oakland·</div></li>`
+	listings := parseTestResults(t, "fuo", withImage, lazyImage,
+		galleryResult("Table without photo", "7781240003", "$40"))
+	if listings[0].Thumbnail != "https://images.craigslist.org/00a0a_couch_300x300.jpg" ||
+		listings[1].Thumbnail != "https://images.craigslist.org/00b0b_chair_300x300.jpg" || listings[2].Thumbnail != "" {
+		t.Fatalf("thumbnails %q, %q, %q", listings[0].Thumbnail, listings[1].Thumbnail, listings[2].Thumbnail)
+	}
+
+	db := newTestDB(t)
+	cfg := testCycleConfig(t, &recordingNotifier{})
+	cfg.RequireImage = true
+	state := &cycleState{
+		browserCtx: context.Background(),
+		newScraper: func(cfg Config, searchURL string) Scraper {
+			return fakeScraper{cfg, listings}
+		},
+	}
+	if err := doCycle(context.Background(), cfg, db, state); err != nil {
+		t.Fatalf("doCycle: %v", err)
+	}
+	if _, err := getListingByPostID(context.Background(), db, "7781240003"); err != sql.ErrNoRows {
+		t.Errorf("the listing without a photo was stored: %v", err)
+	}
+	for _, postID := range []string{"7781240001", "7781240002"} {
+		if _, err := getListingByPostID(context.Background(), db, postID); err != nil {
+			t.Errorf("listing %s with a photo: %v", postID, err)
+		}
+	}
+}
+
+// A saved free-section results page, which shows no prices at all
+const fixtureFreePage = `<ol class="cl-results-page">
+<li class="cl-search-result cl-search-view-mode-gallery" title="Moving boxes">
+	<a href="https://sfbay.craigslist.org/eby/zip/d/berkeley-moving-boxes/7781250001.html"><img src="https://images.craigslist.org/00c0c_boxes_300x300.jpg"></a>
+	<div class="meta">10/14·Berkeley·</div>
+</li>
+<li class="cl-search-result cl-search-view-mode-gallery" title="Firewood, $20 value">
+	<a href="https://sfbay.craigslist.org/sfc/zip/d/san-francisco-firewood/7781250002.html"></a>
+	<div class="meta">10/14·Sunset District·</div>
+</li>
+<li class="cl-search-result cl-search-view-mode-gallery" title="Curb alert: bookshelf">
+	<a href="https://sfbay.craigslist.org/pen/zip/d/palo-alto-curb-alert/7781250003.html"></a>
+	<div class="meta">10/14··</div>
+</li>
+</ol>`
+
+// Every result in the free section is free and notified, even one whose
+// title mentions a price
+func TestParseFreeSection(t *testing.T) {
+	listings, err := parseSearchPage(freeCategory, defaultSelectors, "https://sfbay.craigslist.org/search/zip", fixtureFreePage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listings) != 3 {
+		t.Fatalf("parsed %d listings, want 3", len(listings))
+	}
+	for _, l := range listings {
+		if l.Price != "free" || l.PriceInferred || l.PriceCents == nil || *l.PriceCents != 0 || l.Section != freeCategory {
+			t.Errorf("%q parsed as price %q, inferred %v, price_cents %v, section %q", l.Title, l.Price, l.PriceInferred, l.PriceCents, l.Section)
+		}
+		if !shouldNotify(l, Config{}) {
+			t.Errorf("%q wouldn't be notified", l.Title)
+		}
+	}
+}
+
+// A saved results page with an ad and a nearby-area result mixed in
+const fixtureSponsoredPage = `<ol class="cl-results-page">
+<li class="cl-search-result" title="Free desk">
+	<a href="https://sfbay.craigslist.org/eby/fuo/d/oakland-free-desk/7781260001.html"></a>
+	<div class="meta">10/14·Oakland·</div>
+</li>
+<li class="cl-search-result sponsored" title="Free mattress delivery">
+	<a href="https://sfbay.craigslist.org/sfc/fuo/d/san-francisco-mattress/7781260002.html"></a>
+	<div class="meta">10/14·San Francisco·</div>
+</li>
+<li class="cl-search-result nearby" title="Free futon">
+	<a href="https://sacramento.craigslist.org/fuo/d/davis-free-futon/7781260003.html"></a>
+	<div class="meta">10/14·Davis·</div>
+</li>
+<li class="cl-search-result" data-sponsored="true" title="Free rug">
+	<a href="https://sfbay.craigslist.org/pen/fuo/d/palo-alto-free-rug/7781260004.html"></a>
+	<div class="meta">10/14·Palo Alto·</div>
+</li>
+<li class="cl-search-result" title="Free lamp">
+	<a href="https://sfbay.craigslist.org/pen/fuo/d/palo-alto-free-lamp/7781260005.html"></a>
+	<div class="meta">10/14·Palo Alto·</div>
+</li>
+<li class="cl-search-result" title="Free bookcase">
+	<a href="https://sfbay.craigslist.org/sfc/fuo/d/san-francisco-bookcase/7781260006.html"></a>
+	<div class="meta">10/14·San Francisco·</div>
+</li>
+</ol>`
+
+// Ads and nearby-area results are classified as sponsored, stored like any
+// other, and not notified with -exclude-sponsored
+func TestSponsoredResults(t *testing.T) {
+	listings, err := parseSearchPage("fuo", defaultSelectors, "https://sfbay.craigslist.org/search/fuo", fixtureSponsoredPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sponsored []string
+	for _, l := range listings {
+		if l.Sponsored {
+			sponsored = append(sponsored, l.Title)
+		}
+	}
+	if want := []string{"Free mattress delivery", "Free futon", "Free rug"}; !slices.Equal(sponsored, want) {
+		t.Errorf("sponsored results %q, want %q", sponsored, want)
+	}
+
+	db := newTestDB(t)
+	notifier := &recordingNotifier{}
+	cfg := testCycleConfig(t, notifier)
+	cfg.ExcludeSponsored = true
+	state := &cycleState{
+		browserCtx: context.Background(),
+		newScraper: func(cfg Config, searchURL string) Scraper {
+			return fakeScraper{cfg, listings}
+		},
+	}
+	if err := doCycle(context.Background(), cfg, db, state); err != nil {
+		t.Fatalf("doCycle: %v", err)
+	}
+	if want := []string{"Free desk", "Free lamp", "Free bookcase"}; !slices.Equal(notifier.titles(), want) {
+		t.Errorf("notified %q, want %q", notifier.titles(), want)
+	}
+	stored, err := getListingByPostID(context.Background(), db, "7781260002")
+	if err != nil || !stored.Sponsored {
+		t.Errorf("sponsored listing stored as %+v, %v", stored, err)
+	}
+}
+
+// Each category is kept for its own retention, and the rest, including rows
+// without a section, for the global one under their searched category
+func TestDeleteOldListingsByCategory(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC()
+	for _, row := range []struct {
+		postID, section string
+		age             time.Duration
+	}{
+		{"1", "apa", 48 * time.Hour},
+		{"2", "apa", 80 * time.Hour},
+		{"3", "zip", 10 * time.Minute},
+		{"4", "zip", 45 * time.Minute},
+		{"5", "fuo", 30 * time.Minute},
+		{"6", "fuo", 2 * time.Hour},
+		{"7", "", 2 * time.Hour},
+		{"8", "", 80 * time.Hour},
+	} {
+		listing := fakeListing("Listing "+row.postID, "$10", row.postID)
+		listing.Section = row.section
+		listing.Posted = now.Add(-row.age)
+		listing.ScrapedAt = listing.Posted
+		if _, err := insertListing(context.Background(), db, listing); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byCategory := map[string]time.Duration{"apa": 72 * time.Hour, "zip": 30 * time.Minute}
+	deleted, err := deleteOldListings(context.Background(), db, "apa", time.Hour, byCategory)
+	if err != nil {
+		t.Fatalf("deleteOldListings: %v", err)
+	}
+	if deleted != 4 {
+		t.Errorf("deleted %d listings, want 4", deleted)
+	}
+	var kept []string
+	for _, postID := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		if _, err := getListingByPostID(context.Background(), db, postID); err == nil {
+			kept = append(kept, postID)
+		}
+	}
+	if want := []string{"1", "3", "5", "7"}; !slices.Equal(kept, want) {
+		t.Errorf("kept listings %q, want %q", kept, want)
+	}
+
+	// Without per-category retention, everything gets the global one
+	deleted, err = deleteOldListings(context.Background(), db, "apa", time.Hour, nil)
+	if err != nil || deleted != 2 {
+		t.Errorf("deleteOldListings without per-category retention = %d, %v; want 2", deleted, err)
+	}
+}
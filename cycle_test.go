@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Returns the same listings every time, as if scraped from the site in cfg
+type fakeScraper struct {
+	cfg      Config
+	listings []Listing
+}
+
+func (fs fakeScraper) Scrape(ctx context.Context) ([]Listing, error) {
+	listings := slices.Clone(fs.listings)
+	now := time.Now().UTC()
+	for i := range listings {
+		listings[i].Site = fs.cfg.City
+		listings[i].Posted, listings[i].ScrapedAt = now, now
+	}
+	return listings, nil
+}
+
+func fakeListing(title, price, postID string) Listing {
+	return Listing{
+		Title:      title,
+		Price:      price,
+		City:       "Oakland",
+		ListingURL: "https://sfbay.craigslist.org/eby/fuo/d/oakland-item/" + postID + ".html",
+		PostID:     postID,
+		Section:    "fuo",
+	}
+}
+
+// A cycle stores everything it scrapes, notifies each saved search's
+// notifiers about its matches, and doesn't notify about them again
+func TestDoCycleWithSavedSearches(t *testing.T) {
+	db := newTestDB(t)
+	couches, cheap := &recordingNotifier{}, &recordingNotifier{}
+	cfg := testCycleConfig(t, &recordingNotifier{})
+	cfg.Notifiers = map[string]Notifier{"couches": couches, "cheap": cheap}
+	maxPrice := 100
+	cfg.Searches = []SavedSearch{
+		{Name: "couches", Keywords: []string{"couch", "sofa"}, Notifiers: []string{"couches"}},
+		{Name: "cheap", MaxPrice: &maxPrice, Notifiers: []string{"cheap"}},
+	}
+	if err := validateSearches(cfg.Searches, cfg.Sites, nil, cfg.Notifiers); err != nil {
+		t.Fatalf("validateSearches: %v", err)
+	}
+	cfg.NotifyTemplate = mustParseTemplate(t, defaultSearchNotifyTemplate)
+
+	scraped := []Listing{
+		fakeListing("Leather couch", "$250", "101"),
+		fakeListing("Sofa table", "$40", "102"),
+		fakeListing("Bookshelf", "$300", "103"),
+	}
+	requested := 0
+	state := &cycleState{
+		browserCtx: context.Background(),
+		newScraper: func(cfg Config, searchURL string) Scraper {
+			requested++
+			return fakeScraper{cfg, scraped}
+		},
+		firstCycle: true,
+	}
+
+	for cycle := 1; cycle <= 2; cycle++ {
+		if err := doCycle(context.Background(), cfg, db, state); err != nil {
+			t.Fatalf("cycle %d: %v", cycle, err)
+		}
+	}
+	if requested != 2 {
+		t.Errorf("made %d scrapers over 2 cycles of 1 site, want 2", requested)
+	}
+
+	n, err := countListings(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("%d listings stored, want 3", n)
+	}
+	if got, want := couches.titles(), []string{"Leather couch", "Sofa table"}; !slices.Equal(got, want) {
+		t.Errorf("couches notifier got %q, want %q", got, want)
+	}
+	if got, want := cheap.titles(), []string{"Sofa table"}; !slices.Equal(got, want) {
+		t.Errorf("cheap notifier got %q, want %q", got, want)
+	}
+	if search := couches.sent[1].Search; search != "couches" {
+		t.Errorf("notification names search %q, want %q", search, "couches")
+	}
+	stored, err := getListingByPostID(context.Background(), db, "102")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sofa"}; !slices.Equal(stored.MatchedKeywords, want) {
+		t.Errorf("stored matched keywords %q, want %q", stored.MatchedKeywords, want)
+	}
+}
+
+// With -suppress-initial, the first cycle only seeds the database
+func TestDoCycleSuppressInitial(t *testing.T) {
+	db := newTestDB(t)
+	notifier := &recordingNotifier{}
+	cfg := testCycleConfig(t, notifier)
+	cfg.SuppressInitial = true
+
+	scraped := []Listing{
+		fakeListing("Free couch", "", "201"),
+		fakeListing("Free chair", "free", "202"),
+		fakeListing("Table", "$80", "203"),
+	}
+	state := &cycleState{
+		browserCtx: context.Background(),
+		newScraper: func(cfg Config, searchURL string) Scraper {
+			return fakeScraper{cfg, scraped}
+		},
+		firstCycle: true,
+	}
+	if err := doCycle(context.Background(), cfg, db, state); err != nil {
+		t.Fatalf("doCycle: %v", err)
+	}
+	if titles := notifier.titles(); len(titles) != 0 {
+		t.Errorf("first cycle notified %q, want nothing", titles)
+	}
+	if state.firstCycle {
+		t.Error("firstCycle still set after the first cycle")
+	}
+}
+
+func TestDedupListings(t *testing.T) {
+	listings := []Listing{
+		{Title: "a", PostID: "1", ListingURL: "https://sfbay.craigslist.org/1.html"},
+		{Title: "b", PostID: "2", ListingURL: "https://sfbay.craigslist.org/2.html"},
+		{Title: "a again", PostID: "1", ListingURL: "https://sacramento.craigslist.org/1.html"},
+		{Title: "legacy", ListingURL: "https://sfbay.craigslist.org/legacy.html"},
+		{Title: "legacy again", ListingURL: "https://sfbay.craigslist.org/legacy.html"},
+		{Title: "c", PostID: "3", ListingURL: "https://sfbay.craigslist.org/3.html"},
+	}
+	unique, dropped := dedupListings(listings)
+	var titles []string
+	for _, l := range unique {
+		titles = append(titles, l.Title)
+	}
+	if want := []string{"a", "b", "legacy", "c"}; !slices.Equal(titles, want) || dropped != 2 {
+		t.Errorf("dedupListings kept %q and dropped %d, want %q and 2", titles, dropped, want)
+	}
+}
+
+// Posts two overlapping sites both turn up are stored, notified, and counted
+// once, as the first site found them
+func TestDoCycleOverlappingSites(t *testing.T) {
+	db := newTestDB(t)
+	notifier := &recordingNotifier{}
+	cfg := testCycleConfig(t, notifier)
+	cfg.Sites = []string{"sfbay", "sacramento"}
+
+	results := map[string][]Listing{
+		"sfbay": {fakeListing("Free desk", "", "501"), fakeListing("Free lamp", "", "502"), fakeListing("Free rug", "", "503")},
+		"sacramento": {
+			fakeListing("Free lamp", "", "502"), fakeListing("Free rug", "", "503"),
+			fakeListing("Free futon", "", "504"), fakeListing("Free shelf", "", "505"), fakeListing("Free mirror", "", "506"),
+		},
+	}
+	state := &cycleState{
+		browserCtx: context.Background(),
+		newScraper: func(cfg Config, searchURL string) Scraper {
+			return fakeScraper{cfg, results[cfg.City]}
+		},
+	}
+	scrapedBefore := scrapedCount.Value()
+	if err := doCycle(context.Background(), cfg, db, state); err != nil {
+		t.Fatalf("doCycle: %v", err)
+	}
+
+	want := []string{"Free desk", "Free lamp", "Free rug", "Free futon", "Free shelf", "Free mirror"}
+	if got := notifier.titles(); !slices.Equal(got, want) {
+		t.Errorf("notified %q, want %q", got, want)
+	}
+	if scraped := scrapedCount.Value() - scrapedBefore; scraped != 6 {
+		t.Errorf("counted %d listings scraped, want 6", scraped)
+	}
+	n, err := countListings(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("%d listings stored, want 6", n)
+	}
+	if lamp, err := getListingByPostID(context.Background(), db, "502"); err != nil || lamp.Site != "sfbay" {
+		t.Errorf("overlapping listing stored from site %q, %v; want sfbay", lamp.Site, err)
+	}
+}
+
+// Give a category enough samples at price for its median to be compared against
+func seedPriceStats(t *testing.T, db *sql.DB, category string, price int) {
+	t.Helper()
+	prices := make([]int, priceStatsMinSamples)
+	for i := range prices {
+		prices[i] = price
+	}
+	if err := updatePriceStats(context.Background(), db, map[string]priceStat{}, map[string][]int{category: prices}); err != nil {
+		t.Fatalf("updatePriceStats: %v", err)
+	}
+}
+
+// In repeat mode a suspected scam is handled the same way every time it's
+// scraped, not only when it's new
+func TestDoCycleScamRepeatMode(t *testing.T) {
+	for _, tc := range []struct {
+		action string
+		want   []string // titles notified at low priority, cycle by cycle
+	}{
+		{scamSkip, nil},
+		{scamLow, []string{"iPhone 15 Pro Max", "iPhone 15 Pro Max"}},
+	} {
+		db := newTestDB(t)
+		seedPriceStats(t, db, "fuo/sfbay", 1000)
+		notifier := &recordingNotifier{}
+		cfg := testCycleConfig(t, notifier)
+		cfg.Searches = []SavedSearch{{Name: "phones", Keywords: []string{"iphone"}}}
+		if err := validateSearches(cfg.Searches, cfg.Sites, nil, cfg.Notifiers); err != nil {
+			t.Fatalf("validateSearches: %v", err)
+		}
+		cfg.NotifyMode = notifyRepeat
+		cfg.ScamThreshold = 10
+		cfg.ScamAction = tc.action
+
+		scraped := []Listing{
+			fakeListing("iPhone 15 Pro Max", "$50", "601"),
+			fakeListing("iPhone 14", "$900", "602"),
+			fakeListing("iPhone 13 mini", "$800", "603"),
+		}
+		state := &cycleState{
+			browserCtx: context.Background(),
+			newScraper: func(cfg Config, searchURL string) Scraper {
+				return fakeScraper{cfg, scraped}
+			},
+		}
+		for cycle := 1; cycle <= 2; cycle++ {
+			if err := doCycle(context.Background(), cfg, db, state); err != nil {
+				t.Fatalf("-scam-action %s, cycle %d: %v", tc.action, cycle, err)
+			}
+		}
+
+		var low []string
+		others := 0
+		for _, n := range notifier.sent {
+			if n.Priority == priorityLow {
+				low = append(low, n.Listing.Title)
+			} else {
+				others++
+			}
+		}
+		if !slices.Equal(low, tc.want) {
+			t.Errorf("-scam-action %s: notified %q at low priority, want %q", tc.action, low, tc.want)
+		}
+		if others != 4 {
+			t.Errorf("-scam-action %s: %d other notifications over 2 cycles, want 4", tc.action, others)
+		}
+	}
+}
+
+// With -suppress-reposts, a repost stays suppressed in repeat mode after the
+// cycle that first found it
+func TestDoCycleSuppressRepostsRepeatMode(t *testing.T) {
+	db := newTestDB(t)
+	notifier := &recordingNotifier{}
+	cfg := testCycleConfig(t, notifier)
+	cfg.NotifyMode = notifyRepeat
+	cfg.SuppressReposts = true
+
+	scraped := []Listing{
+		fakeListing("Free walnut dresser", "", "701"),
+		fakeListing("walnut dresser FREE", "", "702"),
+		fakeListing("Free lamp", "", "703"),
+	}
+	state := &cycleState{
+		browserCtx: context.Background(),
+		newScraper: func(cfg Config, searchURL string) Scraper {
+			return fakeScraper{cfg, scraped}
+		},
+	}
+	for cycle := 1; cycle <= 2; cycle++ {
+		if err := doCycle(context.Background(), cfg, db, state); err != nil {
+			t.Fatalf("cycle %d: %v", cycle, err)
+		}
+	}
+
+	want := []string{"Free walnut dresser", "Free lamp", "Free walnut dresser", "Free lamp"}
+	if got := notifier.titles(); !slices.Equal(got, want) {
+		t.Errorf("notified %q, want %q", got, want)
+	}
+}
+
+// A listing whose price is edited down to a scam's counts as new again, and
+// is checked like one
+func TestDoCycleEditedScamPrice(t *testing.T) {
+	for _, tc := range []struct {
+		action   string
+		want     []string // titles notified
+		priority string   // of the notification about the edit
+	}{
+		{scamSkip, []string{"iPhone 15 Pro Max"}, ""},
+		{scamLow, []string{"iPhone 15 Pro Max", "iPhone 15 Pro Max"}, priorityLow},
+	} {
+		db := newTestDB(t)
+		seedPriceStats(t, db, "fuo/sfbay", 1000)
+		notifier := &recordingNotifier{}
+		cfg := testCycleConfig(t, notifier)
+		cfg.Searches = []SavedSearch{{Name: "phones", Keywords: []string{"iphone"}}}
+		if err := validateSearches(cfg.Searches, cfg.Sites, nil, cfg.Notifiers); err != nil {
+			t.Fatalf("validateSearches: %v", err)
+		}
+		cfg.ScamThreshold = 10
+		cfg.ScamAction = tc.action
+
+		scraped := []Listing{fakeListing("iPhone 15 Pro Max", "$900", "801")}
+		state := &cycleState{
+			browserCtx: context.Background(),
+			newScraper: func(cfg Config, searchURL string) Scraper {
+				return fakeScraper{cfg, scraped}
+			},
+		}
+		if err := doCycle(context.Background(), cfg, db, state); err != nil {
+			t.Fatalf("-scam-action %s, cycle 1: %v", tc.action, err)
+		}
+		scraped[0].Price = "$50"
+		if err := doCycle(context.Background(), cfg, db, state); err != nil {
+			t.Fatalf("-scam-action %s, cycle 2: %v", tc.action, err)
+		}
+
+		if got := notifier.titles(); !slices.Equal(got, tc.want) {
+			t.Errorf("-scam-action %s: notified %q, want %q", tc.action, got, tc.want)
+		}
+		if len(notifier.sent) == 2 && notifier.sent[1].Priority != tc.priority {
+			t.Errorf("-scam-action %s: edited listing notified at priority %q, want %q", tc.action, notifier.sent[1].Priority, tc.priority)
+		}
+	}
+}
+
+// Cycle log lines carry the run ID, and the profile name when there is one
+func TestLogPrefix(t *testing.T) {
+	if got, want := (Config{}).logPrefix(), "["+currentRun.id+"] "; got != want {
+		t.Errorf("logPrefix() = %q, want %q", got, want)
+	}
+	if got, want := (Config{Name: "business"}).logPrefix(), "["+currentRun.id+" business] "; got != want {
+		t.Errorf("logPrefix() for a profile = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// How many recent notifications are remembered for -notify-dedup-window
+const notifyDedupSize = 256
+
+// Notifications sent recently, used by dispatch to drop an identical message
+// to the same notifier within -notify-dedup-window. It's a safety net for
+// retries and reloads on top of the database's own dedup. Nil when disabled.
+var recentNotifications *notifyDedup
+
+// A small LRU of message hashes, each expiring after the window
+type notifyDedup struct {
+	mu     sync.Mutex
+	window time.Duration
+	order  *list.List // of dedupEntry, most recent first
+	byHash map[[sha256.Size]byte]*list.Element
+}
+
+type dedupEntry struct {
+	hash   [sha256.Size]byte
+	sentAt time.Time
+}
+
+func newNotifyDedup(window time.Duration) *notifyDedup {
+	return &notifyDedup{window: window, order: list.New(), byHash: make(map[[sha256.Size]byte]*list.Element)}
+}
+
+func dedupHash(notifier, message string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(notifier + "\x00" + message))
+}
+
+// Report whether message was sent via notifier within the window
+func (nd *notifyDedup) Recent(notifier, message string) bool {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	e, ok := nd.byHash[dedupHash(notifier, message)]
+	return ok && time.Since(e.Value.(dedupEntry).sentAt) < nd.window
+}
+
+// Remember that message was just sent via notifier, evicting the least
+// recently sent message once notifyDedupSize are remembered
+func (nd *notifyDedup) Add(notifier, message string) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	hash := dedupHash(notifier, message)
+	if e, ok := nd.byHash[hash]; ok {
+		e.Value = dedupEntry{hash: hash, sentAt: time.Now()}
+		nd.order.MoveToFront(e)
+		return
+	}
+	nd.byHash[hash] = nd.order.PushFront(dedupEntry{hash: hash, sentAt: time.Now()})
+	if nd.order.Len() > notifyDedupSize {
+		oldest := nd.order.Back()
+		nd.order.Remove(oldest)
+		delete(nd.byHash, oldest.Value.(dedupEntry).hash)
+	}
+}
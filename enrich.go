@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/chromedp/chromedp"
+)
+
+// How long a single detail page may take to load
+const detailTimeout = 30 * time.Second
+
+// A newly inserted listing waiting for its detail page to be fetched
+type detailRequest struct {
+	PostID string
+	URL    string
+	DB     *sql.DB // the database the listing was stored in
+}
+
+// The facts scraped from a listing's detail page
+type ListingDetails struct {
+	Description string
+	Images      []string
+	Attributes  map[string]string // e.g. "condition" -> "like new"
+
+	SellerProfileURL string // the seller's other ads, if the page links to them
+
+	// From the "posted:" and "updated:" lines; zero when the page has none
+	Posted  time.Time
+	Updated time.Time
+}
+
+// The layout of the datetime attribute on a detail page's <time> elements
+const detailTimeLayout = "2006-01-02T15:04:05-0700"
+
+// Queue a listing for enrichment without blocking the list loop. When the
+// queue is full the listing is skipped rather than delaying the next scrape.
+func queueDetails(queue chan<- detailRequest, db *sql.DB, listing Listing) {
+	select {
+	case queue <- detailRequest{PostID: listing.PostID, URL: listing.ListingURL, DB: db}:
+	default:
+		fmt.Printf("Enrichment queue full, skipping %s\n", listing.ListingURL)
+	}
+}
+
+// Fetch detail pages from the queue with enrich, normally enrichListing,
+// until the context is cancelled. A fetch starts at most once per interval,
+// with no more than maxConcurrent running at a time.
+func enrichListings(browserCtx context.Context, queue <-chan detailRequest, interval time.Duration, maxConcurrent int, enrich func(req detailRequest)) {
+	throttle := time.NewTicker(interval)
+	defer throttle.Stop()
+	running := make(chan struct{}, maxConcurrent)
+
+	for {
+		var req detailRequest
+		select {
+		case <-browserCtx.Done():
+			return
+		case req = <-queue:
+		}
+
+		select {
+		case <-browserCtx.Done():
+			return
+		case <-throttle.C:
+		}
+		select {
+		case <-browserCtx.Done():
+			return
+		case running <- struct{}{}:
+		}
+
+		go func() {
+			defer func() { <-running }()
+			enrich(req)
+		}()
+	}
+}
+
+// Fetch and store one listing's details in the database it was queued with.
+// The page is loaded in its own tab of the browser behind browserCtx. With
+// an image store, the images are downloaded into it.
+func enrichListing(browserCtx context.Context, req detailRequest, store imageStore) {
+	details, err := scrapeDetails(browserCtx, req.URL)
+	if err != nil {
+		fmt.Printf("Failed to fetch details for %s: %v\n", req.URL, err)
+		return
+	}
+	// Concurrent fetches can finish at once and find each other's writes in the way
+	err = withRetry(browserCtx, func() error {
+		return updateListingDetails(browserCtx, req.DB, req.URL, details)
+	})
+	if err != nil {
+		fmt.Printf("Failed to store details for %s: %v\n", req.URL, err)
+		return
+	}
+	fmt.Printf("Enriched listing %s (%d images)\n", req.PostID, len(details.Images))
+
+	if store != nil && len(details.Images) > 0 {
+		stored := storeImages(browserCtx, req.DB, store, req.PostID, req.URL, details.Images)
+		fmt.Printf("Stored %d of %d images for listing %s\n", stored, len(details.Images), req.PostID)
+	}
+}
+
+// Load a listing's detail page in a new tab and parse it
+func scrapeDetails(browserCtx context.Context, listingURL string) (ListingDetails, error) {
+	if !isCraigslistURL(listingURL) {
+		return ListingDetails{}, fmt.Errorf("refusing to fetch non-Craigslist URL")
+	}
+	tabCtx, cancel := chromedp.NewContext(browserCtx)
+	defer cancel()
+	tabCtx, cancelTimeout := context.WithTimeout(tabCtx, detailTimeout)
+	defer cancelTimeout()
+
+	var htmlContent, location string
+	err := chromedp.Run(tabCtx,
+		chromedp.Navigate(listingURL),
+		chromedp.WaitReady("body"),
+		chromedp.Location(&location),
+		chromedp.OuterHTML("html", &htmlContent),
+	)
+	if err != nil {
+		return ListingDetails{}, fmt.Errorf("failed to load the page: %v", err)
+	}
+	// Chrome follows redirects itself, so check where it ended up before
+	// trusting anything on the page, such as the image URLs to download
+	if !isCraigslistURL(location) {
+		return ListingDetails{}, fmt.Errorf("redirected to non-Craigslist URL %s", location)
+	}
+
+	return parseDetails(strings.NewReader(htmlContent), listingURL)
+}
+
+// Extract the description, image URLs, and seller link from a listing's
+// detail page at pageURL
+func parseDetails(r io.Reader, pageURL string) (ListingDetails, error) {
+	var details ListingDetails
+
+	doc, err := goquery.NewDocumentFromReader(r)
+	if err != nil {
+		return details, fmt.Errorf("failed to parse the page: %v", err)
+	}
+
+	// The posting body starts with a hidden "QR Code Link to This Post" block
+	body := doc.Find("#postingbody")
+	body.Find(".print-information, .print-qrcode-container").Remove()
+	details.Description = strings.TrimSpace(body.Text())
+
+	// Full-size images are linked from the thumbnails; single-image posts have no thumbnails
+	seen := make(map[string]bool)
+	doc.Find("#thumbs a, .gallery .slide img, .gallery .swipe img").Each(func(i int, s *goquery.Selection) {
+		src, exists := s.Attr("href")
+		if !exists {
+			src, exists = s.Attr("src")
+		}
+		if !exists || src == "" || seen[src] {
+			return
+		}
+		seen[src] = true
+		details.Images = append(details.Images, src)
+	})
+
+	details.Attributes = parseAttributes(doc)
+	details.SellerProfileURL = parseSellerLink(doc, pageURL)
+	details.Posted, details.Updated = parsePostTimes(doc)
+
+	return details, nil
+}
+
+// Extract when a post was originally posted and last updated, in UTC. Only
+// edited or bumped posts have an updated time.
+func parsePostTimes(doc *goquery.Document) (posted, updated time.Time) {
+	doc.Find(".postinginfo").Each(func(i int, s *goquery.Selection) {
+		t, err := time.Parse(detailTimeLayout, s.Find("time").AttrOr("datetime", ""))
+		if err != nil {
+			return
+		}
+		switch label := strings.ToLower(strings.TrimSpace(s.Text())); {
+		case strings.HasPrefix(label, "posted"):
+			posted = t.UTC()
+		case strings.HasPrefix(label, "updated"):
+			updated = t.UTC()
+		}
+	})
+	return posted, updated
+}
+
+// Find the "more ads by this user" link, made absolute. Most posts don't have
+// one, and it's left empty unless it leads back to Craigslist.
+func parseSellerLink(doc *goquery.Document, pageURL string) string {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	var link string
+	doc.Find("a").EachWithBreak(func(i int, s *goquery.Selection) bool {
+		if !strings.EqualFold(strings.Join(strings.Fields(s.Text()), " "), "more ads by this user") {
+			return true
+		}
+		href, _ := s.Attr("href")
+		resolved, err := base.Parse(href)
+		if err == nil && href != "" && isCraigslistURL(resolved.String()) {
+			link = resolved.String()
+		}
+		return false
+	})
+	return link
+}
+
+// Extract the attribute groups (condition, make/model, dimensions, ...) from a
+// detail page. Newer pages use label/value pairs; older ones use "key: value"
+// spans. Spans without a colon are flags like "furnished" and get an empty value.
+func parseAttributes(doc *goquery.Document) map[string]string {
+	attributes := make(map[string]string)
+	normalizeKey := func(key string) string {
+		return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(key), ":"))
+	}
+
+	doc.Find(".attrgroup").Each(func(i int, group *goquery.Selection) {
+		group.Find(".attr").Each(func(i int, attr *goquery.Selection) {
+			key := normalizeKey(attr.Find(".labl").Text())
+			value := strings.TrimSpace(attr.Find(".valu").Text())
+			if key == "" && attr.Find(".makemodel").Length() > 0 {
+				key = "make/model"
+			}
+			if key != "" {
+				attributes[key] = value
+			}
+		})
+
+		group.Find("span").Not(".attr, .attr span").Each(func(i int, span *goquery.Selection) {
+			text := strings.TrimSpace(span.Text())
+			if text == "" {
+				return
+			}
+			if span.HasClass("makemodel") {
+				attributes["make/model"] = text
+				return
+			}
+			key, value, _ := strings.Cut(text, ":")
+			attributes[normalizeKey(key)] = strings.TrimSpace(value)
+		})
+	})
+
+	return attributes
+}
+
+// Store the scraped details for a listing, replacing any earlier ones
+func updateListingDetails(ctx context.Context, db *sql.DB, listingURL string, details ListingDetails) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var listingID int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM listings WHERE listing_url = ?;`, listingURL).Scan(&listingID)
+	if err != nil {
+		return err
+	}
+
+	// Without a posted time on the page, the scrape time stays in its place
+	updateQuery := `
+	UPDATE listings
+	SET description = ?, seller_profile_url = ?, posted = COALESCE(?, posted), updated = ?, enriched_at = ?
+	WHERE id = ?;
+	`
+	nullTime := func(t time.Time) any {
+		if t.IsZero() {
+			return nil
+		}
+		return t
+	}
+	_, err = tx.ExecContext(ctx, updateQuery, details.Description, details.SellerProfileURL, nullTime(details.Posted), nullTime(details.Updated), time.Now(), listingID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM images WHERE listing_id = ?;`, listingID); err != nil {
+		return err
+	}
+	for _, image := range details.Images {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO images (listing_id, url) VALUES (?, ?);`, listingID, image); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM attributes WHERE listing_id = ?;`, listingID); err != nil {
+		return err
+	}
+	for key, value := range details.Attributes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO attributes (listing_id, key, value) VALUES (?, ?, ?);`, listingID, key, value); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
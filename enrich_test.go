@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// A saved listing detail page, trimmed to the parts parseDetails reads
+const fixtureDetailPage = `<!DOCTYPE html>
+<html><body>
+<section id="postingbody">
+	<div class="print-information print-qrcode-container">QR Code Link to This Post</div>
+	Solid oak, a few scratches on the top. Pickup only.
+</section>
+<div id="thumbs">
+	<a href="https://images.craigslist.org/00a0a_abc_600x450.jpg"></a>
+	<a href="https://images.craigslist.org/00b0b_def_600x450.jpg"></a>
+</div>
+<div class="attrgroup">
+	<div class="attr"><span class="labl">condition:</span> <span class="valu">like new</span></div>
+	<div class="attr"><span class="labl">size / dimensions:</span> <span class="valu">72x36</span></div>
+</div>
+<p class="attrgroup"><span class="makemodel">Herman Miller Aeron</span> <span>paint color: brown</span></p>
+<p class="postinginfo">post id: 7781234567</p>
+<p class="postinginfo reveal">posted: <time class="date timeago" datetime="2024-05-01T10:00:00-0700">2024-05-01 10:00</time></p>
+<p class="postinginfo reveal">updated: <time class="date timeago" datetime="2024-05-03T09:30:00-0700">2024-05-03 09:30</time></p>
+<a href="/search/sss?sort=date&amp;purveyor-input=owner&amp;seller=12345">more ads by this user</a>
+</body></html>`
+
+const fixtureDetailURL = "https://sfbay.craigslist.org/eby/fuo/d/oakland-oak-table/7781234567.html"
+
+func parseFixtureDetails(t *testing.T) ListingDetails {
+	t.Helper()
+	details, err := parseDetails(strings.NewReader(fixtureDetailPage), fixtureDetailURL)
+	if err != nil {
+		t.Fatalf("parseDetails: %v", err)
+	}
+	return details
+}
+
+func TestParseDetailAttributes(t *testing.T) {
+	details := parseFixtureDetails(t)
+
+	want := map[string]string{
+		"condition":         "like new",
+		"size / dimensions": "72x36",
+		"make/model":        "Herman Miller Aeron",
+		"paint color":       "brown",
+	}
+	if !maps.Equal(details.Attributes, want) {
+		t.Errorf("attributes = %v, want %v", details.Attributes, want)
+	}
+	if details.Description != "Solid oak, a few scratches on the top. Pickup only." {
+		t.Errorf("description = %q", details.Description)
+	}
+	if len(details.Images) != 2 {
+		t.Errorf("images = %q, want 2", details.Images)
+	}
+}
+
+// Craigslist's datetimes carry the site's offset; they're stored in UTC and
+// only shown in -display-tz
+func TestPostTimesInUTC(t *testing.T) {
+	for _, tc := range []struct {
+		datetime string
+		want     time.Time
+	}{
+		{"2024-05-01T10:00:00-0700", time.Date(2024, 5, 1, 17, 0, 0, 0, time.UTC)},
+		{"2024-11-03T23:30:00-0500", time.Date(2024, 11, 4, 4, 30, 0, 0, time.UTC)},
+		{"2024-05-01T10:00:00+0530", time.Date(2024, 5, 1, 4, 30, 0, 0, time.UTC)},
+		{"2024-05-01T10:00:00+0000", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+	} {
+		page := `<p class="postinginfo reveal">posted: <time datetime="` + tc.datetime + `"></time></p>`
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		posted, _ := parsePostTimes(doc)
+		if !posted.Equal(tc.want) || posted.Location() != time.UTC {
+			t.Errorf("posted %s parsed as %v, want %v", tc.datetime, posted, tc.want)
+		}
+	}
+
+	db := newTestDB(t)
+	listing := fakeListing("Oak table", "$120", "7781234567")
+	listing.Posted, _ = time.Parse(detailTimeLayout, "2024-05-01T10:00:00-0700")
+	listing.Posted = listing.Posted.UTC()
+	listing.ScrapedAt = listing.Posted
+	if _, err := insertListing(context.Background(), db, listing); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := getListingByPostID(context.Background(), db, "7781234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2024-05-01T17:00:00Z"; stored.Posted.Format(time.RFC3339) != want {
+		t.Errorf("stored posted %s, want %s", stored.Posted.Format(time.RFC3339), want)
+	}
+
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	if got, want := inDisplayTZ(stored, tokyo).Posted.Format(time.RFC3339), "2024-05-02T02:00:00+09:00"; got != want {
+		t.Errorf("posted in Asia/Tokyo = %s, want %s", got, want)
+	}
+	tmpl := mustParseTemplate(t, `{{.Posted.Format "2006-01-02 15:04 MST"}}`)
+	if got, _ := renderNotification(tmpl, stored, tokyo, recencyPosted); got != "2024-05-02 02:00 JST" {
+		t.Errorf("notification shows posted %q, want 2024-05-02 02:00 JST", got)
+	}
+}
+
+// No more than -max-concurrent-details fetches run at once, however many
+// are queued
+func TestEnrichListingsConcurrency(t *testing.T) {
+	const maxConcurrent, fetches, interval = 2, 6, 5 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	var running, peak int
+	var done sync.WaitGroup
+	done.Add(fetches)
+	fetch := func(req detailRequest) {
+		defer done.Done()
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+
+		time.Sleep(4 * interval)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+
+	queue := make(chan detailRequest, fetches)
+	for i := range fetches {
+		queue <- detailRequest{PostID: strconv.Itoa(i), URL: fixtureDetailURL}
+	}
+	go enrichListings(ctx, queue, interval, maxConcurrent, fetch)
+	done.Wait()
+
+	if peak != maxConcurrent {
+		t.Errorf("%d fetches ran at once, want %d", peak, maxConcurrent)
+	}
+}
+
+// The fixture's posted and updated lines are both parsed, stored, and shown
+// as -recency-basis says
+func TestDetailPostedAndUpdated(t *testing.T) {
+	details := parseFixtureDetails(t)
+	wantPosted := time.Date(2024, 5, 1, 17, 0, 0, 0, time.UTC)
+	wantUpdated := time.Date(2024, 5, 3, 16, 30, 0, 0, time.UTC)
+	if !details.Posted.Equal(wantPosted) || !details.Updated.Equal(wantUpdated) {
+		t.Fatalf("parsed posted %v and updated %v, want %v and %v", details.Posted, details.Updated, wantPosted, wantUpdated)
+	}
+
+	db := newTestDB(t)
+	listing := fakeListing("Oak table", "$120", "7781234567")
+	listing.ListingURL = fixtureDetailURL
+	listing.Posted = time.Now().UTC()
+	listing.ScrapedAt = listing.Posted
+	if _, err := insertListing(context.Background(), db, listing); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateListingDetails(context.Background(), db, fixtureDetailURL, details); err != nil {
+		t.Fatalf("updateListingDetails: %v", err)
+	}
+	stored, err := getListingByPostID(context.Background(), db, "7781234567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Posted.Equal(wantPosted) || stored.Updated == nil || !stored.Updated.Equal(wantUpdated) {
+		t.Fatalf("stored posted %v and updated %v", stored.Posted, stored.Updated)
+	}
+	if err := loadPostTimes(context.Background(), db, &listing); err != nil || !listing.Posted.Equal(wantPosted) {
+		t.Errorf("loadPostTimes gave posted %v, %v", listing.Posted, err)
+	}
+
+	tmpl := mustParseTemplate(t, `{{.Posted.Format "2006-01-02 15:04"}}`)
+	for basis, want := range map[string]string{recencyPosted: "2024-05-01 17:00", recencyUpdated: "2024-05-03 16:30"} {
+		if got, _ := renderNotification(tmpl, stored, time.UTC, basis); got != want {
+			t.Errorf("with -recency-basis %s, notification shows %q, want %q", basis, got, want)
+		}
+	}
+
+	// A page without the times keeps the scrape time as posted and leaves
+	// updated unset, so -recency-basis updated falls back to posted
+	bare := fakeListing("Chair", "$20", "7781234570")
+	bare.Posted = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	bare.ScrapedAt = bare.Posted
+	if _, err := insertListing(context.Background(), db, bare); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateListingDetails(context.Background(), db, bare.ListingURL, ListingDetails{Description: "Sturdy"}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = getListingByPostID(context.Background(), db, "7781234570")
+	if err != nil || !stored.Posted.Equal(bare.Posted) || stored.Updated != nil {
+		t.Errorf("without times on the page, stored posted %v and updated %v, %v", stored.Posted, stored.Updated, err)
+	}
+	if got := stored.recency(recencyUpdated); !got.Equal(bare.Posted) {
+		t.Errorf("recency(updated) without an updated time = %v, want posted %v", got, bare.Posted)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Appends newly inserted listings to -jsonl-out, one JSON object per line
+type jsonlWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer // nil for stdout
+}
+
+// Open path for appending, creating it if needed; "-" means stdout
+func openJSONL(path string) (*jsonlWriter, error) {
+	if path == "-" {
+		return &jsonlWriter{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open -jsonl-out: %v", err)
+	}
+	return &jsonlWriter{w: f, c: f}, nil
+}
+
+// Append one listing. Each line goes out in a single unbuffered write, so
+// concurrent writers and readers tailing the file never see a partial line.
+func (jw *jsonlWriter) Write(listing Listing) error {
+	line, err := json.Marshal(listing)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	_, err = jw.w.Write(line)
+	return err
+}
+
+func (jw *jsonlWriter) Close() error {
+	if jw.c == nil {
+		return nil
+	}
+	return jw.c.Close()
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Images larger than this are skipped rather than stored
+const maxImageBytes = 10 << 20
+
+// Downloads images from Craigslist, following redirects only within it
+var imageClient = &http.Client{
+	Timeout:       time.Minute,
+	CheckRedirect: checkCraigslistRedirect,
+}
+
+// Uploads images to an S3-compatible -image-store
+var uploadClient = &http.Client{Timeout: time.Minute}
+
+// Somewhere to keep copies of listing images, set with -image-store
+type imageStore interface {
+	// Save an image under name, returning where it was stored (a file path or URL)
+	Save(ctx context.Context, name, contentType string, data []byte) (string, error)
+}
+
+// Build the store for -image-store: "s3://bucket/prefix" for an S3-compatible
+// bucket, or otherwise a local directory, which is created if needed
+func newImageStore(location string) (imageStore, error) {
+	if rest, ok := strings.CutPrefix(location, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("invalid -image-store %q: no bucket", location)
+		}
+		return newS3ImageStore(bucket, prefix)
+	}
+	if err := os.MkdirAll(location, 0o755); err != nil {
+		return nil, fmt.Errorf("invalid -image-store %q: %v", location, err)
+	}
+	return dirImageStore{dir: location}, nil
+}
+
+// Fetch an image from Craigslist, refusing anything that isn't an image or is
+// over maxImageBytes
+func downloadImage(ctx context.Context, imageURL string) ([]byte, string, error) {
+	if !isCraigslistURL(imageURL) {
+		return nil, "", fmt.Errorf("refusing to fetch non-Craigslist URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", httpUserAgent)
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("not an image: %q", resp.Header.Get("Content-Type"))
+	}
+	if resp.ContentLength > maxImageBytes {
+		return nil, "", fmt.Errorf("image is %d bytes, over the %d byte limit", resp.ContentLength, maxImageBytes)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxImageBytes {
+		return nil, "", fmt.Errorf("image is over the %d byte limit", maxImageBytes)
+	}
+	return data, contentType, nil
+}
+
+// Download a listing's images into the store and record where each one went.
+// Failures are logged per image so one bad image doesn't lose the rest.
+func storeImages(ctx context.Context, db *sql.DB, store imageStore, postID, listingURL string, images []string) int {
+	stored := 0
+	for i, imageURL := range images {
+		data, contentType, err := downloadImage(ctx, imageURL)
+		if err != nil {
+			fmt.Printf("Failed to download image %s: %v\n", imageURL, err)
+			continue
+		}
+		name := fmt.Sprintf("%s-%d%s", postID, i, imageExtension(contentType))
+		location, err := store.Save(ctx, name, contentType, data)
+		if err != nil {
+			fmt.Printf("Failed to store image %s: %v\n", imageURL, err)
+			continue
+		}
+
+		updateQuery := `
+		UPDATE images
+		SET stored_path = ?
+		WHERE url = ? AND listing_id = (SELECT id FROM listings WHERE listing_url = ?);
+		`
+		if _, err := db.ExecContext(ctx, updateQuery, location, imageURL, listingURL); err != nil {
+			fmt.Printf("Failed to record stored image %s: %v\n", imageURL, err)
+			continue
+		}
+		stored++
+	}
+	return stored
+}
+
+// Pick a file extension for an image's content type, e.g. ".jpg" for image/jpeg
+func imageExtension(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	}
+	return ""
+}
+
+// Keeps images as files in a local directory
+type dirImageStore struct {
+	dir string
+}
+
+func (ds dirImageStore) Save(ctx context.Context, name, contentType string, data []byte) (string, error) {
+	path := filepath.Join(ds.dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Uploads images to an S3-compatible bucket with path-style requests signed
+// with AWS Signature Version 4. Credentials come from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and (optionally) AWS_SESSION_TOKEN; AWS_REGION
+// defaults to us-east-1, and AWS_ENDPOINT_URL can point at another provider.
+type s3ImageStore struct {
+	endpoint     string
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+func newS3ImageStore(bucket, prefix string) (imageStore, error) {
+	store := s3ImageStore{
+		bucket:       bucket,
+		prefix:       strings.Trim(prefix, "/"),
+		region:       os.Getenv("AWS_REGION"),
+		endpoint:     os.Getenv("AWS_ENDPOINT_URL"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("an s3:// -image-store needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+	if store.endpoint == "" {
+		store.endpoint = "https://s3." + store.region + ".amazonaws.com"
+	}
+	store.endpoint = strings.TrimSuffix(store.endpoint, "/")
+	return store, nil
+}
+
+func (ss s3ImageStore) Save(ctx context.Context, name, contentType string, data []byte) (string, error) {
+	key := path.Join(ss.prefix, name)
+	objectURL := ss.endpoint + "/" + url.PathEscape(ss.bucket) + "/" + escapeKey(key)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	ss.sign(req, data, time.Now().UTC())
+
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("upload failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return "s3://" + ss.bucket + "/" + key, nil
+}
+
+// Add the Signature Version 4 headers to an S3 request
+func (ss s3ImageStore) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if ss.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", ss.sessionToken)
+	}
+
+	// Every header set above is signed, along with the host, in sorted order
+	headers := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if ss.sessionToken != "" {
+		headers = append(headers, "x-amz-security-token")
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		value := req.Header.Get(h)
+		if h == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + ss.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+ss.secretKey), date)
+	key = hmacSHA256(key, ss.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+ss.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// Escape each segment of an object key, keeping the slashes between them
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Insert listings from a JSON array in the shape GET /listings returns, for
+// -import. Listings already in the database are left alone and ones that fail
+// validation are skipped with a message. Returns how many were new.
+func importListings(ctx context.Context, db *sql.DB, r io.Reader) (int, error) {
+	var listings []Listing
+	if err := json.NewDecoder(r).Decode(&listings); err != nil {
+		return 0, fmt.Errorf("failed to parse listings: %v", err)
+	}
+
+	imported := 0
+	for i, listing := range listings {
+		if err := listing.Valid(); err != nil {
+			fmt.Printf("Skipping listing %d (%q): %v\n", i, listing.Title, err)
+			continue
+		}
+		// Fill in what older exports may lack
+		if listing.PostID == "" {
+			listing.PostID = parsePostID(listing.ListingURL)
+		}
+		if listing.Section == "" {
+			listing.Section = parseSection(listing.ListingURL)
+		}
+		if listing.PriceCents == nil {
+			listing.PriceCents = priceCents(listing.Price)
+		}
+		if listing.Posted.IsZero() {
+			listing.Posted = time.Now()
+		}
+		listing.Posted = listing.Posted.UTC()
+		if listing.ScrapedAt.IsZero() {
+			listing.ScrapedAt = listing.Posted
+		}
+		listing.ScrapedAt = listing.ScrapedAt.UTC()
+		if listing.Updated != nil {
+			updated := listing.Updated.UTC()
+			listing.Updated = &updated
+		}
+
+		isNew, err := insertListing(ctx, db, listing)
+		if err != nil {
+			return imported, fmt.Errorf("failed to insert listing %d: %v", i, err)
+		}
+		if isNew {
+			imported++
+		}
+	}
+	return imported, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// A saved static results page, as Craigslist serves it to the http engine
+const fixtureResultsPage = `<!DOCTYPE html>
+<html><body><ol class="cl-static-search-results">
+<li class="cl-static-search-result" title="Free couch">
+	<a href="https://sfbay.craigslist.org/eby/fuo/d/oakland-free-couch/7781234567.html">
+		<div class="title">Free couch</div>
+		<div class="details"><div class="location">Oakland</div></div>
+	</a>
+</li>
+<li class="cl-static-search-result" title="Oak dining table">
+	<a href="https://sfbay.craigslist.org/sfc/fuo/d/san-francisco-oak-table/7781234568.html">
+		<div class="title">Oak dining table</div>
+		<div class="details"><div class="price">$120</div><div class="location">San Francisco</div></div>
+	</a>
+</li>
+<li class="cl-static-search-result" title="Desk chair">
+	<a href="https://sfbay.craigslist.org/pen/fuo/d/palo-alto-desk-chair/7781234569.html">
+		<div class="title">Desk chair</div>
+		<div class="details"><div class="price">$1,200.50</div><div class="location">Palo Alto</div></div>
+	</a>
+</li>
+</ol></body></html>`
+
+// Open a fresh in-memory database, closed when the test ends
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := initDB(context.Background(), ":memory:", "off")
+	if err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Records what it's asked to send instead of sending it
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (rn *recordingNotifier) Notify(ctx context.Context, n Notification) error {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.sent = append(rn.sent, n)
+	return nil
+}
+
+func (rn *recordingNotifier) titles() []string {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	var titles []string
+	for _, n := range rn.sent {
+		titles = append(titles, n.Listing.Title)
+	}
+	return titles
+}
+
+// A config for one site with the default notifier replaced by notifier, as
+// parseFlags would set it up without any flags
+func testCycleConfig(t *testing.T, notifier Notifier) Config {
+	t.Helper()
+	return Config{
+		City:            "sfbay",
+		Sites:           []string{"sfbay"},
+		Category:        "fuo",
+		Sort:            "date",
+		SellerType:      sellerAll,
+		Engine:          engineHTTP,
+		Selectors:       defaultSelectors,
+		StaticSelectors: staticSelectors,
+		AcceptLanguage:  "en-US",
+		WaitTimeout:     10 * time.Second,
+		Notifiers:       map[string]Notifier{defaultNotifierName: notifier},
+		NotifyMode:      notifyOnce,
+		NotifyTemplate:  mustParseTemplate(t, defaultNotifyTemplate),
+		DisplayTZ:       time.UTC,
+		Retention:       time.Hour,
+		RepostWindow:    24 * time.Hour,
+	}
+}
+
+// Parse a notification template the way parseFlags does
+func mustParseTemplate(t *testing.T, text string) *template.Template {
+	t.Helper()
+	tmpl, err := template.New("notify").Parse(text)
+	if err != nil {
+		t.Fatalf("parse template %q: %v", text, err)
+	}
+	return tmpl
+}
+
+// Scrape a fixture results page with the http engine, then store and notify
+// through the real cycle, without Craigslist or Chrome
+func TestCycleAgainstFixtureServer(t *testing.T) {
+	requests := 0
+	fixture := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(fixtureResultsPage))
+	}))
+	defer fixture.Close()
+
+	db := newTestDB(t)
+	notifier := &recordingNotifier{}
+	cfg := testCycleConfig(t, notifier)
+	state := &cycleState{
+		browserCtx: context.Background(),
+		newScraper: func(cfg Config, searchURL string) Scraper {
+			return newScraper(cfg, fixture.URL+"/search/fuo")
+		},
+		firstCycle: true,
+	}
+
+	if err := doCycle(context.Background(), cfg, db, state); err != nil {
+		t.Fatalf("doCycle: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("fixture server got %d requests, want 1", requests)
+	}
+
+	n, err := countListings(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("%d listings stored, want 3", n)
+	}
+	listing, err := getListingByPostID(context.Background(), db, "7781234569")
+	if err != nil {
+		t.Fatalf("getListingByPostID: %v", err)
+	}
+	if listing.Site != "sfbay" || listing.City != "Palo Alto" || listing.PriceCents == nil || *listing.PriceCents != 120050 {
+		t.Errorf("stored listing = site %q, city %q, price_cents %v", listing.Site, listing.City, listing.PriceCents)
+	}
+
+	// Without saved searches, only the listing without a price is interesting
+	if titles := notifier.titles(); len(titles) != 1 || titles[0] != "Free couch" {
+		t.Errorf("notified %q, want just the free couch", titles)
+	}
+}
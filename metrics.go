@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Counters published on the API's /debug/vars. Every valid listing scraped is
+// counted as either inserted (new) or a duplicate, and then as filtered out
+// (matched no search or price rule) or notified, unless its notification was
+// suppressed. The _by_city maps break each of these down by listing city.
+var (
+	scrapedCount   = expvar.NewInt("listings_scraped")
+	insertedCount  = expvar.NewInt("listings_inserted")
+	duplicateCount = expvar.NewInt("listings_duplicate")
+	filteredCount  = expvar.NewInt("listings_filtered")
+	notifiedListed = expvar.NewInt("listings_notified")
+	notifiedCount  = expvar.NewInt("notifications_sent") // one per notifier delivered to
+
+	cityCounts      = expvar.NewMap("listings_scraped_by_city")
+	insertedByCity  = expvar.NewMap("listings_inserted_by_city")
+	duplicateByCity = expvar.NewMap("listings_duplicate_by_city")
+	filteredByCity  = expvar.NewMap("listings_filtered_by_city")
+	notifiedByCity  = expvar.NewMap("listings_notified_by_city")
+
+	// Unlike the counters, a gauge of what's in the databases right now, keyed
+	// by category and site, e.g. "sss/sfbay", and for profiles by their name
+	// too, e.g. "business/bfs/sfbay", since each has its own database. Only the
+	// sites and categories monitors search are included, so nearby areas and
+	// old rows don't add keys.
+	storedGauge = expvar.NewMap("listings_stored_by_search")
+
+	runIDVar = expvar.NewString("run_id") // set by main from currentRun
+)
+
+// Count one listing's outcome, in total and for its city
+func countOutcome(total *expvar.Int, byCity *expvar.Map, city string) {
+	total.Add(1)
+	byCity.Add(city, 1)
+}
+
+// Set the stored listings gauge for each site cfg searches from the counts
+// in dbs, as of the end of a cycle
+func updateStoredGauge(ctx context.Context, cfg Config, dbs []*sql.DB) error {
+	bySite := make(map[string]int)
+	for _, db := range dbs {
+		counts, err := countListingsByCity(ctx, db)
+		if err != nil {
+			return err
+		}
+		for site, n := range counts {
+			bySite[site] += n
+		}
+	}
+	for _, site := range searchSites(cfg) {
+		gauge := new(expvar.Int)
+		gauge.Set(int64(bySite[site]))
+		storedGauge.Set(storedGaugeKey(cfg, site), gauge)
+	}
+	return nil
+}
+
+// The storedGauge key for one site a monitor searches
+func storedGaugeKey(cfg Config, site string) string {
+	key := cfg.Category + "/" + site
+	if cfg.Name != "" {
+		key = cfg.Name + "/" + key
+	}
+	return key
+}
+
+// Totals for the shutdown report, across every monitor
+type runStats struct {
+	id            string // see newRunID
+	started       time.Time
+	cycles        atomic.Int64 // completed, successfully or not
+	failedCycles  atomic.Int64 // every site failed
+	blockedCycles atomic.Int64
+	siteErrors    atomic.Int64 // sites that failed to scrape, in any cycle
+}
+
+var currentRun = &runStats{id: newRunID(), started: time.Now()}
+
+// A short ID for this run, e.g. 20240501-142233-9f3c: the start time in UTC
+// plus a random suffix, so restarts and instances started together differ
+func newRunID() string {
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// One line summing up the run, for the log and -report-notify
+func (rs *runStats) summary() string {
+	return fmt.Sprintf("Run summary for %s: ran for %v, %d cycles (%d failed, %d blocked), %d site errors; %d listings scraped, %d inserted, %d notified, %d notifications sent",
+		rs.id, time.Since(rs.started).Round(time.Second), rs.cycles.Load(), rs.failedCycles.Load(), rs.blockedCycles.Load(), rs.siteErrors.Load(),
+		scrapedCount.Value(), insertedCount.Value(), notifiedListed.Value(), notifiedCount.Value())
+}
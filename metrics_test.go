@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"testing"
+)
+
+// Monitors searching the same category and site keep separate gauges
+func TestUpdateStoredGauge(t *testing.T) {
+	mainDB, profileDB := newTestDB(t), newTestDB(t)
+	addTestListing(t, mainDB, "sfbay", "111")
+	addTestListing(t, mainDB, "sfbay", "222")
+	addTestListing(t, profileDB, "sfbay", "333")
+
+	mainCfg := Config{City: "sfbay", Sites: []string{"sfbay"}, Category: "fuo"}
+	profileCfg := mainCfg
+	profileCfg.Name = "business"
+	if err := updateStoredGauge(context.Background(), mainCfg, []*sql.DB{mainDB}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateStoredGauge(context.Background(), profileCfg, []*sql.DB{profileDB}); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]int64{"fuo/sfbay": 2, "business/fuo/sfbay": 1} {
+		gauge, ok := storedGauge.Get(key).(*expvar.Int)
+		if !ok || gauge.Value() != want {
+			t.Errorf("listings_stored_by_search[%q] = %v, want %d", key, storedGauge.Get(key), want)
+		}
+	}
+}
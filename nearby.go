@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// The most nearby areas -nearby adds to a cycle, however many pages suggest
+const nearbyMax = 10
+
+// The nearby areas each site's results page last suggested, recorded by the
+// scrapers with -nearby so doCycle can fan out to them
+var nearbyAreas = struct {
+	sync.Mutex
+	bySite map[string][]string
+}{bySite: make(map[string][]string)}
+
+// Record the nearby areas a site's results page links to
+func recordNearbyAreas(site, searchURL, htmlContent, selector string) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlContent))
+	if err != nil {
+		return
+	}
+	areas := parseNearbyAreas(doc, searchURL, selector)
+	debugf("Found %d nearby areas on %s: %v", len(areas), site, areas)
+
+	nearbyAreas.Lock()
+	defer nearbyAreas.Unlock()
+	nearbyAreas.bySite[site] = areas
+}
+
+// Extract the sites the nearby-area links on a page point to, e.g.
+// "modesto" for https://modesto.craigslist.org/, in page order
+func parseNearbyAreas(doc *goquery.Document, pageURL, selector string) []string {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil
+	}
+
+	var areas []string
+	doc.Find(selector).Each(func(i int, s *goquery.Selection) {
+		href, ok := s.Attr("href")
+		if !ok {
+			return
+		}
+		link, err := base.Parse(href)
+		if err != nil || !isCraigslistURL(link.String()) {
+			return
+		}
+		site, ok := strings.CutSuffix(strings.ToLower(link.Hostname()), ".craigslist.org")
+		if ok && site != "" && site != "www" && !slices.Contains(areas, site) {
+			areas = append(areas, site)
+		}
+	})
+	return areas
+}
+
+// The nearby areas to scrape along with sites: those their pages suggested,
+// minus the sites themselves, up to nearbyMax. Only the given sites' pages
+// are consulted, so the fan-out never goes more than one area deep.
+func nearbySites(sites []string) []string {
+	nearbyAreas.Lock()
+	defer nearbyAreas.Unlock()
+
+	var nearby []string
+	for _, site := range sites {
+		for _, area := range nearbyAreas.bySite[site] {
+			if slices.Contains(sites, area) || slices.Contains(nearby, area) {
+				continue
+			}
+			if len(nearby) == nearbyMax {
+				fmt.Printf("Only scraping the first %d nearby areas\n", nearbyMax)
+				return nearby
+			}
+			nearby = append(nearby, area)
+		}
+	}
+	return nearby
+}
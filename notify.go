@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The name of the notifier configured by the -ntfy-* flags
+const defaultNotifierName = "ntfy"
+
+// Shared by every notifier so a hung endpoint can't stall the scrape loop
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+// A notification about one listing, as handed to each notifier
+type Notification struct {
+	Message  string  `json:"message"`            // the rendered -notify-template text
+	Search   string  `json:"search,omitempty"`   // the saved search that matched, if any
+	Priority string  `json:"priority,omitempty"` // see notificationPriority; high when empty
+	Listing  Listing `json:"listing"`            // for notifiers that send structured data
+}
+
+// A destination for notifications
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// A notifier as described in the -config file, e.g.
+//
+//	{"name": "deals", "type": "discord", "url": "https://discord.com/api/webhooks/..."}
+type NotifierConfig struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`    // ntfy, discord, slack, telegram, or webhook
+	URL    string `json:"url"`     // topic URL for ntfy, webhook URL otherwise
+	Token  string `json:"token"`   // ntfy access token or Telegram bot token
+	ChatID string `json:"chat_id"` // Telegram only
+}
+
+// Build a notifier from its configuration
+func newNotifier(nc NotifierConfig) (Notifier, error) {
+	switch nc.Type {
+	case "ntfy":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("notifier %q: ntfy needs a url", nc.Name)
+		}
+		return ntfyNotifier{topicURL: nc.URL, token: nc.Token}, nil
+	case "discord", "slack", "webhook":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("notifier %q: %s needs a url", nc.Name, nc.Type)
+		}
+		switch nc.Type {
+		case "discord":
+			return discordNotifier{webhookURL: nc.URL}, nil
+		case "slack":
+			return slackNotifier{webhookURL: nc.URL}, nil
+		}
+		return webhookNotifier{url: nc.URL}, nil
+	case "telegram":
+		if nc.Token == "" || nc.ChatID == "" {
+			return nil, fmt.Errorf("notifier %q: telegram needs a token and chat_id", nc.Name)
+		}
+		return telegramNotifier{token: nc.Token, chatID: nc.ChatID}, nil
+	default:
+		return nil, fmt.Errorf("notifier %q: unknown type %q", nc.Name, nc.Type)
+	}
+}
+
+// One notifier a listing goes to, and the saved searches that sent it there
+type notificationRoute struct {
+	notifier string
+	searches []string
+}
+
+// Work out where a listing's notification goes: each matching search routes
+// to its own notifiers, and with no matching search (no saved searches, or a
+// below-average price) it goes to the default ntfy topic. A notifier that
+// several searches route to still gets the listing once, naming them all.
+func notificationRoutes(matched []SavedSearch) []notificationRoute {
+	if len(matched) == 0 {
+		return []notificationRoute{{notifier: defaultNotifierName}}
+	}
+	var routes []notificationRoute
+	index := make(map[string]int)
+	for _, search := range matched {
+		for _, name := range search.Notifiers {
+			i, ok := index[name]
+			if !ok {
+				i = len(routes)
+				index[name] = i
+				routes = append(routes, notificationRoute{notifier: name})
+			}
+			if !slices.Contains(routes[i].searches, search.Name) {
+				routes[i].searches = append(routes[i].searches, search.Name)
+			}
+		}
+	}
+	return routes
+}
+
+// Send a notification to each of the named notifiers, returning how many
+// deliveries succeeded. Failures are logged and don't stop the others. A
+// message sent via the same notifier within -notify-dedup-window is dropped.
+// With -notify-spool, failures are queued, and counted once delivered.
+func dispatch(ctx context.Context, notifiers map[string]Notifier, names []string, n Notification) int {
+	sent := 0
+	for _, name := range names {
+		if recentNotifications != nil && recentNotifications.Recent(name, n.Message) {
+			fmt.Printf("Dropping duplicate notification via %s: %s\n", name, n.Message)
+			continue
+		}
+		err := notifiers[name].Notify(ctx, n)
+		if errors.Is(err, errSpooled) {
+			fmt.Printf("Notification via %s %v: %s\n", name, err, n.Message)
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Failed to send notification via %s: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("Notification sent via %s: %s\n", name, n.Message)
+		if recentNotifications != nil {
+			recentNotifications.Add(name, n.Message)
+		}
+		sent++
+	}
+	return sent
+}
+
+// The message -send-test-notification sends
+const testNotificationMessage = "Craigslist bot test notification"
+
+// Send the test message through every notifier of cfg and its profiles,
+// reporting how each went, and return how many failed. It goes straight to
+// each notifier, bypassing -notify-dedup-window and -notify-spool, and a
+// notifier that profiles share is only tried once.
+func sendTestNotifications(ctx context.Context, cfg Config) int {
+	tried := make(map[string]bool)
+	failed := 0
+	for _, c := range append([]Config{cfg}, cfg.Profiles...) {
+		for _, name := range slices.Sorted(maps.Keys(c.Notifiers)) {
+			notifier := c.Notifiers[name]
+			if sn, ok := notifier.(spooledNotifier); ok {
+				notifier = sn.notifier
+			}
+			key := notifierKey(notifier)
+			if tried[key] {
+				continue
+			}
+			tried[key] = true
+
+			if err := notifier.Notify(ctx, Notification{Message: testNotificationMessage}); err != nil {
+				fmt.Printf("%s%s: failed: %v\n", c.logPrefix(), name, err)
+				failed++
+				continue
+			}
+			fmt.Printf("%s%s: ok\n", c.logPrefix(), name)
+		}
+	}
+	return failed
+}
+
+// Publishes to an ntfy topic
+type ntfyNotifier struct {
+	topicURL string
+	token    string
+}
+
+func (nn ntfyNotifier) Notify(ctx context.Context, n Notification) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", nn.topicURL, strings.NewReader(n.Message))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	title := "Craigslist Alert"
+	if n.Search != "" {
+		title += ": " + n.Search
+	}
+	req.Header.Set("Title", title)
+	priority := n.Priority
+	if priority == "" {
+		priority = priorityHigh
+	}
+	req.Header.Set("Priority", priority)
+	if url := listingLink(n); url != "" {
+		req.Header.Set("Click", url)
+	}
+	if nn.token != "" {
+		req.Header.Set("Authorization", "Bearer "+nn.token)
+	}
+	return doNotifyRequest(req)
+}
+
+// Posts to a Discord channel webhook
+type discordNotifier struct {
+	webhookURL string
+}
+
+func (dn discordNotifier) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, dn.webhookURL, map[string]string{"content": dn.format(n)})
+}
+
+// Discord markdown: the search in bold and a masked link to the listing, with
+// markdown in the message itself escaped so titles can't garble it
+func (dn discordNotifier) format(n Notification) string {
+	var sb strings.Builder
+	if n.Priority == priorityUrgent {
+		sb.WriteString("**URGENT** ")
+	}
+	if n.Search != "" {
+		sb.WriteString("**" + discordEscaper.Replace(n.Search) + "** ")
+	}
+	sb.WriteString(discordEscaper.Replace(n.Message))
+	if url := listingLink(n); url != "" {
+		sb.WriteString("\n[View listing](" + url + ")")
+	}
+	return sb.String()
+}
+
+var discordEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`, "`", "\\`", "|", `\|`, ">", `\>`, "[", `\[`, "]", `\]`)
+
+// Posts to a Slack incoming webhook
+type slackNotifier struct {
+	webhookURL string
+}
+
+func (sn slackNotifier) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, sn.webhookURL, map[string]string{"text": sn.format(n)})
+}
+
+// Slack mrkdwn: the search in bold and a link to the listing, with &, <, and >
+// escaped as Slack requires
+func (sn slackNotifier) format(n Notification) string {
+	var sb strings.Builder
+	if n.Priority == priorityUrgent {
+		sb.WriteString("*URGENT* ")
+	}
+	if n.Search != "" {
+		sb.WriteString("*" + slackEscaper.Replace(n.Search) + "* ")
+	}
+	sb.WriteString(slackEscaper.Replace(n.Message))
+	if url := listingLink(n); url != "" {
+		sb.WriteString("\n<" + url + "|View listing>")
+	}
+	return sb.String()
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Sends a message from a Telegram bot to a chat
+type telegramNotifier struct {
+	token  string
+	chatID string
+}
+
+func (tn telegramNotifier) Notify(ctx context.Context, n Notification) error {
+	apiURL := "https://api.telegram.org/bot" + tn.token + "/sendMessage"
+	return postJSON(ctx, apiURL, map[string]string{"chat_id": tn.chatID, "text": tn.format(n), "parse_mode": "HTML"})
+}
+
+// Telegram HTML: the search in bold and a link to the listing, with the
+// message itself escaped
+func (tn telegramNotifier) format(n Notification) string {
+	var sb strings.Builder
+	if n.Priority == priorityUrgent {
+		sb.WriteString("<b>URGENT</b> ")
+	}
+	if n.Search != "" {
+		sb.WriteString("<b>" + html.EscapeString(n.Search) + "</b> ")
+	}
+	sb.WriteString(html.EscapeString(n.Message))
+	if url := listingLink(n); url != "" {
+		sb.WriteString("\n<a href=\"" + html.EscapeString(url) + "\">View listing</a>")
+	}
+	return sb.String()
+}
+
+// Posts the full listing as JSON, for other programs to consume
+type webhookNotifier struct {
+	url string
+}
+
+func (wn webhookNotifier) Notify(ctx context.Context, n Notification) error {
+	return postJSON(ctx, wn.url, n)
+}
+
+// The listing's URL, for notifiers that can link to it separately, unless
+// the -notify-template already put it in the message
+func listingLink(n Notification) string {
+	url := n.Listing.ListingURL
+	if url == "" || strings.Contains(n.Message, url) {
+		return ""
+	}
+	return url
+}
+
+// POST a value as JSON
+func postJSON(ctx context.Context, endpoint string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", redactURLError(err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doNotifyRequest(req)
+}
+
+// Send a notifier's request, treating any non-2xx response as a failure
+func doNotifyRequest(req *http.Request) error {
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return redactURLError(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Drop the URL from a request error, keeping only its host. Webhook URLs and
+// the Telegram bot token are secrets, and *url.Error prints the whole URL.
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	host := "the notifier"
+	if u, parseErr := url.Parse(urlErr.URL); parseErr == nil && u.Host != "" {
+		host = u.Host
+	}
+	return fmt.Errorf("%s %s: %v", urlErr.Op, host, urlErr.Err)
+}
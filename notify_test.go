@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A notifier for a destination that records its messages, or fails them all.
+// Like the real notifiers, two with the same destination are the same notifier.
+type testNotifier struct {
+	url  string
+	fail bool
+	sent *[]string
+}
+
+func (tn testNotifier) Notify(ctx context.Context, n Notification) error {
+	if tn.fail {
+		return errors.New("webhook returned 404")
+	}
+	*tn.sent = append(*tn.sent, n.Message)
+	return nil
+}
+
+// -send-test-notification tries each notifier once, and reports how many failed
+func TestSendTestNotifications(t *testing.T) {
+	var okSent, sharedSent []string
+	ok := testNotifier{url: "https://ntfy.example/ok", sent: &okSent}
+	shared := testNotifier{url: "https://ntfy.example/shared", sent: &sharedSent}
+	cfg := Config{Notifiers: map[string]Notifier{
+		"ok":     ok,
+		"broken": testNotifier{url: "https://ntfy.example/broken", fail: true},
+		"shared": shared,
+	}}
+	cfg.Profiles = []Config{{Name: "weekend", Notifiers: map[string]Notifier{
+		"shared":      shared,
+		"also broken": testNotifier{url: "https://ntfy.example/also-broken", fail: true},
+	}}}
+
+	if failed := sendTestNotifications(context.Background(), cfg); failed != 2 {
+		t.Errorf("sendTestNotifications = %d failed, want 2", failed)
+	}
+	for name, sent := range map[string][]string{"ok": okSent, "shared": sharedSent} {
+		if len(sent) != 1 || sent[0] != testNotificationMessage {
+			t.Errorf("%s got %q, want the test message once", name, sent)
+		}
+	}
+}
+
+// A notification whose message and search both need escaping on every platform
+func markupNotification() Notification {
+	return Notification{
+		Message:  "New free listing! <Couch> *mint* & [clean]",
+		Search:   "free_stuff",
+		Priority: priorityUrgent,
+		Listing:  Listing{ListingURL: "https://sfbay.craigslist.org/fuo/d/couch/7781234567.html?a=1&b=2"},
+	}
+}
+
+func TestNotifierFormats(t *testing.T) {
+	n := markupNotification()
+	for _, tc := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"discord", discordNotifier{}.format(n),
+			"**URGENT** **free\\_stuff** New free listing! <Couch\\> \\*mint\\* & \\[clean\\]\n[View listing](https://sfbay.craigslist.org/fuo/d/couch/7781234567.html?a=1&b=2)"},
+		{"slack", slackNotifier{}.format(n),
+			"*URGENT* *free_stuff* New free listing! &lt;Couch&gt; *mint* &amp; [clean]\n<https://sfbay.craigslist.org/fuo/d/couch/7781234567.html?a=1&b=2|View listing>"},
+		{"telegram", telegramNotifier{}.format(n),
+			"<b>URGENT</b> <b>free_stuff</b> New free listing! &lt;Couch&gt; *mint* &amp; [clean]\n<a href=\"https://sfbay.craigslist.org/fuo/d/couch/7781234567.html?a=1&amp;b=2\">View listing</a>"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s formatted\n%s\nwant\n%s", tc.name, tc.got, tc.want)
+		}
+	}
+
+	// A link the template already put in the message isn't repeated
+	n.Priority, n.Search = priorityDefault, ""
+	n.Message = "Couch " + n.Listing.ListingURL
+	got, want := slackNotifier{}.format(n), "Couch https://sfbay.craigslist.org/fuo/d/couch/7781234567.html?a=1&amp;b=2"
+	if got != want {
+		t.Errorf("slack formatted %q, want %q", got, want)
+	}
+}
+
+// What each backend actually sends: ntfy plain text with its metadata in
+// headers, the others JSON
+func TestNotifierRequests(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+	n := markupNotification()
+
+	if err := (ntfyNotifier{topicURL: srv.URL + "/deals", token: "tk_test"}).Notify(context.Background(), n); err != nil {
+		t.Fatalf("ntfy: %v", err)
+	}
+	if string(body) != n.Message || got.URL.Path != "/deals" || got.Header.Get("Title") != "Craigslist Alert: free_stuff" ||
+		got.Header.Get("Priority") != priorityUrgent || got.Header.Get("Click") != n.Listing.ListingURL || got.Header.Get("Authorization") != "Bearer tk_test" {
+		t.Errorf("ntfy sent %q to %s with headers %v", body, got.URL.Path, got.Header)
+	}
+
+	for name, tc := range map[string]struct {
+		notifier Notifier
+		field    string
+		want     string
+	}{
+		"discord": {discordNotifier{webhookURL: srv.URL}, "content", discordNotifier{}.format(n)},
+		"slack":   {slackNotifier{webhookURL: srv.URL}, "text", slackNotifier{}.format(n)},
+	} {
+		if err := tc.notifier.Notify(context.Background(), n); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var payload map[string]string
+		if err := json.Unmarshal(body, &payload); err != nil || got.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("%s sent %q (%s): %v", name, body, got.Header.Get("Content-Type"), err)
+		}
+		if payload[tc.field] != tc.want {
+			t.Errorf("%s sent %s %q, want %q", name, tc.field, payload[tc.field], tc.want)
+		}
+	}
+
+	if err := (webhookNotifier{url: srv.URL}).Notify(context.Background(), n); err != nil {
+		t.Fatalf("webhook: %v", err)
+	}
+	var sent Notification
+	if err := json.Unmarshal(body, &sent); err != nil || sent.Message != n.Message || sent.Listing.ListingURL != n.Listing.ListingURL {
+		t.Errorf("webhook sent %s: %v", body, err)
+	}
+}
+
+func TestNotificationRoutes(t *testing.T) {
+	routes := notificationRoutes([]SavedSearch{
+		{Name: "couches", Notifiers: []string{"ntfy", "webhook"}},
+		{Name: "cheap", Notifiers: []string{"webhook", "discord"}},
+	})
+	want := []notificationRoute{
+		{notifier: "ntfy", searches: []string{"couches"}},
+		{notifier: "webhook", searches: []string{"couches", "cheap"}},
+		{notifier: "discord", searches: []string{"cheap"}},
+	}
+	if !slices.EqualFunc(routes, want, func(a, b notificationRoute) bool {
+		return a.notifier == b.notifier && slices.Equal(a.searches, b.searches)
+	}) {
+		t.Errorf("notificationRoutes = %+v, want %+v", routes, want)
+	}
+	if routes := notificationRoutes(nil); len(routes) != 1 || routes[0].notifier != defaultNotifierName {
+		t.Errorf("notificationRoutes without a matching search = %+v, want just the default", routes)
+	}
+}
+
+// A listing two searches match reaches ntfy and the structured webhook once
+// each, both naming the two searches
+func TestMatchedListingReachesEveryNotifierOnce(t *testing.T) {
+	var mu sync.Mutex
+	var posted []Notification
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n Notification
+		json.NewDecoder(r.Body).Decode(&n)
+		mu.Lock()
+		posted = append(posted, n)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	db := newTestDB(t)
+	ntfy := &recordingNotifier{}
+	cfg := testCycleConfig(t, ntfy)
+	cfg.Notifiers["webhook"] = webhookNotifier{url: webhook.URL}
+	maxPrice := 100
+	cfg.Searches = []SavedSearch{
+		{Name: "couches", Keywords: []string{"couch"}, Notifiers: []string{defaultNotifierName, "webhook"}},
+		{Name: "cheap", MaxPrice: &maxPrice, Notifiers: []string{"webhook", defaultNotifierName}},
+	}
+	if err := validateSearches(cfg.Searches, cfg.Sites, nil, cfg.Notifiers); err != nil {
+		t.Fatalf("validateSearches: %v", err)
+	}
+	state := &cycleState{
+		browserCtx: context.Background(),
+		newScraper: func(cfg Config, searchURL string) Scraper {
+			return fakeScraper{cfg, []Listing{
+				fakeListing("Small couch", "$60", "301"),
+				fakeListing("Bookshelf", "$300", "302"),
+				fakeListing("Dresser", "$250", "303"),
+			}}
+		},
+	}
+	if err := doCycle(context.Background(), cfg, db, state); err != nil {
+		t.Fatalf("doCycle: %v", err)
+	}
+
+	if len(ntfy.sent) != 1 || len(posted) != 1 {
+		t.Fatalf("ntfy got %d notifications and the webhook %d, want 1 each", len(ntfy.sent), len(posted))
+	}
+	for name, n := range map[string]Notification{"ntfy": ntfy.sent[0], "webhook": posted[0]} {
+		if n.Listing.PostID != "301" || n.Search != "couches, cheap" || n.Message != ntfy.sent[0].Message {
+			t.Errorf("%s got listing %s for %q: %q", name, n.Listing.PostID, n.Search, n.Message)
+		}
+	}
+}
+
+// Webhook URLs and the Telegram bot token never show up in a send error
+func TestNotifyErrorsRedactSecrets(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	addr := srv.Listener.Addr().String()
+	srv.Close() // so every request fails to connect
+
+	n := markupNotification()
+	for name, tc := range map[string]struct {
+		notifier Notifier
+		secret   string
+		host     string
+	}{
+		"discord":  {discordNotifier{webhookURL: "http://" + addr + "/api/webhooks/123/s3cret-discord"}, "s3cret-discord", addr},
+		"slack":    {slackNotifier{webhookURL: "http://" + addr + "/services/T0/B0/s3cret-slack"}, "s3cret-slack", addr},
+		"telegram": {telegramNotifier{token: "123:s3cret-telegram\x7f", chatID: "42"}, "s3cret-telegram", "the notifier"},
+	} {
+		err := tc.notifier.Notify(context.Background(), n)
+		if err == nil {
+			t.Fatalf("%s: sending to a closed server succeeded", name)
+		}
+		if msg := err.Error(); strings.Contains(msg, tc.secret) || !strings.Contains(msg, tc.host) {
+			t.Errorf("%s: error %q, want it to name %s without the secret", name, msg, tc.host)
+		}
+	}
+}
+
+// Notifier secrets left out of the -config file come from the environment
+func TestNotifierEnv(t *testing.T) {
+	t.Setenv("CRAIGSLIST_NOTIFIER_DEALS_URL", "https://discord.com/api/webhooks/1/from-env")
+	t.Setenv("CRAIGSLIST_NOTIFIER_FREE_STUFF_TOKEN", "123:from-env")
+	t.Setenv("CRAIGSLIST_NOTIFIER_SLACK_URL", "https://hooks.slack.com/services/from-env")
+
+	notifiers := map[string]Notifier{}
+	err := addNotifiers(notifiers, []NotifierConfig{
+		{Name: "deals", Type: "discord"},
+		{Name: "free-stuff", Type: "telegram", ChatID: "42"},
+		{Name: "slack", Type: "slack", URL: "https://hooks.slack.com/services/from-file"},
+	})
+	if err != nil {
+		t.Fatalf("addNotifiers: %v", err)
+	}
+	if got := notifiers["deals"]; got != (discordNotifier{webhookURL: "https://discord.com/api/webhooks/1/from-env"}) {
+		t.Errorf("deals = %#v", got)
+	}
+	if got := notifiers["free-stuff"]; got != (telegramNotifier{token: "123:from-env", chatID: "42"}) {
+		t.Errorf("free-stuff = %#v", got)
+	}
+	// What the file gives wins
+	if got := notifiers["slack"]; got != (slackNotifier{webhookURL: "https://hooks.slack.com/services/from-file"}) {
+		t.Errorf("slack = %#v", got)
+	}
+
+	// Without either, the notifier is still incomplete
+	if err := addNotifiers(map[string]Notifier{}, []NotifierConfig{{Name: "other", Type: "discord"}}); err == nil {
+		t.Error("addNotifiers accepted a discord notifier with no url anywhere")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Where a site's partition lives with -partition-by-city: next to dbPath and
+// named after it, e.g. ./craigslist-sfbay.db for ./craigslist.db. DSN
+// parameters on dbPath aren't carried over.
+func partitionPath(dbPath, site string) string {
+	path, _, _ := strings.Cut(dbPath, "?")
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + site + ext
+}
+
+// Open a partition for every site cfg searches when -partition-by-city is
+// set, moving each site's listings over from db first. Returns nil when
+// partitioning is off or db is in memory.
+func openPartitions(ctx context.Context, cfg Config, db *sql.DB) (map[string]*sql.DB, error) {
+	if !cfg.Partition || cfg.DBPath == ":memory:" {
+		return nil, nil
+	}
+
+	partitions := make(map[string]*sql.DB)
+	for _, site := range searchSites(cfg) {
+		path := partitionPath(cfg.DBPath, site)
+		part, err := initDB(ctx, path, cfg.SQLiteSync)
+		if err != nil {
+			closePartitions(partitions)
+			return nil, fmt.Errorf("partition %s: %v", path, err)
+		}
+		partitions[site] = part
+
+		moved, err := moveToPartition(ctx, db, path, site)
+		if err != nil {
+			closePartitions(partitions)
+			return nil, fmt.Errorf("failed to move %s listings to %s: %v", site, path, err)
+		}
+		if moved > 0 {
+			fmt.Printf("Moved %d %s listings to %s\n", moved, site, path)
+		}
+	}
+	return partitions, nil
+}
+
+func closePartitions(partitions map[string]*sql.DB) {
+	for _, part := range partitions {
+		part.Close()
+	}
+}
+
+// Move a site's listings, with their images, attributes, and fingerprints,
+// out of db and into the partition at path. Rows stored before the site was
+// recorded are matched by their URL's host. This is the migration from a
+// single database, and a no-op once it has run.
+func moveToPartition(ctx context.Context, db *sql.DB, path, site string) (int64, error) {
+	// ATTACH applies to one connection, so hold on to one
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS part;`, path); err != nil {
+		return 0, err
+	}
+	defer conn.ExecContext(context.Background(), `DETACH DATABASE part;`)
+
+	// The columns both have but id, so the list follows the migrations in
+	// initDB and skips any left behind by older versions
+	mainColumns, err := tableColumns(ctx, conn, "main")
+	if err != nil {
+		return 0, err
+	}
+	partColumns, err := tableColumns(ctx, conn, "part")
+	if err != nil {
+		return 0, err
+	}
+	var columns []string
+	for _, column := range mainColumns {
+		if column != "id" && slices.Contains(partColumns, column) {
+			columns = append(columns, column)
+		}
+	}
+	columnList := strings.Join(columns, ", ")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The IDs of the site's listings in db
+	siteListings := `SELECT id FROM main.listings WHERE site = ? OR (site IS NULL AND listing_url LIKE ?)`
+	urlPattern := "https://" + site + ".craigslist.org/%"
+
+	result, err := tx.ExecContext(ctx, `
+	INSERT OR IGNORE INTO part.listings (`+columnList+`)
+	SELECT `+columnList+` FROM main.listings WHERE id IN (`+siteListings+`);
+	`, site, urlPattern)
+	if err != nil {
+		return 0, err
+	}
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	statements := []string{
+		`UPDATE part.listings SET site = ? WHERE site IS NULL;`,
+		// Listings already in the partition keep the images and attributes they have
+		`INSERT INTO part.images (listing_id, url, stored_path)
+		SELECT p.id, i.url, i.stored_path
+		FROM main.images i
+		JOIN main.listings m ON m.id = i.listing_id
+		JOIN part.listings p ON p.listing_url = m.listing_url
+		WHERE m.id IN (` + siteListings + `)
+		AND NOT EXISTS (SELECT 1 FROM part.images pi WHERE pi.listing_id = p.id)
+		ORDER BY i.rowid;`,
+		`INSERT OR IGNORE INTO part.attributes (listing_id, key, value)
+		SELECT p.id, a.key, a.value
+		FROM main.attributes a
+		JOIN main.listings m ON m.id = a.listing_id
+		JOIN part.listings p ON p.listing_url = m.listing_url
+		WHERE m.id IN (` + siteListings + `);`,
+		`INSERT OR IGNORE INTO part.fingerprints SELECT fingerprint, listing_url, seen_at FROM main.fingerprints WHERE listing_url LIKE ?;`,
+		`INSERT OR IGNORE INTO part.notified_fingerprints SELECT fingerprint, listing_url, notified_at FROM main.notified_fingerprints WHERE listing_url LIKE ?;`,
+		`DELETE FROM main.fingerprints WHERE listing_url LIKE ?;`,
+		`DELETE FROM main.notified_fingerprints WHERE listing_url LIKE ?;`,
+		// Images and attributes go with their listings
+		`DELETE FROM main.listings WHERE id IN (` + siteListings + `);`,
+	}
+	args := [][]any{
+		{site},
+		{site, urlPattern},
+		{site, urlPattern},
+		{urlPattern},
+		{urlPattern},
+		{urlPattern},
+		{urlPattern},
+		{site, urlPattern},
+	}
+	for i, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement, args[i]...); err != nil {
+			return 0, err
+		}
+	}
+	return moved, tx.Commit()
+}
+
+// The names of the columns of schema's listings table
+func tableColumns(ctx context.Context, conn *sql.Conn, schema string) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("PRAGMA %s.table_info(listings);", schema))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// The database a site's listings are stored in: its partition, or db for a
+// site without one, e.g. one added by a config reload
+func partitionFor(db *sql.DB, partitions map[string]*sql.DB, site string) *sql.DB {
+	if part, ok := partitions[site]; ok {
+		return part
+	}
+	return db
+}
+
+// Every database listings may be stored in: db, then the partitions by site
+func partitionDBs(db *sql.DB, partitions map[string]*sql.DB) []*sql.DB {
+	dbs := []*sql.DB{db}
+	for _, site := range slices.Sorted(maps.Keys(partitions)) {
+		dbs = append(dbs, partitions[site])
+	}
+	return dbs
+}
+
+// Some of a cycle's listings, and the database they're stored in
+type listingPartition struct {
+	db       *sql.DB
+	listings []Listing
+}
+
+// Split a cycle's listings by the database they belong in. Every database
+// gets a group, even an empty one, so each is cleaned up every cycle.
+func partitionListings(listings []Listing, db *sql.DB, partitions map[string]*sql.DB) []listingPartition {
+	dbs := partitionDBs(db, partitions)
+	groups := make([]listingPartition, len(dbs))
+	index := make(map[*sql.DB]int, len(dbs))
+	for i, partDB := range dbs {
+		groups[i].db = partDB
+		index[partDB] = i
+	}
+	for _, listing := range listings {
+		i := index[partitionFor(db, partitions, listing.Site)]
+		groups[i].listings = append(groups[i].listings, listing)
+	}
+	return groups
+}
+
+// Fetch a page of listings across every database, like queryListings does
+// for one. Each database is asked for everything up to the end of the page,
+// and the results are merged in the requested order.
+func queryPartitions(ctx context.Context, dbs []*sql.DB, q listingQuery) ([]Listing, int, error) {
+	if len(dbs) == 1 {
+		return queryListings(ctx, dbs[0], q)
+	}
+
+	partQuery := q
+	partQuery.Limit = q.Offset + q.Limit
+	partQuery.Offset = 0
+	listings := []Listing{}
+	total := 0
+	for _, db := range dbs {
+		found, n, err := queryListings(ctx, db, partQuery)
+		if err != nil {
+			return nil, 0, err
+		}
+		listings = append(listings, found...)
+		total += n
+	}
+
+	slices.SortStableFunc(listings, func(a, b Listing) int {
+		var c int
+		switch q.Sort {
+		case "price":
+			// Unknown prices sort last whichever the direction
+			switch {
+			case a.PriceCents == nil && b.PriceCents == nil:
+				return 0
+			case a.PriceCents == nil:
+				return 1
+			case b.PriceCents == nil:
+				return -1
+			}
+			c = cmp.Compare(*a.PriceCents, *b.PriceCents)
+		case "updated":
+			c = a.recency(recencyUpdated).Compare(b.recency(recencyUpdated))
+		default:
+			c = a.Posted.Compare(b.Posted)
+		}
+		if q.Desc {
+			return -c
+		}
+		return c
+	})
+
+	if q.Offset >= len(listings) {
+		return []Listing{}, total, nil
+	}
+	return listings[q.Offset:min(len(listings), q.Offset+q.Limit)], total, nil
+}
+
+// Look up one listing by post ID in whichever database has it. Returns
+// sql.ErrNoRows if none does.
+func getPartitionedListing(ctx context.Context, dbs []*sql.DB, postID string) (Listing, error) {
+	for _, db := range dbs {
+		listing, err := getListingByPostID(ctx, db, postID)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return listing, err
+		}
+	}
+	return Listing{}, sql.ErrNoRows
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A category's median needs this many prices before listings are compared
+// against it
+const priceStatsMinSamples = 20
+
+// Each category keeps only its most recent prices, this many of them, so its
+// median follows prices as they drift rather than covering all time
+const priceStatsWindow = 500
+
+// The typical price for one category, over its most recent prices. The
+// median is what listings are compared against, since a few wildly priced
+// listings drag the mean around; the mean is kept alongside it for reference.
+type priceStat struct {
+	avg     float64
+	median  float64
+	samples int
+}
+
+// Load the price stats of every category. Categories last updated before
+// medians were kept fall back to their mean until their next update.
+func loadPriceStats(ctx context.Context, db *sql.DB) (map[string]priceStat, error) {
+	selectQuery := `
+	SELECT category, avg_price, COALESCE(median_price, avg_price), samples FROM price_stats;
+	`
+	rows, err := db.QueryContext(ctx, selectQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make(map[string]priceStat)
+	for rows.Next() {
+		var category string
+		var stat priceStat
+		if err := rows.Scan(&category, &stat.avg, &stat.median, &stat.samples); err != nil {
+			return nil, err
+		}
+		stats[category] = stat
+	}
+	return stats, rows.Err()
+}
+
+// Add a cycle's prices to each category's sample, dropping the oldest beyond
+// priceStatsWindow, and recompute its mean and median from what's left
+func updatePriceStats(ctx context.Context, db *sql.DB, stats map[string]priceStat, prices map[string][]int) error {
+	for category, cyclePrices := range prices {
+		stat, err := updateCategoryStats(ctx, db, category, cyclePrices)
+		if err != nil {
+			return err
+		}
+		stats[category] = stat
+	}
+	return nil
+}
+
+func updateCategoryStats(ctx context.Context, db *sql.DB, category string, cyclePrices []int) (priceStat, error) {
+	var stat priceStat
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return stat, err
+	}
+	defer tx.Rollback()
+
+	insertQuery := `
+	INSERT INTO price_samples (category, price, seen_at) VALUES (?, ?, ?);
+	`
+	for _, price := range cyclePrices {
+		if _, err := tx.ExecContext(ctx, insertQuery, category, price, time.Now()); err != nil {
+			return stat, err
+		}
+	}
+	trimQuery := `
+	DELETE FROM price_samples
+	WHERE category = ? AND rowid NOT IN (
+		SELECT rowid FROM price_samples WHERE category = ? ORDER BY rowid DESC LIMIT ?
+	);
+	`
+	if _, err := tx.ExecContext(ctx, trimQuery, category, category, priceStatsWindow); err != nil {
+		return stat, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT price FROM price_samples WHERE category = ? ORDER BY price;`, category)
+	if err != nil {
+		return stat, err
+	}
+	var sample []int
+	for rows.Next() {
+		var price int
+		if err := rows.Scan(&price); err != nil {
+			rows.Close()
+			return stat, err
+		}
+		sample = append(sample, price)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return stat, err
+	}
+	if len(sample) == 0 {
+		return stat, nil
+	}
+
+	sum := 0
+	for _, price := range sample {
+		sum += price
+	}
+	stat = priceStat{avg: float64(sum) / float64(len(sample)), median: median(sample), samples: len(sample)}
+
+	upsertQuery := `
+	INSERT INTO price_stats (category, avg_price, median_price, samples, updated_at)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT(category) DO UPDATE SET avg_price = excluded.avg_price, median_price = excluded.median_price, samples = excluded.samples, updated_at = excluded.updated_at;
+	`
+	if _, err := tx.ExecContext(ctx, upsertQuery, category, stat.avg, stat.median, stat.samples, time.Now()); err != nil {
+		return stat, err
+	}
+	return stat, tx.Commit()
+}
+
+// The median of a sorted, non-empty sample
+func median(sorted []int) float64 {
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return float64(sorted[mid])
+	}
+	return float64(sorted[mid-1]+sorted[mid]) / 2
+}
+
+// Report whether price is more than pct percent under the category's median,
+// once the category has enough samples to go on
+func belowMedian(stats map[string]priceStat, category string, price, pct int) bool {
+	stat, ok := stats[category]
+	if !ok || stat.samples < priceStatsMinSamples {
+		return false
+	}
+	return float64(price) < stat.median*float64(100-pct)/100
+}
+
+// Report whether a listing looks like a scam: priced under thresholdPct
+// percent of its category's median, or under twice that with a generic title
+// of a word or two, like "car" for $1. Free and unpriced listings never do.
+func isSuspectedScam(l Listing, median, thresholdPct int) bool {
+	price, ok := parsePrice(l.Price)
+	if !ok || price == 0 || median <= 0 {
+		return false
+	}
+	limit := median * thresholdPct
+	if genericTitle(l.Title) {
+		limit *= 2
+	}
+	return price*100 < limit
+}
+
+// Report whether a title is too vague to say what's for sale
+func genericTitle(title string) bool {
+	words := strings.FieldsFunc(title, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return len(words) < 3
+}
+
+// The category a listing's price is compared within: its section when the
+// URL has one, e.g. "fuo" for furniture, or else the searched category, on
+// the site it was found on, e.g. "fuo/sfbay"
+func priceCategory(cfg Config, listing Listing) string {
+	category := cfg.Category
+	if listing.Section != "" {
+		category = listing.Section
+	}
+	if listing.Site != "" {
+		category += "/" + listing.Site
+	}
+	return category
+}
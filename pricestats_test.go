@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestIsSuspectedScam(t *testing.T) {
+	// Against a $10,000 median with -scam-threshold 10: under $1,000 is
+	// suspect, or under $2,000 with a generic title
+	const median, threshold = 10000, 10
+	for _, tc := range []struct {
+		title, price string
+		scam         bool
+	}{
+		{"2012 Honda Civic LX sedan", "$1", true},
+		{"2012 Honda Civic LX sedan", "$999", true},
+		{"2012 Honda Civic LX sedan", "$1,000", false},
+		{"2012 Honda Civic LX sedan", "$1,500", false},
+		{"Car", "$1,500", true},
+		{"Honda - Civic!", "$1,999", true},
+		{"Honda - Civic!", "$2,000", false},
+		{"Car", "$9,000", false},
+		{"Car", "free", false},
+		{"Car", "$0", false},
+		{"Car", "", false},
+		{"Car", "call for price", false},
+	} {
+		l := Listing{Title: tc.title, Price: tc.price}
+		if got := isSuspectedScam(l, median, threshold); got != tc.scam {
+			t.Errorf("isSuspectedScam(%q, %s) = %v, want %v", tc.title, tc.price, got, tc.scam)
+		}
+	}
+
+	// Without a median to compare with, nothing is suspect
+	if isSuspectedScam(Listing{Title: "Car", Price: "$1"}, 0, threshold) {
+		t.Error("isSuspectedScam without a median = true")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// The proxy schemes -proxy accepts; Chrome and Go's HTTP client both speak all
+// of them. With socks5, hostnames are resolved by the proxy rather than
+// locally, so running Tor and passing -proxy socks5://127.0.0.1:9050 keeps
+// both the lookups and the page loads off this machine's own address.
+var proxySchemes = []string{"http", "https", "socks5"}
+
+// Loads search pages for the http engine, bounded by -wait-timeout per page
+var scrapeClient = &http.Client{CheckRedirect: checkCraigslistRedirect}
+
+// Parse and check a -proxy URL such as socks5://127.0.0.1:9050
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(proxySchemes, u.Scheme) {
+		return nil, fmt.Errorf("scheme must be one of %s", strings.Join(proxySchemes, ", "))
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, fmt.Errorf("must include a host and port")
+	}
+	// Chrome's --proxy-server has nowhere to put them
+	if u.User != nil {
+		return nil, fmt.Errorf("credentials aren't supported")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("must not have a path")
+	}
+	return u, nil
+}
+
+// Send every request the bot makes through proxy: the http engine's page
+// loads, the redirect checks, image downloads and uploads, and notifications.
+// Chrome gets it as --proxy-server in chromeAllocatorOptions.
+func useProxy(proxy *url.URL) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxy)
+	for _, client := range []*http.Client{scrapeClient, redirectClient, imageClient, uploadClient, notifyClient} {
+		client.Transport = transport
+	}
+}
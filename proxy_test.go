@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestParseProxy(t *testing.T) {
+	for s, ok := range map[string]bool{
+		"socks5://127.0.0.1:9050":     true,
+		"http://proxy.example:3128":   true,
+		"https://proxy.example:443/":  true,
+		"ftp://proxy.example:21":      false,
+		"socks5://127.0.0.1":          false,
+		"http://user:pw@proxy:3128":   false,
+		"http://proxy.example:3128/x": false,
+	} {
+		if _, err := parseProxy(s); (err == nil) != ok {
+			t.Errorf("parseProxy(%q) = %v, want ok %v", s, err, ok)
+		}
+	}
+}
+
+// Every client goes through -proxy, not just the page loads
+func TestUseProxyCoversEveryClient(t *testing.T) {
+	var mu sync.Mutex
+	proxied := make(map[string]bool)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied[r.Host] = true
+		mu.Unlock()
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("jpeg"))
+	}))
+	defer proxy.Close()
+
+	clients := []*http.Client{scrapeClient, redirectClient, imageClient, uploadClient, notifyClient}
+	saved := make([]http.RoundTripper, len(clients))
+	for i, client := range clients {
+		saved[i] = client.Transport
+	}
+	t.Cleanup(func() {
+		for i, client := range clients {
+			client.Transport = saved[i]
+		}
+	})
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useProxy(proxyURL)
+
+	if _, _, err := downloadImage(context.Background(), "http://images.craigslist.org/00a0a_abc_600x450.jpg"); err != nil {
+		t.Fatalf("downloadImage: %v", err)
+	}
+	resp, err := notifyClient.Get("http://ntfy.example/topic")
+	if err != nil {
+		t.Fatalf("notifyClient: %v", err)
+	}
+	resp.Body.Close()
+
+	for _, host := range []string{"images.craigslist.org", "ntfy.example"} {
+		if !proxied[host] {
+			t.Errorf("request to %s didn't go through the proxy", host)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The most listings a quiet-hours digest lists; the rest are only counted
+const quietDigestMax = 50
+
+// A daily window, in minutes after midnight, during which nothing is sent.
+// The window crosses midnight when end is before start, as in 22:00-07:00.
+type quietHours struct {
+	start, end int
+}
+
+// Parse a -quiet-hours window such as "22:00-07:00"
+func parseQuietHours(s string) (*quietHours, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("must be a range like 22:00-07:00")
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return nil, fmt.Errorf("invalid start %q: must be HH:MM", from)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return nil, fmt.Errorf("invalid end %q: must be HH:MM", to)
+	}
+	q := &quietHours{start: start.Hour()*60 + start.Minute(), end: end.Hour()*60 + end.Minute()}
+	if q.start == q.end {
+		return nil, fmt.Errorf("start and end are the same")
+	}
+	return q, nil
+}
+
+// Report whether t's time of day falls in the window; the start is inside
+// it and the end isn't
+func (q *quietHours) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if q.start < q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// Report whether it's quiet hours now, in the -display-tz zone
+func (cfg Config) quietNow() bool {
+	return cfg.QuietHours != nil && cfg.QuietHours.contains(time.Now().In(cfg.DisplayTZ))
+}
+
+// Hold a message back for the digest sent via notifier once quiet hours end
+func (state *cycleState) holdForDigest(notifier, message string) {
+	if state.digest == nil {
+		state.digest = make(map[string][]string)
+	}
+	state.digest[notifier] = append(state.digest[notifier], message)
+}
+
+// Send each notifier one message listing what was held back during quiet
+// hours, then forget it. Returns how many notifiers it was sent or queued for.
+func sendDigest(ctx context.Context, cfg Config, state *cycleState) int {
+	sent := 0
+	for notifier, messages := range state.digest {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%d new listings during quiet hours:", len(messages))
+		for _, message := range messages[:min(len(messages), quietDigestMax)] {
+			sb.WriteString("\n- " + message)
+		}
+		if len(messages) > quietDigestMax {
+			fmt.Fprintf(&sb, "\n...and %d more", len(messages)-quietDigestMax)
+		}
+		sent += sendOrQueue(ctx, cfg.Notifiers, state.notifyQueue, []string{notifier}, Notification{Message: sb.String()})
+	}
+	state.digest = nil
+	return sent
+}
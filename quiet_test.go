@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietHoursContains(t *testing.T) {
+	for _, tc := range []struct {
+		window string
+		clock  string
+		quiet  bool
+	}{
+		// Crossing midnight
+		{"22:00-07:00", "21:59", false},
+		{"22:00-07:00", "22:00", true},
+		{"22:00-07:00", "23:59", true},
+		{"22:00-07:00", "00:00", true},
+		{"22:00-07:00", "03:00", true},
+		{"22:00-07:00", "06:59", true},
+		{"22:00-07:00", "07:00", false},
+		{"22:00-07:00", "12:00", false},
+		{"23:30-00:15", "00:10", true},
+		{"23:30-00:15", "00:15", false},
+		// Within a day
+		{"13:00-14:30", "12:59", false},
+		{"13:00-14:30", "13:00", true},
+		{"13:00-14:30", "14:29", true},
+		{"13:00-14:30", "14:30", false},
+	} {
+		q, err := parseQuietHours(tc.window)
+		if err != nil {
+			t.Fatalf("parseQuietHours(%q): %v", tc.window, err)
+		}
+		clock, err := time.Parse("15:04", tc.clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := time.Date(2024, 10, 14, clock.Hour(), clock.Minute(), 0, 0, time.UTC)
+		if got := q.contains(at); got != tc.quiet {
+			t.Errorf("%s contains %s = %v, want %v", tc.window, tc.clock, got, tc.quiet)
+		}
+	}
+}
+
+func TestParseQuietHoursErrors(t *testing.T) {
+	for _, window := range []string{"", "22:00", "22:00-", "10pm-7am", "25:00-07:00", "07:00-07:00"} {
+		if _, err := parseQuietHours(window); err == nil {
+			t.Errorf("parseQuietHours(%q) succeeded, want an error", window)
+		}
+	}
+}
+
+// The window is in -display-tz: 23:00 in New York is quiet even though it's
+// 03:00 or 04:00 the next day in UTC
+func TestQuietHoursInDisplayTZ(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	q, err := parseQuietHours("22:00-07:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 10, 15, 3, 0, 0, 0, time.UTC)
+	if !q.contains(at.In(newYork)) {
+		t.Error("23:00 in New York isn't quiet")
+	}
+	if !q.contains(at) {
+		t.Error("03:00 UTC isn't quiet")
+	}
+	if at := time.Date(2024, 10, 14, 23, 0, 0, 0, time.UTC); q.contains(at.In(newYork)) {
+		t.Error("19:00 in New York is quiet")
+	}
+}
+
+func TestSendDigest(t *testing.T) {
+	var sent []string
+	cfg := Config{Notifiers: map[string]Notifier{"ntfy": testNotifier{url: "https://ntfy.example/digest", sent: &sent}}}
+	state := &cycleState{}
+	for i := 0; i < quietDigestMax+2; i++ {
+		state.holdForDigest("ntfy", "Free chair")
+	}
+	if n := sendDigest(context.Background(), cfg, state); n != 1 {
+		t.Errorf("sendDigest sent %d, want 1", n)
+	}
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "52 new listings during quiet hours:\n- Free chair") || !strings.HasSuffix(sent[0], "...and 2 more") {
+		t.Errorf("digest %q", sent)
+	}
+	if state.digest != nil {
+		t.Error("digest kept after sending")
+	}
+}
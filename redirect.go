@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// How many hops a redirect chain may take before we give up on it
+const maxRedirects = 5
+
+// Follows redirects for resolveListingURL, refusing overly long chains and
+// any hop off Craigslist
+var redirectClient = &http.Client{
+	Timeout:       15 * time.Second,
+	CheckRedirect: checkCraigslistRedirect,
+}
+
+// The CheckRedirect of every client that fetches from Craigslist. Checking
+// only the first URL isn't enough, since a Craigslist page could redirect
+// anywhere.
+func checkCraigslistRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if !isCraigslistURL(req.URL.String()) {
+		return fmt.Errorf("refusing to follow redirect to non-Craigslist URL %s", req.URL)
+	}
+	return nil
+}
+
+// Query parameters that redirect/tracking links carry their destination in
+var redirectParams = []string{"url", "u", "target", "dest"}
+
+// Resolve a result link to the canonical posting URL. Links that already look
+// like postings are returned as-is. Otherwise the destination is taken from a
+// redirect query parameter if present, or found by following the redirect
+// chain with a HEAD request. Only Craigslist links are followed or accepted as
+// destinations.
+func resolveListingURL(ctx context.Context, link string) (string, error) {
+	if parsePostID(link) != "" {
+		return link, nil
+	}
+	if !isCraigslistURL(link) {
+		return "", errors.New("refusing to fetch non-Craigslist URL")
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	for _, param := range redirectParams {
+		if target := u.Query().Get(param); target != "" && parsePostID(target) != "" && isCraigslistURL(target) {
+			return target, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", link, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := redirectClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	resolved := resp.Request.URL.String()
+	if parsePostID(resolved) == "" {
+		return "", errors.New("redirect did not lead to a posting")
+	}
+	return resolved, nil
+}
+
+// Replace redirect links in scraped listings with their canonical posting
+// URLs, so deduplication by URL is reliable. Listings whose links can't be
+// resolved keep the original link.
+func resolveListingURLs(ctx context.Context, listings []Listing) {
+	for i := range listings {
+		resolved, err := resolveListingURL(ctx, listings[i].ListingURL)
+		if err != nil {
+			fmt.Printf("Failed to resolve %s: %v\n", listings[i].ListingURL, err)
+			continue
+		}
+		if resolved == listings[i].ListingURL {
+			continue
+		}
+		listings[i].ListingURL = resolved
+		listings[i].PostID = parsePostID(resolved)
+		listings[i].Section = parseSection(resolved)
+	}
+}
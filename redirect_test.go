@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckCraigslistRedirect(t *testing.T) {
+	for _, tc := range []struct {
+		url  string
+		hops int
+		ok   bool
+	}{
+		{"https://images.craigslist.org/00a0a_abc_600x450.jpg", 1, true},
+		{"https://sfbay.craigslist.org/fuo/d/couch/7781234567.html", 1, true},
+		{"http://169.254.169.254/latest/meta-data/", 1, false},
+		{"https://craigslist.org.example.com/", 1, false},
+		{"https://sfbay.craigslist.org/", maxRedirects, false},
+	} {
+		req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		via := make([]*http.Request, tc.hops)
+		if err := checkCraigslistRedirect(req, via); (err == nil) != tc.ok {
+			t.Errorf("checkCraigslistRedirect(%s, %d hops) = %v, want ok %v", tc.url, tc.hops, err, tc.ok)
+		}
+	}
+}
+
+// A redirect off Craigslist is refused before the client follows it
+func TestClientsRefuseOffsiteRedirects(t *testing.T) {
+	fetched := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = true
+	}))
+	defer target.Close()
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	for name, client := range map[string]*http.Client{"imageClient": imageClient, "scrapeClient": scrapeClient, "redirectClient": redirectClient} {
+		resp, err := client.Get(redirector.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), "non-Craigslist") {
+			t.Errorf("%s followed an offsite redirect: %v", name, err)
+		}
+	}
+	if fetched {
+		t.Error("the redirect target was fetched")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Named groups of related Craigslist sites, selectable with -region. More can
+// be defined under "regions" in the -config file.
+var regionPresets = map[string][]string{
+	"nc-triad":  {"greensboro", "winstonsalem"},
+	"nc":        {"charlotte", "raleigh", "greensboro", "winstonsalem", "asheville", "wilmington", "fayetteville", "hickory", "boone", "outerbanks", "eastnc", "onslow"},
+	"carolinas": {"charlotte", "raleigh", "greensboro", "winstonsalem", "asheville", "wilmington", "greenville", "columbia", "charleston", "myrtlebeach"},
+	"socal":     {"losangeles", "orangecounty", "inlandempire", "sandiego", "ventura"},
+	"nyc-metro": {"newyork", "longisland", "newjersey"},
+}
+
+// The preset names, sorted, for help and error messages
+func regionNames(regions map[string][]string) string {
+	return strings.Join(slices.Sorted(maps.Keys(regions)), ", ")
+}
+
+// Set cfg.Sites from -region, or to just -city without one
+func resolveRegion(cfg *Config, regions map[string][]string) error {
+	if cfg.Region == "" {
+		cfg.Sites = []string{cfg.City}
+		return nil
+	}
+	sites, ok := regions[cfg.Region]
+	if !ok {
+		return fmt.Errorf("invalid -region %q: must be one of %s", cfg.Region, regionNames(regions))
+	}
+	cfg.Sites = sites
+	return nil
+}
+
+// Merge the -config file's regions over the presets
+func mergeRegions(custom map[string][]string) (map[string][]string, error) {
+	regions := maps.Clone(regionPresets)
+	for name, sites := range custom {
+		if len(sites) == 0 {
+			return nil, fmt.Errorf("region %q has no sites", name)
+		}
+		regions[name] = sites
+	}
+	return regions, nil
+}
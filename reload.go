@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Reload the config each time a signal arrives on hup, until ctx is done. The
+// -config file is applied again on top of the original flags, and each
+// monitor picks up its new config at the start of its next cycle, so a cycle
+// already running finishes with the old one. A config that fails to load is
+// reported and the current one kept.
+func reloadOnSignal(ctx context.Context, hup <-chan os.Signal, flagCfg Config, monitors []monitor) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		if flagCfg.ConfigPath == "" {
+			fmt.Println("No -config file to reload")
+			continue
+		}
+		cfg, err := loadConfig(flagCfg)
+		if err != nil {
+			fmt.Printf("Failed to reload config, keeping the current one: %v\n", err)
+			continue
+		}
+		applyConfig(cfg, monitors)
+		fmt.Printf("Reloaded config from %s\n", cfg.ConfigPath)
+	}
+}
+
+// Hand each running monitor its part of a freshly loaded config. Monitors run
+// against the database they opened at startup, so adding or removing
+// profiles, or moving one to another database, takes a restart.
+func applyConfig(cfg Config, monitors []monitor) {
+	profiles := make(map[string]Config)
+	for _, profile := range cfg.Profiles {
+		profiles[profile.Name] = profile
+	}
+
+	for _, m := range monitors {
+		if m.name == "" {
+			m.config.Store(&cfg)
+			continue
+		}
+		profile, ok := profiles[m.name]
+		if !ok {
+			fmt.Printf("Profile %s is no longer in the config; it keeps its old settings until a restart\n", m.name)
+			continue
+		}
+		delete(profiles, m.name)
+		if current := m.config.Load(); profile.DBPath != current.DBPath {
+			fmt.Printf("Profile %s keeps using %s until a restart\n", m.name, current.DBPath)
+			profile.DBPath = current.DBPath
+		}
+		m.config.Store(&profile)
+	}
+
+	for name := range profiles {
+		fmt.Printf("Profile %s is new and starts after a restart\n", name)
+	}
+}
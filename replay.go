@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Run a saved page (e.g. from -dump-html-dir) through the parser for -replay,
+// printing what it extracts, so selector fixes can be tried without scraping.
+// The page is parsed with the -engine's selectors and -category.
+func replayDump(cfg Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read -replay file: %v", err)
+	}
+	htmlContent := string(data)
+	if isBlockedPage(htmlContent) {
+		fmt.Println("Warning: this looks like Craigslist's block page, not search results")
+	}
+
+	sel := cfg.Selectors
+	if cfg.Engine == engineHTTP {
+		sel = cfg.StaticSelectors
+	}
+	listings, err := parseSearchPage(cfg.Category, sel, path, htmlContent)
+	if err != nil {
+		return err
+	}
+
+	for i, listing := range listings {
+		fmt.Printf("%d. %s\n", i+1, listing.Title)
+		fmt.Printf("   price %q, city %q, section %q, post %s\n", listing.Price, listing.City, listing.Section, listing.PostID)
+		fmt.Printf("   %s\n", listing.ListingURL)
+		if err := listing.Valid(); err != nil {
+			fmt.Printf("   Warning: would be skipped: %v\n", err)
+		}
+	}
+	fmt.Printf("Parsed %d listings from %s with result selector %q\n", len(listings), path, sel.Result)
+	return nil
+}
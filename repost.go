@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Compute a fingerprint that survives the small edits sellers make when
+// reposting: case, punctuation, word order, and repeated words in the title
+// are ignored, as is formatting of the price.
+func listingFingerprint(listing Listing) string {
+	words := strings.FieldsFunc(strings.ToLower(listing.Title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	sort.Strings(words)
+	unique := words[:0]
+	for i, word := range words {
+		if i == 0 || word != words[i-1] {
+			unique = append(unique, word)
+		}
+	}
+
+	price := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) || unicode.IsLetter(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, listing.Price)
+
+	sum := sha256.Sum256([]byte(strings.Join(unique, " ") + "|" + price))
+	return hex.EncodeToString(sum[:])
+}
+
+// Report whether a newly inserted listing shares its fingerprint with a
+// different listing seen within the window, and record it as the latest
+// listing for that fingerprint. Likely reposts are flagged in the database.
+func checkRepost(ctx context.Context, db *sql.DB, listing Listing, window time.Duration) (bool, error) {
+	fingerprint := listingFingerprint(listing)
+
+	var previousURL string
+	var seenAt time.Time
+	selectQuery := `
+	SELECT listing_url, seen_at FROM fingerprints
+	WHERE fingerprint = ?;
+	`
+	err := db.QueryRowContext(ctx, selectQuery, fingerprint).Scan(&previousURL, &seenAt)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	repost := err == nil && previousURL != listing.ListingURL && time.Since(seenAt) < window
+
+	upsertQuery := `
+	INSERT INTO fingerprints (fingerprint, listing_url, seen_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT(fingerprint) DO UPDATE SET listing_url = excluded.listing_url, seen_at = excluded.seen_at;
+	`
+	_, err = db.ExecContext(ctx, upsertQuery, fingerprint, listing.ListingURL, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	if repost {
+		updateQuery := `
+		UPDATE listings
+		SET likely_repost = 1
+		WHERE listing_url = ?;
+		`
+		_, err = db.ExecContext(ctx, updateQuery, listing.ListingURL)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return repost, nil
+}
+
+// Report whether a listing with the same fingerprint but a different URL was
+// notified within the window, as happens when one item is cross-posted to
+// several nearby cities
+func crosspostNotified(ctx context.Context, db *sql.DB, listing Listing, window time.Duration) (bool, error) {
+	var previousURL string
+	var notifiedAt time.Time
+	selectQuery := `
+	SELECT listing_url, notified_at FROM notified_fingerprints
+	WHERE fingerprint = ?;
+	`
+	err := db.QueryRowContext(ctx, selectQuery, listingFingerprint(listing)).Scan(&previousURL, &notifiedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return previousURL != listing.ListingURL && time.Since(notifiedAt) < window, nil
+}
+
+// Record that a listing's fingerprint was just notified, for crosspostNotified
+func markFingerprintNotified(ctx context.Context, db *sql.DB, listing Listing) error {
+	upsertQuery := `
+	INSERT INTO notified_fingerprints (fingerprint, listing_url, notified_at)
+	VALUES (?, ?, ?)
+	ON CONFLICT(fingerprint) DO UPDATE SET listing_url = excluded.listing_url, notified_at = excluded.notified_at;
+	`
+	_, err := db.ExecContext(ctx, upsertQuery, listingFingerprint(listing), listing.ListingURL, time.Now())
+	return err
+}
+
+// Report whether a stored listing was flagged as a likely repost when it was
+// first seen
+func storedRepost(ctx context.Context, db *sql.DB, listingURL string) (bool, error) {
+	selectQuery := `
+	SELECT COALESCE(likely_repost, 0) FROM listings WHERE listing_url = ?;
+	`
+	var repost bool
+	err := db.QueryRowContext(ctx, selectQuery, listingURL).Scan(&repost)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return repost, err
+}
+
+// Delete fingerprints that have aged out of the repost window
+func deleteOldFingerprints(ctx context.Context, db *sql.DB, window time.Duration) error {
+	deleteQuery := `
+	DELETE FROM fingerprints
+	WHERE seen_at < ?;
+	DELETE FROM notified_fingerprints
+	WHERE notified_at < ?;
+	`
+	cutoff := time.Now().Add(-window)
+	_, err := db.ExecContext(ctx, deleteQuery, cutoff, cutoff)
+	return err
+}
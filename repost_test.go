@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestListingFingerprint(t *testing.T) {
+	base := Listing{Title: "Mid-century walnut dresser", Price: "$400"}
+	for _, tc := range []struct {
+		title, price string
+		same         bool
+	}{
+		{"mid century WALNUT dresser!!", "$400", true},
+		{"Walnut dresser, mid century", "$400", true},
+		{"Mid-century walnut walnut dresser", "$400", true},
+		{"Mid-century walnut dresser", "$400.", true},
+		{"Mid-century walnut dresser", "$350", false},
+		{"Mid-century oak dresser", "$400", false},
+		{"Mid-century walnut dresser and mirror", "$400", false},
+	} {
+		other := Listing{Title: tc.title, Price: tc.price}
+		if same := listingFingerprint(other) == listingFingerprint(base); same != tc.same {
+			t.Errorf("fingerprint of %q %s matches %q %s: %v, want %v", tc.title, tc.price, base.Title, base.Price, same, tc.same)
+		}
+	}
+}
+
+// A repost is a different URL with the same fingerprint within the window
+func TestCheckRepost(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	original := fakeListing("Walnut dresser", "$400", "601")
+	repost := fakeListing("walnut DRESSER", "$400", "602")
+
+	for _, tc := range []struct {
+		listing Listing
+		window  time.Duration
+		want    bool
+	}{
+		{original, time.Hour, false},
+		{original, time.Hour, false}, // seen again at the same URL
+		{repost, time.Hour, true},
+		{original, 0, false}, // outside the window it's not a repost
+	} {
+		if _, err := insertListing(ctx, db, tc.listing); err != nil {
+			t.Fatal(err)
+		}
+		got, err := checkRepost(ctx, db, tc.listing, tc.window)
+		if err != nil {
+			t.Fatalf("checkRepost: %v", err)
+		}
+		if got != tc.want {
+			t.Errorf("checkRepost(%s, %v) = %v, want %v", tc.listing.PostID, tc.window, got, tc.want)
+		}
+	}
+
+	stored, err := getListingByPostID(ctx, db, "602")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.LikelyRepost {
+		t.Error("the repost wasn't flagged in the database")
+	}
+	for postID, want := range map[string]bool{"601": false, "602": true} {
+		stored, err := getListingByPostID(ctx, db, postID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := storedRepost(ctx, db, stored.ListingURL); err != nil || got != want {
+			t.Errorf("storedRepost(%s) = %v, %v; want %v", postID, got, err, want)
+		}
+	}
+
+	// Fingerprints age out with the window
+	if err := deleteOldFingerprints(ctx, db, -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM fingerprints;`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%d fingerprints left after they aged out", n)
+	}
+}
+
+// A cross-post is the same item notified from another city's URL
+func TestCrosspostNotified(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	oakland := fakeListing("Walnut dresser", "$400", "701")
+	sanJose := fakeListing("Walnut dresser", "$400", "702")
+	sanJose.ListingURL = "https://sfbay.craigslist.org/sby/fuo/d/san-jose-walnut-dresser/702.html"
+	sanJose.City = "San Jose"
+	other := fakeListing("Oak dresser", "$400", "703")
+
+	if got, err := crosspostNotified(ctx, db, sanJose, time.Hour); err != nil || got {
+		t.Fatalf("crosspostNotified before anything was notified = %v, %v", got, err)
+	}
+	if err := markFingerprintNotified(ctx, db, oakland); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		listing Listing
+		window  time.Duration
+		want    bool
+	}{
+		{sanJose, time.Hour, true},
+		{oakland, time.Hour, false}, // the notified listing itself
+		{other, time.Hour, false},
+		{sanJose, 0, false},
+	} {
+		got, err := crosspostNotified(ctx, db, tc.listing, tc.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("crosspostNotified(%s, %v) = %v, want %v", tc.listing.PostID, tc.window, got, tc.want)
+		}
+	}
+}
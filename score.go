@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ntfy priorities for listing notifications, lowest first
+const (
+	priorityMin     = "min"
+	priorityLow     = "low"
+	priorityDefault = "default"
+	priorityHigh    = "high"
+	priorityUrgent  = "urgent"
+)
+
+var priorities = []string{priorityMin, priorityLow, priorityDefault, priorityHigh, priorityUrgent}
+
+// The priority for listings in a price range, from the -config file's
+// price_priorities. Rules are checked in order and the first match wins.
+type PricePriority struct {
+	MaxPrice *int   `json:"max_price"` // in dollars, inclusive; omitted for no upper bound
+	Unknown  bool   `json:"unknown"`   // the rule is for listings with no known price instead
+	Priority string `json:"priority"`  // min, low, default, high, or urgent
+}
+
+// Used without price_priorities: free and unknown prices are the ones worth
+// dropping everything for, so they're urgent and everything else is default
+var defaultPricePriorities = []PricePriority{
+	{Unknown: true, Priority: priorityUrgent},
+	{MaxPrice: new(int), Priority: priorityUrgent},
+	{Priority: priorityDefault},
+}
+
+// Check the price_priorities rules from the -config file
+func validatePricePriorities(rules []PricePriority) error {
+	for i, rule := range rules {
+		if !slices.Contains(priorities, rule.Priority) {
+			return fmt.Errorf("price_priorities rule %d: invalid priority %q, must be one of %s", i+1, rule.Priority, strings.Join(priorities, ", "))
+		}
+		if rule.Unknown && rule.MaxPrice != nil {
+			return fmt.Errorf("price_priorities rule %d: max_price doesn't apply to unknown prices", i+1)
+		}
+	}
+	return nil
+}
+
+// The priority the first matching rule gives a listing's price, or default
+// if none matches
+func pricePriority(rules []PricePriority, price string) string {
+	dollars, known := parsePrice(price)
+	for _, rule := range rules {
+		if rule.Unknown {
+			if !known {
+				return rule.Priority
+			}
+			continue
+		}
+		if known && (rule.MaxPrice == nil || dollars <= *rule.MaxPrice) {
+			return rule.Priority
+		}
+	}
+	return priorityDefault
+}
+
+// Score a listing by the keywords it mentions: the sum of the weights of every
+// keyword found in its title or description, ignoring case. Weights can be
+// negative to push down listings that mention something unwanted.
+func scoreListing(l Listing, weights map[string]int) int {
+	text := strings.ToLower(l.Title + " " + l.Description)
+	score := 0
+	for keyword, weight := range weights {
+		if strings.Contains(text, strings.ToLower(keyword)) {
+			score += weight
+		}
+	}
+	return score
+}
+
+// Pick the priority to notify about a listing with: low for a suspected scam,
+// or else the one price_priorities (or defaultPricePriorities) gives its
+// price, raised to at least high when keyword scoring is on and it scored
+// -high-score or more
+func notificationPriority(cfg Config, listing Listing) string {
+	if listing.SuspectedScam {
+		return priorityLow
+	}
+	rules := cfg.PricePriorities
+	if rules == nil {
+		rules = defaultPricePriorities
+	}
+	priority := pricePriority(rules, listing.Price)
+	highScore := len(cfg.KeywordWeights) > 0 && listing.Score >= cfg.HighScore
+	if highScore && slices.Index(priorities, priority) < slices.Index(priorities, priorityHigh) {
+		return priorityHigh
+	}
+	return priority
+}
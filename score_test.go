@@ -0,0 +1,117 @@
+package main
+
+import "testing"
+
+func TestScoreListing(t *testing.T) {
+	weights := map[string]int{"mid-century": 5, "Teak": 3, "broken": -10}
+	for _, tc := range []struct {
+		listing Listing
+		want    int
+	}{
+		{Listing{Title: "Mid-Century teak dresser"}, 8},
+		{Listing{Title: "Dresser", Description: "Solid TEAK, one leg broken"}, -7},
+		{Listing{Title: "Teak teak teak"}, 3},
+		{Listing{Title: "Oak dresser"}, 0},
+	} {
+		if got := scoreListing(tc.listing, weights); got != tc.want {
+			t.Errorf("scoreListing(%q, %q) = %d, want %d", tc.listing.Title, tc.listing.Description, got, tc.want)
+		}
+	}
+	if got := scoreListing(Listing{Title: "Teak dresser"}, nil); got != 0 {
+		t.Errorf("scoreListing without weights = %d, want 0", got)
+	}
+}
+
+// A high score raises the priority to at least high, and one under
+// -min-score isn't notified at all, though scoring alone doesn't make a
+// priced listing interesting
+func TestScoreRouting(t *testing.T) {
+	cfg := Config{KeywordWeights: map[string]int{"teak": 5}, HighScore: 10, MinScore: 0}
+	for _, tc := range []struct {
+		price    string
+		score    int
+		priority string
+		notify   bool
+	}{
+		{"$50", 12, priorityHigh, false},
+		{"$50", 10, priorityHigh, false},
+		{"$50", 9, priorityDefault, false},
+		{"free", 12, priorityUrgent, true},
+		{"free", -1, priorityUrgent, false},
+	} {
+		listing := Listing{Title: "Teak dresser", Price: tc.price, Score: tc.score}
+		if got := notificationPriority(cfg, listing); got != tc.priority {
+			t.Errorf("notificationPriority(%s, score %d) = %s, want %s", tc.price, tc.score, got, tc.priority)
+		}
+		if got := shouldNotify(listing, cfg); got != tc.notify {
+			t.Errorf("shouldNotify(%s, score %d) = %v, want %v", tc.price, tc.score, got, tc.notify)
+		}
+	}
+
+	// Scores mean nothing without keyword weights
+	cfg.KeywordWeights = nil
+	if got := notificationPriority(cfg, Listing{Price: "$50", Score: 12}); got != priorityDefault {
+		t.Errorf("notificationPriority without keyword weights = %s, want default", got)
+	}
+}
+
+func TestPricePriority(t *testing.T) {
+	fifty, cheap := 50, 0
+	rules := []PricePriority{
+		{Unknown: true, Priority: priorityLow},
+		{MaxPrice: &cheap, Priority: priorityUrgent},
+		{MaxPrice: &fifty, Priority: priorityHigh},
+	}
+	for _, tc := range []struct {
+		rules []PricePriority
+		price string
+		want  string
+	}{
+		{defaultPricePriorities, "free", priorityUrgent},
+		{defaultPricePriorities, "$0", priorityUrgent},
+		{defaultPricePriorities, "", priorityUrgent},
+		{defaultPricePriorities, "call for price", priorityUrgent},
+		{defaultPricePriorities, "$1", priorityDefault},
+		{defaultPricePriorities, "$1,200", priorityDefault},
+		{rules, "", priorityLow},
+		{rules, "free", priorityUrgent},
+		{rules, "$50", priorityHigh},
+		{rules, "$50.99", priorityHigh},
+		{rules, "$51", priorityDefault},
+		{rules, "$25-$75", priorityHigh},
+		{nil, "free", priorityDefault},
+	} {
+		if got := pricePriority(tc.rules, tc.price); got != tc.want {
+			t.Errorf("pricePriority(%q) with %d rules = %s, want %s", tc.price, len(tc.rules), got, tc.want)
+		}
+	}
+
+	// Without price_priorities the defaults apply; a suspected scam is low
+	// whatever its price
+	if got := notificationPriority(Config{}, Listing{Price: "free"}); got != priorityUrgent {
+		t.Errorf("notificationPriority(free) = %s, want urgent", got)
+	}
+	if got := notificationPriority(Config{PricePriorities: rules}, Listing{Price: "$20"}); got != priorityHigh {
+		t.Errorf("notificationPriority($20) with rules = %s, want high", got)
+	}
+	if got := notificationPriority(Config{}, Listing{Price: "$5", SuspectedScam: true}); got != priorityLow {
+		t.Errorf("notificationPriority of a suspected scam = %s, want low", got)
+	}
+}
+
+func TestValidatePricePriorities(t *testing.T) {
+	hundred := 100
+	for _, tc := range []struct {
+		rules []PricePriority
+		ok    bool
+	}{
+		{defaultPricePriorities, true},
+		{[]PricePriority{{MaxPrice: &hundred, Priority: priorityMin}}, true},
+		{[]PricePriority{{Priority: "loud"}}, false},
+		{[]PricePriority{{Unknown: true, MaxPrice: &hundred, Priority: priorityHigh}}, false},
+	} {
+		if err := validatePricePriorities(tc.rules); (err == nil) != tc.ok {
+			t.Errorf("validatePricePriorities(%+v) = %v, want ok %v", tc.rules, err, tc.ok)
+		}
+	}
+}
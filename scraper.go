@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// Loads a search results page and extracts its listings. The page, and
+// the site and engine settings, are fixed when the scraper is made; the
+// chromedp engine also needs the browser tab in ctx.
+type Scraper interface {
+	Scrape(ctx context.Context) ([]Listing, error)
+}
+
+// The Scraper for cfg's -engine, loading searchURL for the site in cfg.City
+func newScraper(cfg Config, searchURL string) Scraper {
+	var engine Scraper
+	switch cfg.Engine {
+	case engineHTTP:
+		engine = httpScraper{cfg, searchURL}
+	case engineAuto:
+		engine = autoScraper{httpScraper{cfg, searchURL}, chromedpScraper{cfg, searchURL}}
+	default:
+		engine = chromedpScraper{cfg, searchURL}
+	}
+	return searchScraper{engine, cfg, searchURL}
+}
+
+// Tags the listings an engine found with the site and search URL they came
+// from, and resolves their redirects with -resolve-redirects
+type searchScraper struct {
+	engine    Scraper
+	cfg       Config
+	searchURL string
+}
+
+func (ss searchScraper) Scrape(ctx context.Context) ([]Listing, error) {
+	listings, err := ss.engine.Scrape(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range listings {
+		listings[i].Site = ss.cfg.City
+		listings[i].SearchURL = ss.searchURL
+	}
+	if ss.cfg.ResolveRedirects {
+		resolveListingURLs(ctx, listings)
+	}
+	return listings, nil
+}
+
+// Loads a search results page in headless Chrome
+type chromedpScraper struct {
+	cfg       Config
+	searchURL string
+}
+
+func (cs chromedpScraper) Scrape(ctx context.Context) ([]Listing, error) {
+	cfg, searchURL := cs.cfg, cs.searchURL
+	var htmlContent string
+
+	// Bound the whole load so a layout change can't leave WaitReady hanging forever
+	waitCtx, cancel := context.WithTimeout(ctx, cfg.WaitTimeout)
+	defer cancel()
+
+	// Run the chromedp tasks to load the page and wait for the content. Starting
+	// from a blank page forces a full load even when only the #search fragment
+	// changes between requests (as it does when paginating).
+	err := chromedp.Run(waitCtx,
+		chromedp.Navigate("about:blank"),
+		chromedp.Navigate(searchURL),
+		chromedp.WaitReady(cfg.Selectors.Result), // Wait until listings are loaded
+	)
+	if err != nil && waitCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		// See whether we were shown something other than results
+		page, captureErr := capturePage(ctx)
+		if captureErr != nil {
+			fmt.Printf("Failed to capture page for debugging: %v\n", captureErr)
+		}
+		if isBlockedPage(page) {
+			return nil, fmt.Errorf("%w on %s", ErrBlocked, searchURL)
+		}
+		if cfg.DumpHTMLDir != "" && captureErr == nil {
+			writePageDump(cfg.DumpHTMLDir, page)
+		}
+		return nil, fmt.Errorf("timed out after %v waiting for %q on %s; the page layout may have changed", cfg.WaitTimeout, cfg.Selectors.Result, searchURL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the page: %v", err)
+	}
+
+	// Scrolling takes as long as it takes, so only the initial load is
+	// bounded by -wait-timeout
+	if cfg.MaxScrolls > 0 {
+		if err := scrollResults(ctx, cfg.Selectors.Result, cfg.MaxScrolls); err != nil {
+			return nil, fmt.Errorf("failed to scroll the page: %v", err)
+		}
+	}
+	// Get the full HTML content of the body
+	if err := chromedp.Run(ctx, chromedp.InnerHTML("body", &htmlContent)); err != nil {
+		return nil, fmt.Errorf("failed to load the page: %v", err)
+	}
+
+	if cfg.Nearby {
+		recordNearbyAreas(cfg.City, searchURL, htmlContent, cfg.Selectors.Nearby)
+	}
+	return parseSearchPage(cfg.Category, cfg.Selectors, searchURL, htmlContent)
+}
+
+// How long a scroll gets to lazy-load more results before they're counted
+const scrollSettle = 1500 * time.Millisecond
+
+// Scroll to the bottom of a gallery page up to maxScrolls times, stopping
+// once a scroll doesn't bring in more results matching selector
+func scrollResults(ctx context.Context, selector string, maxScrolls int) error {
+	quoted, err := json.Marshal(selector)
+	if err != nil {
+		return err
+	}
+	countJS := "document.querySelectorAll(" + string(quoted) + ").length"
+
+	var count int
+	if err := chromedp.Run(ctx, chromedp.Evaluate(countJS, &count)); err != nil {
+		return err
+	}
+	for i := 0; i < maxScrolls; i++ {
+		var more int
+		err := chromedp.Run(ctx,
+			chromedp.Evaluate(`window.scrollTo(0, document.body.scrollHeight);`, nil),
+			chromedp.Sleep(scrollSettle),
+			chromedp.Evaluate(countJS, &more),
+		)
+		if err != nil {
+			return err
+		}
+		if more <= count {
+			debugf("Scrolled %d times, %d results loaded", i+1, count)
+			return nil
+		}
+		count = more
+	}
+	debugf("Stopped after %d scrolls, %d results loaded", maxScrolls, count)
+	return nil
+}
+
+// Tries the lightweight http engine first, and falls back to chromedp when it
+// fails or finds nothing, which usually means the page needs JavaScript
+type autoScraper struct {
+	http     Scraper // an httpScraper
+	chromedp Scraper // a chromedpScraper for the same page
+}
+
+func (as autoScraper) Scrape(ctx context.Context) ([]Listing, error) {
+	listings, err := as.http.Scrape(ctx)
+	if err == nil && len(listings) > 0 {
+		fmt.Printf("Scraped %d listings with the http engine\n", len(listings))
+		return listings, nil
+	}
+	// Chrome would only be blocked as well
+	if errors.Is(err, ErrBlocked) {
+		return nil, err
+	}
+	if err != nil {
+		fmt.Printf("The http engine failed, falling back to chromedp: %v\n", err)
+	} else {
+		fmt.Println("The http engine found no listings, falling back to chromedp")
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	listings, err = as.chromedp.Scrape(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Scraped %d listings with the chromedp engine\n", len(listings))
+	return listings, nil
+}
+
+// Fetches a search results page with a plain HTTP request. This only works
+// for the static results page Craigslist serves to clients without JavaScript,
+// but needs no browser at all. A page with no matching results is dumped to
+// -dump-html-dir, since it may mean the page now needs JavaScript.
+type httpScraper struct {
+	cfg       Config
+	searchURL string
+}
+
+func (hs httpScraper) Scrape(ctx context.Context) ([]Listing, error) {
+	cfg, searchURL := hs.cfg, hs.searchURL
+	reqCtx, cancel := context.WithTimeout(ctx, cfg.WaitTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, searchURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", httpUserAgent)
+	req.Header.Set("Accept-Language", cfg.AcceptLanguage)
+	resp, err := scrapeClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the page: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the page: %v", err)
+	}
+	// The block page may come with an error status, so check for it first
+	if isBlockedPage(string(body)) {
+		return nil, fmt.Errorf("%w on %s", ErrBlocked, searchURL)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("failed to load the page: %s", resp.Status)
+	}
+
+	if cfg.Nearby {
+		recordNearbyAreas(cfg.City, searchURL, string(body), cfg.StaticSelectors.Nearby)
+	}
+	listings, err := parseSearchPage(cfg.Category, cfg.StaticSelectors, searchURL, string(body))
+	if err == nil && len(listings) == 0 && cfg.DumpHTMLDir != "" {
+		writePageDump(cfg.DumpHTMLDir, string(body))
+	}
+	return listings, err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Returns err, or otherwise listings, counting its calls
+type stubScraper struct {
+	listings []Listing
+	err      error
+	calls    *int
+}
+
+func (ss stubScraper) Scrape(ctx context.Context) ([]Listing, error) {
+	*ss.calls++
+	return ss.listings, ss.err
+}
+
+func TestAutoScraperFallback(t *testing.T) {
+	found := []Listing{fakeListing("Couch", "$50", "1001")}
+	for _, tc := range []struct {
+		name         string
+		httpListings []Listing
+		httpErr      error
+		wantFallback bool
+		wantErr      error
+	}{
+		{"http finds listings", found, nil, false, nil},
+		{"http finds nothing", nil, nil, true, nil},
+		{"http fails", nil, errors.New("failed to load the page: 503 Service Unavailable"), true, nil},
+		{"http is blocked", nil, fmt.Errorf("%w on page", ErrBlocked), false, ErrBlocked},
+	} {
+		var httpCalls, chromeCalls int
+		as := autoScraper{
+			http:     stubScraper{tc.httpListings, tc.httpErr, &httpCalls},
+			chromedp: stubScraper{found, nil, &chromeCalls},
+		}
+		listings, err := as.Scrape(context.Background())
+		if !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if fellBack := chromeCalls > 0; fellBack != tc.wantFallback {
+			t.Errorf("%s: fell back to chromedp %v, want %v", tc.name, fellBack, tc.wantFallback)
+		}
+		if tc.wantErr == nil && len(listings) != 1 {
+			t.Errorf("%s: %d listings, want 1", tc.name, len(listings))
+		}
+	}
+}
+
+// A static page without results, as when Craigslist wants JavaScript,
+// sends -engine auto to Chrome
+func TestAutoScraperFallsBackOnEmptyPage(t *testing.T) {
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<html><body><noscript>Please enable JavaScript</noscript></body></html>`))
+	}))
+	defer page.Close()
+	cfg := testCycleConfig(t, &recordingNotifier{})
+
+	chromeCalls := 0
+	as := autoScraper{
+		http:     httpScraper{cfg, page.URL},
+		chromedp: stubScraper{[]Listing{fakeListing("Couch", "$50", "1002")}, nil, &chromeCalls},
+	}
+	if _, err := as.Scrape(context.Background()); err != nil {
+		t.Fatalf("Scrape: %v", err)
+	}
+	if chromeCalls != 1 {
+		t.Errorf("chromedp scraped %d times, want 1", chromeCalls)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A named search from the -config file. Listings from its city that match its
+// keywords and price range are notified, tagged with the search's name.
+type SavedSearch struct {
+	Name     string   `json:"name"`
+	City     string   `json:"city"`      // Craigslist site; defaults to -city, or every site in -region
+	Region   string   `json:"region"`    // a -region name, instead of city
+	Keywords []string `json:"keywords"`  // any of these in the title (case-insensitive); empty matches every title
+	MinPrice *int     `json:"min_price"` // in dollars; listings without a known price never match a price bound
+	MaxPrice *int     `json:"max_price"`
+
+	// Names of the notifiers that receive this search's matches; defaults to the -ntfy-* topic
+	Notifiers []string `json:"notifiers"`
+
+	// The sites the search covers, from its city or region; filled in by validateSearches
+	Sites []string `json:"-"`
+}
+
+// Report whether a listing satisfies the search's keywords and price range.
+// The city is checked separately, against the site the listing came from.
+func (s SavedSearch) Matches(listing Listing) bool {
+	if len(s.Keywords) > 0 && len(s.matchedKeywords(listing)) == 0 {
+		return false
+	}
+
+	if s.MinPrice != nil || s.MaxPrice != nil {
+		price, ok := parsePrice(listing.Price)
+		if !ok {
+			return false
+		}
+		if s.MinPrice != nil && price < *s.MinPrice {
+			return false
+		}
+		if s.MaxPrice != nil && price > *s.MaxPrice {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The search's keywords found in a listing's title, ignoring case
+func (s SavedSearch) matchedKeywords(listing Listing) []string {
+	title := strings.ToLower(listing.Title)
+	var matched []string
+	for _, keyword := range s.Keywords {
+		if strings.Contains(title, strings.ToLower(keyword)) {
+			matched = append(matched, keyword)
+		}
+	}
+	return matched
+}
+
+// The keywords that surfaced a listing from the given site: those found in
+// it by every saved search it matches, without repeats (ignoring case)
+func matchedKeywords(searches []SavedSearch, site string, listing Listing) keywordList {
+	var keywords keywordList
+	for _, search := range matchingSearches(searches, site, listing) {
+		for _, keyword := range search.matchedKeywords(listing) {
+			repeat := slices.ContainsFunc(keywords, func(k string) bool { return strings.EqualFold(k, keyword) })
+			if !repeat {
+				keywords = append(keywords, keyword)
+			}
+		}
+	}
+	return keywords
+}
+
+// Keywords as stored in the matched_keywords column: a JSON array, or NULL
+// when there are none
+type keywordList []string
+
+func (kl keywordList) Value() (driver.Value, error) {
+	if len(kl) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal([]string(kl))
+	return string(b), err
+}
+
+func (kl *keywordList) Scan(src any) error {
+	*kl = nil
+	var text string
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		return fmt.Errorf("unexpected matched_keywords value %T", src)
+	}
+	if text == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(text), (*[]string)(kl))
+}
+
+// Return the saved searches that match a listing from the given site
+func matchingSearches(searches []SavedSearch, site string, listing Listing) []SavedSearch {
+	var matched []SavedSearch
+	for _, search := range searches {
+		if slices.Contains(search.Sites, site) && search.Matches(listing) {
+			matched = append(matched, search)
+		}
+	}
+	return matched
+}
+
+// Return the distinct sites to scrape: the union of the saved searches'
+// sites, or the default sites (-city or -region) when there are no saved searches
+func searchSites(cfg Config) []string {
+	if len(cfg.Searches) == 0 {
+		return cfg.Sites
+	}
+
+	var sites []string
+	seen := make(map[string]bool)
+	for _, search := range cfg.Searches {
+		for _, site := range search.Sites {
+			if !seen[site] {
+				seen[site] = true
+				sites = append(sites, site)
+			}
+		}
+	}
+	return sites
+}
+
+// Check the saved searches for mistakes, filling in each search's sites and
+// default notifier. Every region and notifier a search names must exist.
+func validateSearches(searches []SavedSearch, defaultSites []string, regions map[string][]string, notifiers map[string]Notifier) error {
+	names := make(map[string]bool)
+	for i := range searches {
+		search := &searches[i]
+		if search.Name == "" {
+			return fmt.Errorf("search %d has no name", i+1)
+		}
+		if names[search.Name] {
+			return fmt.Errorf("duplicate search name %q", search.Name)
+		}
+		names[search.Name] = true
+
+		switch {
+		case search.City != "" && search.Region != "":
+			return fmt.Errorf("search %q: city and region can't both be set", search.Name)
+		case search.City != "":
+			search.Sites = []string{search.City}
+		case search.Region != "":
+			search.Sites = regions[search.Region]
+			if search.Sites == nil {
+				return fmt.Errorf("search %q: unknown region %q", search.Name, search.Region)
+			}
+		default:
+			search.Sites = defaultSites
+		}
+		if search.MinPrice != nil && search.MaxPrice != nil && *search.MinPrice > *search.MaxPrice {
+			return fmt.Errorf("search %q: min_price is greater than max_price", search.Name)
+		}
+
+		if len(search.Notifiers) == 0 {
+			search.Notifiers = []string{defaultNotifierName}
+		}
+		for _, name := range search.Notifiers {
+			if notifiers[name] == nil {
+				return fmt.Errorf("search %q: unknown notifier %q", search.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Decide whether a listing is interesting enough to notify about. With saved
+// searches, it is if any search matches it; otherwise only free, empty, or
+// unknown prices are. Either way, so is a listing priced well under its
+// category's average, unless keyword scoring puts it under -min-score or its
+// title is too short for -min-title-length.
+func shouldNotify(l Listing, cfg Config) bool {
+	if cfg.MinTitleLength > 0 && shortTitle(l.Title, cfg.MinTitleLength) {
+		return false
+	}
+	if len(cfg.KeywordWeights) > 0 && l.Score < cfg.MinScore {
+		return false
+	}
+	if l.BelowAverage {
+		return true
+	}
+	if len(cfg.Searches) > 0 {
+		return len(matchingSearches(cfg.Searches, l.Site, l)) > 0
+	}
+	return strings.ToLower(l.Price) == "free" || l.Price == "" || l.Price == "()"
+}
+
+// Report whether a title, trimmed, has fewer than minLength characters or is
+// the placeholder for a result without one
+func shortTitle(title string, minLength int) bool {
+	title = strings.TrimSpace(title)
+	return title == placeholderTitle || utf8.RuneCountInString(title) < minLength
+}
+
+// Parse a displayed price into whole dollars, dropping any cents: "$1,200"
+// is 1200, "free" is 0, and a range such as "$100-$200" is its lower bound.
+// Reports false for empty or unrecognized prices, including placeholders
+// like "contact for price".
+func parsePrice(price string) (int, bool) {
+	cents, ok := parsePriceCents(price)
+	return cents / 100, ok
+}
+
+// Parse a displayed price into cents. Either "," or "." may be the decimal
+// mark, so "$1,200.50", "1.200,50 €", and "12,50 €" all parse; see
+// parseAmount.
+func parsePriceCents(price string) (int, bool) {
+	price = strings.ToLower(strings.TrimSpace(price))
+	if price == "free" {
+		return 0, true
+	}
+	if isPricePlaceholder(price) {
+		return 0, false
+	}
+	price, _ = splitPriceRange(price)
+	return parseAmount(priceFormatting.Replace(price))
+}
+
+// Parse a displayed price into cents for the price_cents column, or nil if
+// it's unknown
+func priceCents(price string) *int {
+	cents, ok := parsePriceCents(price)
+	if !ok {
+		return nil
+	}
+	return &cents
+}
+
+// Currency symbols in displayed prices, and the spaces some locales group
+// digits with, e.g. "1 200 €"
+var priceFormatting = strings.NewReplacer("$", "", "£", "", "€", "", " ", "", "\u00a0", "", "\u202f", "")
+
+// Parse an amount such as "1,200.50" or "1.200" into cents. A final "," or
+// "." followed by exactly two digits is the decimal mark; any other "," or
+// "." groups digits in threes, so "," groups in "1,200" and "." in "1.200".
+func parseAmount(amount string) (int, bool) {
+	whole, fraction := amount, "00"
+	if i := strings.LastIndexAny(amount, ",."); i >= 0 && len(amount)-i == 3 {
+		whole, fraction = amount[:i], amount[i+1:]
+		// The decimal mark can't also group the whole amount
+		if strings.ContainsRune(whole, rune(amount[i])) {
+			return 0, false
+		}
+	}
+
+	groups := strings.FieldsFunc(whole, func(r rune) bool { return r == ',' || r == '.' })
+	if len(groups) == 0 || strings.Count(whole, ",")+strings.Count(whole, ".") != len(groups)-1 {
+		return 0, false
+	}
+	for _, group := range groups[1:] {
+		if len(group) != 3 {
+			return 0, false
+		}
+	}
+
+	dollars, err := strconv.Atoi(strings.Join(groups, ""))
+	if err != nil || dollars < 0 {
+		return 0, false
+	}
+	cents, err := strconv.Atoi(fraction)
+	if err != nil || cents < 0 || strings.ContainsAny(fraction, "+-") {
+		return 0, false
+	}
+	return dollars*100 + cents, true
+}
+
+// Normalize a displayed price for storage and matching: a range becomes its
+// lower bound, e.g. "$100" from "$100 - $200", and a placeholder such as
+// "call for price" becomes empty, the same as no price at all
+func normalizePrice(price string) string {
+	price = strings.TrimSpace(price)
+	if isPricePlaceholder(strings.ToLower(price)) {
+		return ""
+	}
+	if low, ok := splitPriceRange(price); ok {
+		return low
+	}
+	return price
+}
+
+// Text shown instead of a price when the seller wants to be asked
+var pricePlaceholders = []string{"contact", "call", "ask", "inquire", "negotiable"}
+
+// Report whether a lowercased price is a placeholder rather than an amount
+func isPricePlaceholder(price string) bool {
+	if price == "" || strings.ContainsAny(price, "0123456789") {
+		return false
+	}
+	for _, placeholder := range pricePlaceholders {
+		if strings.Contains(price, placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// Split off the lower bound of a price range such as "$100-$200" or
+// "$100 – $200", reporting whether the price was a range
+func splitPriceRange(price string) (string, bool) {
+	for _, separator := range []string{"-", "–", "—", " to "} {
+		if low, high, ok := strings.Cut(price, separator); ok && strings.TrimSpace(low) != "" && strings.TrimSpace(high) != "" {
+			return strings.TrimSpace(low), true
+		}
+	}
+	return price, false
+}
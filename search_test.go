@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestParsePriceCents(t *testing.T) {
+	for _, tc := range []struct {
+		price string
+		cents int
+		ok    bool
+	}{
+		{"$50", 5000, true},
+		{"$1,200", 120000, true},
+		{"$1,200.50", 120050, true},
+		{"€1.200", 120000, true},
+		{"12,50 €", 1250, true},
+		{"1.200,50 €", 120050, true},
+		{"1 200 €", 120000, true},
+		{"1\u00a0200 €", 120000, true},
+		{"£1,234,567", 123456700, true},
+		{"$100 - $200", 10000, true},
+		{"free", 0, true},
+		{"$0", 0, true},
+		{"", 0, false},
+		{"call for price", 0, false},
+		{"$1.5", 0, false},
+		{"$12,5", 0, false},
+		{"1,200,50", 0, false},
+		{"$-5", 0, false},
+	} {
+		cents, ok := parsePriceCents(tc.price)
+		if cents != tc.cents || ok != tc.ok {
+			t.Errorf("parsePriceCents(%q) = %d, %v; want %d, %v", tc.price, cents, ok, tc.cents, tc.ok)
+		}
+	}
+}
+
+func TestParsePriceDropsCents(t *testing.T) {
+	for price, want := range map[string]int{"$1,200.50": 1200, "12,50 €": 12, "€1.200": 1200} {
+		if got, ok := parsePrice(price); !ok || got != want {
+			t.Errorf("parsePrice(%q) = %d, %v; want %d", price, got, ok, want)
+		}
+	}
+}
+
+func TestInferPrice(t *testing.T) {
+	for title, want := range map[string]string{
+		"Couch - $50":         "$50",
+		"Sofa €1.200, barely": "€1.200",
+		"Table $1,200.":       "$1,200",
+		"Free chair":          "",
+	} {
+		if got, _ := inferPrice(title); got != want {
+			t.Errorf("inferPrice(%q) = %q, want %q", title, got, want)
+		}
+	}
+}
+
+func TestNormalizePrice(t *testing.T) {
+	for _, tc := range []struct{ price, want string }{
+		{"$100-$200", "$100"},
+		{"$100 – $200", "$100"},
+		{"$100 to $200", "$100"},
+		{"$150", "$150"},
+		{"-$5", "-$5"},
+		{"Contact for price", ""},
+		{"call", ""},
+		{"Negotiable", ""},
+		{"free", "free"},
+		{"", ""},
+	} {
+		if got := normalizePrice(tc.price); got != tc.want {
+			t.Errorf("normalizePrice(%q) = %q, want %q", tc.price, got, tc.want)
+		}
+	}
+}
+
+// A result's range or placeholder is kept as shown, while the price used for
+// filtering is the range's lower bound, or nothing at all
+func TestParseTextualPrices(t *testing.T) {
+	listings := parseTestResults(t, "fuo",
+		galleryResult("Bookshelves", "601", "$100-$200"),
+		galleryResult("Piano", "602", "contact for price"),
+	)
+	if l := listings[0]; l.Price != "$100" || l.PriceText != "$100-$200" || l.PriceCents == nil || *l.PriceCents != 10000 {
+		t.Errorf("range parsed as price %q, price_text %q, price_cents %v", l.Price, l.PriceText, l.PriceCents)
+	}
+	if l := listings[1]; l.Price != "" || l.PriceText != "contact for price" || l.PriceCents != nil {
+		t.Errorf("placeholder parsed as price %q, price_text %q, price_cents %v", l.Price, l.PriceText, l.PriceCents)
+	}
+}
+
+func TestShouldNotify(t *testing.T) {
+	plain := Config{}
+	minPrice, maxPrice := 50, 200
+	searches := Config{Searches: []SavedSearch{
+		{Name: "couches", Keywords: []string{"couch"}, MinPrice: &minPrice, MaxPrice: &maxPrice},
+	}}
+	if err := validateSearches(searches.Searches, []string{"sfbay"}, nil, map[string]Notifier{defaultNotifierName: testNotifier{}}); err != nil {
+		t.Fatalf("validateSearches: %v", err)
+	}
+	titled := Config{MinTitleLength: 5}
+
+	for _, tc := range []struct {
+		name    string
+		listing Listing
+		cfg     Config
+		want    bool
+	}{
+		{"free", Listing{Title: "Chair", Price: "free"}, plain, true},
+		{"Free", Listing{Title: "Chair", Price: "Free"}, plain, true},
+		{"empty price", Listing{Title: "Chair"}, plain, true},
+		{"empty parentheses", Listing{Title: "Chair", Price: "()"}, plain, true},
+		{"priced", Listing{Title: "Chair", Price: "$20"}, plain, false},
+		{"priced below average", Listing{Title: "Chair", Price: "$20", BelowAverage: true}, plain, true},
+		{"search, price in range", Listing{Title: "Leather couch", Price: "$120", Site: "sfbay"}, searches, true},
+		{"search, price at the bound", Listing{Title: "Leather couch", Price: "$200", Site: "sfbay"}, searches, true},
+		{"search, price above range", Listing{Title: "Leather couch", Price: "$250", Site: "sfbay"}, searches, false},
+		{"search, price below range", Listing{Title: "Leather couch", Price: "$20", Site: "sfbay"}, searches, false},
+		{"search, free is out of range", Listing{Title: "Leather couch", Price: "free", Site: "sfbay"}, searches, false},
+		{"search, no keyword", Listing{Title: "Armchair", Price: "$120", Site: "sfbay"}, searches, false},
+		{"search, other site", Listing{Title: "Leather couch", Price: "$120", Site: "charlotte"}, searches, false},
+		{"title long enough", Listing{Title: "Chair", Price: "free"}, titled, true},
+		{"title too short", Listing{Title: " TV ", Price: "free"}, titled, false},
+		{"placeholder title", Listing{Title: placeholderTitle, Price: "free"}, titled, false},
+	} {
+		if got := shouldNotify(tc.listing, tc.cfg); got != tc.want {
+			t.Errorf("%s: shouldNotify(%q, %q) = %v, want %v", tc.name, tc.listing.Title, tc.listing.Price, got, tc.want)
+		}
+	}
+}
+
+// The keywords recorded for a listing are exactly the ones that made a saved
+// search match it
+func TestMatchedKeywords(t *testing.T) {
+	maxPrice := 100
+	searches := []SavedSearch{
+		{Name: "seating", Keywords: []string{"couch", "Sofa", "chair"}},
+		{Name: "cheap tables", Keywords: []string{"table", "SOFA"}, MaxPrice: &maxPrice},
+		{Name: "charlotte", City: "charlotte", Keywords: []string{"leather"}},
+	}
+	if err := validateSearches(searches, []string{"sfbay"}, nil, map[string]Notifier{defaultNotifierName: testNotifier{}}); err != nil {
+		t.Fatalf("validateSearches: %v", err)
+	}
+	for _, tc := range []struct {
+		title, price string
+		want         []string
+	}{
+		{"Leather sofa", "$300", []string{"Sofa"}},
+		{"Sofa table", "$40", []string{"Sofa", "table"}},
+		{"Sofa table", "$400", []string{"Sofa"}},
+		{"Coffee table", "$400", nil},
+		{"Desk", "free", nil},
+	} {
+		listing := Listing{Title: tc.title, Price: tc.price, Site: "sfbay"}
+		got := matchedKeywords(searches, listing.Site, listing)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("matchedKeywords(%q, %s) = %q, want %q", tc.title, tc.price, got, tc.want)
+		}
+		if matched := len(matchingSearches(searches, listing.Site, listing)) > 0; matched != (len(tc.want) > 0) {
+			t.Errorf("%q, %s: keywords %q recorded, but matched a search is %v", tc.title, tc.price, got, matched)
+		}
+	}
+}
+
+func TestMatchedKeywordsStored(t *testing.T) {
+	db := newTestDB(t)
+	for postID, keywords := range map[string]keywordList{"401": {"Sofa", "table"}, "402": nil} {
+		listing := fakeListing("Sofa table", "$40", postID)
+		listing.MatchedKeywords = keywords
+		if _, err := insertListing(context.Background(), db, listing); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := getListingByPostID(context.Background(), db, postID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(stored.MatchedKeywords, keywords) {
+			t.Errorf("listing %s stored keywords %q, want %q", postID, stored.MatchedKeywords, keywords)
+		}
+	}
+	var raw *string
+	if err := db.QueryRow(`SELECT matched_keywords FROM listings WHERE post_id = '401';`).Scan(&raw); err != nil || raw == nil || *raw != `["Sofa","table"]` {
+		t.Errorf("matched_keywords column holds %v, %v", raw, err)
+	}
+}
+
+func TestShortTitle(t *testing.T) {
+	for _, tc := range []struct {
+		title     string
+		minLength int
+		short     bool
+	}{
+		{"Desk", 5, true},
+		{"Chair", 5, false},
+		{"Chairs", 5, false},
+		{"  Desk  ", 5, true},
+		{"  Chair\n", 5, false},
+		{"Bürö", 5, true},
+		{"Büros", 5, false},
+		{"", 1, true},
+		{"   ", 1, true},
+		{"X", 1, false},
+		{placeholderTitle, 1, true},
+		{" " + placeholderTitle + " ", 1, true},
+		{placeholderTitle + "s", 1, false},
+	} {
+		if got := shortTitle(tc.title, tc.minLength); got != tc.short {
+			t.Errorf("shortTitle(%q, %d) = %v, want %v", tc.title, tc.minLength, got, tc.short)
+		}
+	}
+}
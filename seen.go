@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// How long a post is remembered in seen_posts after it was last scraped.
+// Much longer than listings are kept, so a post still up after its row is
+// cleaned out, or after a restart, isn't taken for a new one.
+const seenRetention = 30 * 24 * time.Hour
+
+// What seen_posts knew about a post before the latest sighting of it
+type sighting int
+
+const (
+	sightingNew       sighting = iota // never seen, or not within seenRetention
+	sightingUnchanged                 // seen with the same title and price
+	sightingChanged                   // seen, but the title or price has been edited since
+)
+
+// Hash the content a seller can edit in place. Unlike listingFingerprint,
+// every change counts, so a price edit from $100 to $90 is caught.
+func contentHash(listing Listing) string {
+	sum := sha256.Sum256([]byte(listing.Title + "\x00" + listing.Price))
+	return hex.EncodeToString(sum[:])
+}
+
+// Record a sighting of a listing in seen_posts, keyed by post ID (or URL for
+// results without one), and report what was known about it before
+func recordSighting(ctx context.Context, db *sql.DB, listing Listing) (sighting, error) {
+	key := listing.PostID
+	if key == "" {
+		key = listing.ListingURL
+	}
+	hash := contentHash(listing)
+
+	var previous string
+	selectQuery := `
+	SELECT content_hash FROM seen_posts
+	WHERE post_id = ?;
+	`
+	err := db.QueryRowContext(ctx, selectQuery, key).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return sightingNew, err
+	}
+	result := sightingNew
+	if err == nil {
+		result = sightingUnchanged
+		if previous != hash {
+			result = sightingChanged
+		}
+	}
+
+	upsertQuery := `
+	INSERT INTO seen_posts (post_id, content_hash, first_seen, last_seen)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(post_id) DO UPDATE SET content_hash = excluded.content_hash, last_seen = excluded.last_seen;
+	`
+	now := time.Now().UTC()
+	err = withRetry(ctx, func() error {
+		_, err := db.ExecContext(ctx, upsertQuery, key, hash, now, now)
+		return err
+	})
+	return result, err
+}
+
+// Forget posts that haven't been scraped within seenRetention
+func deleteOldSightings(ctx context.Context, db *sql.DB) error {
+	deleteQuery := `
+	DELETE FROM seen_posts
+	WHERE last_seen < ?;
+	`
+	_, err := db.ExecContext(ctx, deleteQuery, time.Now().UTC().Add(-seenRetention))
+	return err
+}
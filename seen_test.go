@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordSighting(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "seen.db")
+	db, err := initDB(ctx, path, "off")
+	if err != nil {
+		t.Fatalf("initDB: %v", err)
+	}
+
+	couch := fakeListing("Leather couch", "$100", "7781270001")
+	legacy := fakeListing("Desk", "$40", "")
+	for _, tc := range []struct {
+		name    string
+		listing Listing
+		want    sighting
+	}{
+		{"first sighting", couch, sightingNew},
+		{"seen again", couch, sightingUnchanged},
+		{"price edited", fakeListing("Leather couch", "$90", "7781270001"), sightingChanged},
+		{"seen after the edit", fakeListing("Leather couch", "$90", "7781270001"), sightingUnchanged},
+		{"title edited", fakeListing("Leather couch, must go", "$90", "7781270001"), sightingChanged},
+		{"result without a post ID", legacy, sightingNew},
+		{"seen again by URL", legacy, sightingUnchanged},
+		{"another post", fakeListing("Leather couch", "$90", "7781270002"), sightingNew},
+	} {
+		if got, err := recordSighting(ctx, db, tc.listing); err != nil || got != tc.want {
+			t.Errorf("%s: recordSighting = %v, %v; want %v", tc.name, got, err, tc.want)
+		}
+	}
+
+	// Sightings outlive a restart, changes and all
+	db.Close()
+	db, err = initDB(ctx, path, "off")
+	if err != nil {
+		t.Fatalf("initDB after restart: %v", err)
+	}
+	defer db.Close()
+	for _, tc := range []struct {
+		name    string
+		listing Listing
+		want    sighting
+	}{
+		{"unchanged after restart", fakeListing("Leather couch, must go", "$90", "7781270001"), sightingUnchanged},
+		{"edited after restart", fakeListing("Leather couch, must go", "$75", "7781270001"), sightingChanged},
+	} {
+		if got, err := recordSighting(ctx, db, tc.listing); err != nil || got != tc.want {
+			t.Errorf("%s: recordSighting = %v, %v; want %v", tc.name, got, err, tc.want)
+		}
+	}
+
+	// Posts not seen within seenRetention are forgotten
+	if _, err := db.Exec(`UPDATE seen_posts SET last_seen = ? WHERE post_id = ?;`, time.Now().UTC().Add(-seenRetention-time.Hour), couch.PostID); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteOldSightings(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := recordSighting(ctx, db, couch); err != nil || got != sightingNew {
+		t.Errorf("recordSighting of a forgotten post = %v, %v; want new", got, err)
+	}
+}
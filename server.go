@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Set by POST /pause and cleared by POST /resume. While set, every monitor
+// skips its cycles, so nothing is scraped or notified.
+var scrapingPaused atomic.Bool
+
+// The body of GET /stats
+type apiStats struct {
+	RunID             string `json:"run_id"`
+	Paused            bool   `json:"paused"`
+	Scraped           int64  `json:"listings_scraped"`
+	Inserted          int64  `json:"listings_inserted"`
+	Duplicate         int64  `json:"listings_duplicate"`
+	Filtered          int64  `json:"listings_filtered"`
+	Notified          int64  `json:"listings_notified"`
+	NotificationsSent int64  `json:"notifications_sent"`
+
+	// What's in the database (and any partitions) now
+	Stored       int            `json:"listings_stored"`
+	StoredByCity map[string]int `json:"listings_stored_by_city"`
+}
+
+// What the {postID} and ?city= parameters must look like. Anything else is
+// refused rather than matched, so a value can't widen a lookup or a delete.
+var (
+	postIDParamRegexp   = regexp.MustCompile(`^[0-9]+$`)
+	siteParamRegexp     = regexp.MustCompile(`^[a-z0-9]+$`)
+	cityNameParamRegexp = regexp.MustCompile(`^\p{L}[\p{L}\p{N} .'-]*$`) // as shown in results, e.g. "Winston-Salem"
+)
+
+// Page sizes for /listings
+const (
+	defaultListingsLimit = 100
+	maxListingsLimit     = 500
+)
+
+// Start the HTTP API in the background. The API is served over HTTPS when a
+// certificate and key are configured; they are loaded up front so a bad pair
+// fails startup rather than the first request. Listings are served from all
+// of dbs: the database, then any -partition-by-city partitions.
+func startServer(cfg Config, dbs []*sql.DB) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:    cfg.ListenAddr,
+		Handler: newAPIHandler(cfg, dbs),
+	}
+
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			fmt.Printf("API listening on https://%s\n", cfg.ListenAddr)
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			fmt.Printf("API listening on http://%s\n", cfg.ListenAddr)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Printf("API server failed: %v\n", err)
+		}
+	}()
+
+	return srv, nil
+}
+
+// Build the API routes. Everything except /healthz sits behind basic auth when
+// -api-user and -api-pass are set.
+func newAPIHandler(cfg Config, dbs []*sql.DB) http.Handler {
+	root := http.NewServeMux()
+	mux := http.NewServeMux()
+
+	// Left open for load balancer and container probes
+	root.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		if scrapingPaused.Load() {
+			fmt.Fprintln(w, "ok (paused)")
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	if cfg.APIUser != "" {
+		root.Handle("/", requireBasicAuth(mux, cfg.APIUser, cfg.APIPass))
+	} else {
+		root.Handle("/", mux)
+	}
+
+	// Stop and restart scraping without stopping the process. Like the
+	// deletes, only allowed behind basic auth, so nobody who merely reaches
+	// the port can silence the monitor.
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.APIUser == "" {
+			http.Error(w, "pausing requires -api-user and -api-pass", http.StatusForbidden)
+			return
+		}
+		if !scrapingPaused.Swap(true) {
+			fmt.Println("Scraping paused via the API")
+		}
+		writeJSON(w, map[string]bool{"paused": true})
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.APIUser == "" {
+			http.Error(w, "resuming requires -api-user and -api-pass", http.StatusForbidden)
+			return
+		}
+		if scrapingPaused.Swap(false) {
+			fmt.Println("Scraping resumed via the API")
+		}
+		writeJSON(w, map[string]bool{"paused": false})
+	})
+
+	// The counters from metrics.go, whether scraping is paused, and how many
+	// listings are stored
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		stats := apiStats{
+			RunID:             currentRun.id,
+			Paused:            scrapingPaused.Load(),
+			Scraped:           scrapedCount.Value(),
+			Inserted:          insertedCount.Value(),
+			Duplicate:         duplicateCount.Value(),
+			Filtered:          filteredCount.Value(),
+			Notified:          notifiedListed.Value(),
+			NotificationsSent: notifiedCount.Value(),
+			StoredByCity:      make(map[string]int),
+		}
+		for _, db := range dbs {
+			byCity, err := countListingsByCity(r.Context(), db)
+			if err != nil {
+				fmt.Printf("Failed to count listings: %v\n", err)
+				http.Error(w, "failed to count listings", http.StatusInternalServerError)
+				return
+			}
+			for city, n := range byCity {
+				stats.Stored += n
+				stats.StoredByCity[city] += n
+			}
+		}
+		writeJSON(w, stats)
+	})
+
+	// Counters from metrics.go
+	mux.HandleFunc("GET /debug/vars", serveVars)
+
+	// GET /listings?section=fuo&search_url=...&min_price=10&max_price=100&sort=posted|updated|price&order=asc|desc&limit=100&offset=0
+	// Prices are whole dollars; listings with unknown prices only match without them.
+	// The total number of matches is returned in X-Total-Count.
+	mux.HandleFunc("GET /listings", func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseListingQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		listings, total, err := queryPartitions(r.Context(), dbs, q)
+		if err != nil {
+			fmt.Printf("Failed to query listings: %v\n", err)
+			http.Error(w, "failed to query listings", http.StatusInternalServerError)
+			return
+		}
+		for i := range listings {
+			listings[i] = inDisplayTZ(listings[i], cfg.DisplayTZ)
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		writeJSON(w, listings)
+	})
+
+	// GET /listings/{postID}: one listing, with its description, images, and
+	// attributes once it has been enriched
+	mux.HandleFunc("GET /listings/{postID}", func(w http.ResponseWriter, r *http.Request) {
+		postID := r.PathValue("postID")
+		if !postIDParamRegexp.MatchString(postID) {
+			http.Error(w, "invalid post ID: must be digits", http.StatusBadRequest)
+			return
+		}
+		listing, err := getPartitionedListing(r.Context(), dbs, postID)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "listing not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Failed to look up listing: %v\n", err)
+			http.Error(w, "failed to look up listing", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, inDisplayTZ(listing, cfg.DisplayTZ))
+	})
+
+	// DELETE /listings/{postID} and DELETE /listings?city=sfbay (a site) or
+	// ?city=San+Francisco (a city as shown in the results): purge listings by
+	// hand, responding with how many were removed. Only allowed behind
+	// basic auth, since anyone who can reach an open API could empty the database.
+	mux.HandleFunc("DELETE /listings/{postID}", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.APIUser == "" {
+			http.Error(w, "deleting listings requires -api-user and -api-pass", http.StatusForbidden)
+			return
+		}
+		postID := r.PathValue("postID")
+		if !postIDParamRegexp.MatchString(postID) {
+			http.Error(w, "invalid post ID: must be digits", http.StatusBadRequest)
+			return
+		}
+		deleted, err := deleteFromPartitions(dbs, func(db *sql.DB) (int64, error) {
+			return deleteListingByPostID(r.Context(), db, postID)
+		})
+		if err != nil {
+			fmt.Printf("Failed to delete listing: %v\n", err)
+			http.Error(w, "failed to delete listing", http.StatusInternalServerError)
+			return
+		}
+		if deleted == 0 {
+			http.Error(w, "listing not found", http.StatusNotFound)
+			return
+		}
+		fmt.Printf("Deleted listing %s via the API\n", postID)
+		writeJSON(w, map[string]int64{"deleted": deleted})
+	})
+	mux.HandleFunc("DELETE /listings", func(w http.ResponseWriter, r *http.Request) {
+		if cfg.APIUser == "" {
+			http.Error(w, "deleting listings requires -api-user and -api-pass", http.StatusForbidden)
+			return
+		}
+		city := r.URL.Query().Get("city")
+		if city == "" {
+			http.Error(w, "city is required", http.StatusBadRequest)
+			return
+		}
+		if !siteParamRegexp.MatchString(city) && !cityNameParamRegexp.MatchString(city) {
+			http.Error(w, "invalid city: must be a site name such as sfbay or a city name such as San Francisco", http.StatusBadRequest)
+			return
+		}
+		deleted, err := deleteFromPartitions(dbs, func(db *sql.DB) (int64, error) {
+			return deleteListingsByCity(r.Context(), db, city)
+		})
+		if err != nil {
+			fmt.Printf("Failed to delete listings: %v\n", err)
+			http.Error(w, "failed to delete listings", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("Deleted %d listings from %s via the API\n", deleted, city)
+		writeJSON(w, map[string]int64{"deleted": deleted})
+	})
+
+	return root
+}
+
+// Run a delete against every database, returning how many rows it removed in all
+func deleteFromPartitions(dbs []*sql.DB, del func(*sql.DB) (int64, error)) (int64, error) {
+	var total int64
+	for _, db := range dbs {
+		n, err := del(db)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Validate the /listings query parameters
+func parseListingQuery(values url.Values) (listingQuery, error) {
+	q := listingQuery{
+		Section:   values.Get("section"),
+		SearchURL: values.Get("search_url"),
+		Sort:      "posted",
+		Desc:      true,
+		Limit:     defaultListingsLimit,
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		if _, ok := listingSortColumns[sort]; !ok {
+			return q, fmt.Errorf("invalid sort %q: must be posted, updated, or price", sort)
+		}
+		q.Sort = sort
+	}
+
+	switch order := values.Get("order"); order {
+	case "", "desc":
+	case "asc":
+		q.Desc = false
+	default:
+		return q, fmt.Errorf("invalid order %q: must be asc or desc", order)
+	}
+
+	var err error
+	if q.MinCents, err = parseCentsParam(values, "min_price"); err != nil {
+		return q, err
+	}
+	if q.MaxCents, err = parseCentsParam(values, "max_price"); err != nil {
+		return q, err
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("invalid limit %q: must be a positive integer", limit)
+		}
+		q.Limit = min(n, maxListingsLimit)
+	}
+
+	if offset := values.Get("offset"); offset != "" {
+		n, err := strconv.Atoi(offset)
+		if err != nil || n < 0 {
+			return q, fmt.Errorf("invalid offset %q: must be a non-negative integer", offset)
+		}
+		q.Offset = n
+	}
+
+	return q, nil
+}
+
+// Parse an optional whole-dollar price parameter into cents
+func parseCentsParam(values url.Values, param string) (*int, error) {
+	v := values.Get(param)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q: must be a non-negative whole number of dollars", param, v)
+	}
+	cents := n * 100
+	return &cents, nil
+}
+
+// Reject requests that don't carry the expected basic auth credentials
+func requireBasicAuth(next http.Handler, user, pass string) http.Handler {
+	wantUser := sha256.Sum256([]byte(user))
+	wantPass := sha256.Sum256([]byte(pass))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPass, ok := r.BasicAuth()
+
+		// Compare fixed-length digests so neither content nor length leaks through timing
+		userHash := sha256.Sum256([]byte(gotUser))
+		passHash := sha256.Sum256([]byte(gotPass))
+		userOK := subtle.ConstantTimeCompare(userHash[:], wantUser[:]) == 1
+		passOK := subtle.ConstantTimeCompare(passHash[:], wantPass[:]) == 1
+
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="craigslist_bot", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Serve the published expvars the way expvar.Handler does, leaving out the
+// runtime's cmdline, which holds any secrets given as flags, and memstats
+func serveVars(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" || kv.Key == "memstats" {
+			return
+		}
+		if !first {
+			fmt.Fprint(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprint(w, "\n}\n")
+}
+
+// Write a value as a JSON response
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Failed to write response: %v\n", err)
+	}
+}
+
+// A listing with its times converted to loc, for the API's responses
+func inDisplayTZ(listing Listing, loc *time.Location) Listing {
+	listing.Posted = listing.Posted.In(loc)
+	listing.ScrapedAt = listing.ScrapedAt.In(loc)
+	if listing.Updated != nil {
+		updated := listing.Updated.In(loc)
+		listing.Updated = &updated
+	}
+	return listing
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Store a listing as a scrape would
+func addTestListing(t *testing.T, db *sql.DB, site, postID string) {
+	t.Helper()
+	now := time.Now().UTC()
+	listing := Listing{
+		Title:      "Couch " + postID,
+		Price:      "$50",
+		City:       site,
+		Site:       site,
+		Posted:     now,
+		ScrapedAt:  now,
+		ListingURL: "https://" + site + ".craigslist.org/fuo/d/couch/" + postID + ".html",
+		PostID:     postID,
+	}
+	if _, err := insertListing(context.Background(), db, listing); err != nil {
+		t.Fatalf("insertListing: %v", err)
+	}
+}
+
+// Store a listing the way rows were stored before post IDs and sites were
+// recorded, as initDB's migrations leave it
+func addLegacyListing(t *testing.T, db *sql.DB, listingURL string) {
+	t.Helper()
+	now := time.Now().UTC()
+	_, err := db.Exec(`INSERT INTO listings (title, price, city, posted, scraped_at, listing_url) VALUES ('Legacy', '', '', ?, ?, ?);`, now, now, listingURL)
+	if err != nil {
+		t.Fatalf("insert legacy listing: %v", err)
+	}
+}
+
+// An API server over db with credentials configured, unless user is empty
+func newTestAPI(t *testing.T, db *sql.DB, user string) *httptest.Server {
+	t.Helper()
+	cfg := Config{APIUser: user, APIPass: "secret", DisplayTZ: time.UTC}
+	srv := httptest.NewServer(newAPIHandler(cfg, []*sql.DB{db}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Send an API request with the test credentials and decode any JSON body into v
+func doAPIRequest(t *testing.T, method, url string, v any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	req.SetBasicAuth("admin", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("decode %s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestDeleteListingByPostID(t *testing.T) {
+	db := newTestDB(t)
+	addTestListing(t, db, "sfbay", "111")
+	addTestListing(t, db, "sfbay", "222")
+	addLegacyListing(t, db, "https://sfbay.craigslist.org/fuo/d/chair/333.html")
+	srv := newTestAPI(t, db, "admin")
+
+	var body map[string]int64
+	if code := doAPIRequest(t, "DELETE", srv.URL+"/listings/111", &body); code != http.StatusOK {
+		t.Fatalf("DELETE /listings/111: status %d", code)
+	}
+	if body["deleted"] != 1 {
+		t.Errorf("DELETE /listings/111: deleted %d, want 1", body["deleted"])
+	}
+	if code := doAPIRequest(t, "DELETE", srv.URL+"/listings/333", &body); code != http.StatusOK || body["deleted"] != 1 {
+		t.Errorf("DELETE /listings/333 (legacy): status %d, deleted %d", code, body["deleted"])
+	}
+	if code := doAPIRequest(t, "DELETE", srv.URL+"/listings/111", nil); code != http.StatusNotFound {
+		t.Errorf("DELETE /listings/111 again: status %d, want 404", code)
+	}
+
+	n, err := countListings(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d listings left, want 1", n)
+	}
+}
+
+func TestDeleteListingsByCity(t *testing.T) {
+	db := newTestDB(t)
+	addTestListing(t, db, "sfbay", "111")
+	addTestListing(t, db, "sfbay", "222")
+	addTestListing(t, db, "charlotte", "333")
+	addLegacyListing(t, db, "https://sfbay.craigslist.org/fuo/d/chair/444.html")
+	addLegacyListing(t, db, "https://sfbayarea.craigslist.org/fuo/d/chair/555.html")
+	now := time.Now().UTC()
+	if _, err := insertListing(context.Background(), db, Listing{
+		Title: "Desk", Price: "$80", City: "Winston-Salem", Site: "greensboro", Posted: now, ScrapedAt: now,
+		ListingURL: "https://greensboro.craigslist.org/fuo/d/desk/666.html", PostID: "666",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestAPI(t, db, "admin")
+
+	// By site, then by the city shown in the results
+	for _, tc := range []struct {
+		query string
+		want  int64
+	}{
+		{"city=sfbay", 3},
+		{"city=Winston-Salem", 1},
+	} {
+		var body map[string]int64
+		if code := doAPIRequest(t, "DELETE", srv.URL+"/listings?"+tc.query, &body); code != http.StatusOK {
+			t.Fatalf("DELETE /listings?%s: status %d", tc.query, code)
+		}
+		if body["deleted"] != tc.want {
+			t.Errorf("DELETE /listings?%s: deleted %d, want %d", tc.query, body["deleted"], tc.want)
+		}
+	}
+
+	n, err := countListings(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("%d listings left, want 2", n)
+	}
+}
+
+func TestListingParamsRejectPatterns(t *testing.T) {
+	db := newTestDB(t)
+	addLegacyListing(t, db, "https://sfbay.craigslist.org/fuo/d/chair/444.html")
+	srv := newTestAPI(t, db, "admin")
+
+	for _, tc := range []struct{ method, path string }{
+		{"GET", "/listings/%25"},
+		{"GET", "/listings/1_"},
+		{"DELETE", "/listings/%25"},
+		{"DELETE", "/listings?city=%25"},
+		{"DELETE", "/listings?city=sf_ay"},
+		{"DELETE", "/listings?city=San+Francisco%25"},
+	} {
+		if code := doAPIRequest(t, tc.method, srv.URL+tc.path, nil); code != http.StatusBadRequest {
+			t.Errorf("%s %s: status %d, want 400", tc.method, tc.path, code)
+		}
+	}
+
+	// The wildcards are compared exactly in the store too
+	for _, pattern := range []string{"%", "_"} {
+		if _, err := getListingByPostID(context.Background(), db, pattern); err != sql.ErrNoRows {
+			t.Errorf("getListingByPostID(%q): %v, want sql.ErrNoRows", pattern, err)
+		}
+		if n, err := deleteListingByPostID(context.Background(), db, pattern); err != nil || n != 0 {
+			t.Errorf("deleteListingByPostID(%q) = %d, %v; want 0", pattern, n, err)
+		}
+		if n, err := deleteListingsByCity(context.Background(), db, pattern); err != nil || n != 0 {
+			t.Errorf("deleteListingsByCity(%q) = %d, %v; want 0", pattern, n, err)
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	t.Cleanup(func() { scrapingPaused.Store(false) })
+	srv := newTestAPI(t, newTestDB(t), "admin")
+
+	var body map[string]bool
+	if code := doAPIRequest(t, "POST", srv.URL+"/pause", &body); code != http.StatusOK || !body["paused"] {
+		t.Fatalf("POST /pause: status %d, body %v", code, body)
+	}
+	if !scrapingPaused.Load() {
+		t.Error("POST /pause didn't pause scraping")
+	}
+	var stats apiStats
+	if code := doAPIRequest(t, "GET", srv.URL+"/stats", &stats); code != http.StatusOK || !stats.Paused {
+		t.Errorf("GET /stats while paused: status %d, paused %v", code, stats.Paused)
+	}
+	if code := doAPIRequest(t, "POST", srv.URL+"/resume", &body); code != http.StatusOK || body["paused"] {
+		t.Fatalf("POST /resume: status %d, body %v", code, body)
+	}
+	if scrapingPaused.Load() {
+		t.Error("POST /resume didn't resume scraping")
+	}
+}
+
+func TestPauseRequiresCredentials(t *testing.T) {
+	t.Cleanup(func() { scrapingPaused.Store(false) })
+	srv := newTestAPI(t, newTestDB(t), "")
+
+	for _, path := range []string{"/pause", "/resume"} {
+		if code := doAPIRequest(t, "POST", srv.URL+path, nil); code != http.StatusForbidden {
+			t.Errorf("POST %s without -api-user: status %d, want 403", path, code)
+		}
+	}
+	if scrapingPaused.Load() {
+		t.Error("POST /pause without -api-user paused scraping")
+	}
+}
+
+func TestDeleteRequiresCredentials(t *testing.T) {
+	db := newTestDB(t)
+	addTestListing(t, db, "sfbay", "111")
+	srv := newTestAPI(t, db, "")
+
+	if code := doAPIRequest(t, "DELETE", srv.URL+"/listings/111", nil); code != http.StatusForbidden {
+		t.Errorf("DELETE without -api-user: status %d, want 403", code)
+	}
+}
+
+func TestListingsSortAndPagination(t *testing.T) {
+	db := newTestDB(t)
+	for i, price := range []string{"$30", "$10", "$20"} {
+		listing := fakeListing("Item "+price, price, strconv.Itoa(800+i))
+		listing.PriceCents = priceCents(price)
+		listing.Posted = time.Date(2024, 10, 14, 10+i, 0, 0, 0, time.UTC)
+		listing.ScrapedAt = listing.Posted
+		if _, err := insertListing(context.Background(), db, listing); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := newTestAPI(t, db, "admin")
+
+	var listings []Listing
+	if code := doAPIRequest(t, "GET", srv.URL+"/listings?sort=price&order=asc&limit=2", &listings); code != http.StatusOK {
+		t.Fatalf("GET /listings?sort=price: status %d", code)
+	}
+	if len(listings) != 2 || listings[0].Price != "$10" || listings[1].Price != "$20" {
+		t.Errorf("sort=price&order=asc&limit=2 gave %+v", listings)
+	}
+	if code := doAPIRequest(t, "GET", srv.URL+"/listings?offset=2", &listings); code != http.StatusOK || len(listings) != 1 || listings[0].Price != "$30" {
+		t.Errorf("offset=2 gave status %d, %+v; want the oldest listing", code, listings)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/listings?limit=1", nil)
+	req.SetBasicAuth("admin", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if total := resp.Header.Get("X-Total-Count"); total != "3" {
+		t.Errorf("X-Total-Count = %q, want 3", total)
+	}
+
+	for _, query := range []string{"sort=title", "sort=id;DROP TABLE listings", "order=sideways", "limit=0", "limit=x", "offset=-1", "min_price=cheap"} {
+		if code := doAPIRequest(t, "GET", srv.URL+"/listings?"+url.PathEscape(query), nil); code != http.StatusBadRequest {
+			t.Errorf("GET /listings?%s: status %d, want 400", query, code)
+		}
+	}
+}
+
+func TestCountListings(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+	if n, err := countListings(ctx, db); err != nil || n != 0 {
+		t.Errorf("countListings of an empty store = %d, %v; want 0", n, err)
+	}
+	if counts, err := countListingsByCity(ctx, db); err != nil || len(counts) != 0 {
+		t.Errorf("countListingsByCity of an empty store = %v, %v; want none", counts, err)
+	}
+
+	addTestListing(t, db, "sfbay", "111")
+	addTestListing(t, db, "sfbay", "222")
+	addTestListing(t, db, "charlotte", "333")
+	addLegacyListing(t, db, "https://sfbay.craigslist.org/fuo/d/chair/444.html")
+
+	if n, err := countListings(ctx, db); err != nil || n != 4 {
+		t.Errorf("countListings = %d, %v; want 4", n, err)
+	}
+	counts, err := countListingsByCity(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"sfbay": 2, "charlotte": 1, "": 1}; !maps.Equal(counts, want) {
+		t.Errorf("countListingsByCity = %v, want %v", counts, want)
+	}
+
+	srv := newTestAPI(t, db, "admin")
+	var stats apiStats
+	if code := doAPIRequest(t, "GET", srv.URL+"/stats", &stats); code != http.StatusOK {
+		t.Fatalf("GET /stats: status %d", code)
+	}
+	if stats.Stored != 4 || !maps.Equal(stats.StoredByCity, counts) {
+		t.Errorf("GET /stats: stored %d, by city %v", stats.Stored, stats.StoredByCity)
+	}
+}
+
+func TestGetListingByPostID(t *testing.T) {
+	db := newTestDB(t)
+	addTestListing(t, db, "sfbay", "111")
+	addLegacyListing(t, db, "https://sfbay.craigslist.org/fuo/d/chair/333.html")
+	listing := fakeListing("Oak table", "$120", "7781234567")
+	listing.ListingURL = fixtureDetailURL
+	listing.Posted, listing.ScrapedAt = time.Now().UTC(), time.Now().UTC()
+	if _, err := insertListing(context.Background(), db, listing); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateListingDetails(context.Background(), db, fixtureDetailURL, parseFixtureDetails(t)); err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestAPI(t, db, "admin")
+
+	var got Listing
+	if code := doAPIRequest(t, "GET", srv.URL+"/listings/111", &got); code != http.StatusOK {
+		t.Fatalf("GET /listings/111: status %d", code)
+	}
+	if got.PostID != "111" || got.Title != "Couch 111" || got.Site != "sfbay" {
+		t.Errorf("GET /listings/111 = %+v", got)
+	}
+
+	got = Listing{}
+	if code := doAPIRequest(t, "GET", srv.URL+"/listings/7781234567", &got); code != http.StatusOK {
+		t.Fatalf("GET /listings/7781234567: status %d", code)
+	}
+	if got.Description == "" || len(got.Images) != 2 || got.Attributes["condition"] != "like new" {
+		t.Errorf("enriched listing missing details: description %q, images %q, attributes %v", got.Description, got.Images, got.Attributes)
+	}
+
+	// Rows stored before post IDs were recorded are found by their URL
+	got = Listing{}
+	if code := doAPIRequest(t, "GET", srv.URL+"/listings/333", &got); code != http.StatusOK || got.Title != "Legacy" {
+		t.Errorf("GET /listings/333 (legacy): status %d, %+v", code, got)
+	}
+
+	for _, postID := range []string{"999", "33", "1111"} {
+		if code := doAPIRequest(t, "GET", srv.URL+"/listings/"+postID, nil); code != http.StatusNotFound {
+			t.Errorf("GET /listings/%s: status %d, want 404", postID, code)
+		}
+	}
+}
+
+// /debug/vars has the bot's counters but not the command line, which may
+// hold secrets
+func TestDebugVars(t *testing.T) {
+	srv := newTestAPI(t, newTestDB(t), "admin")
+	var vars map[string]json.RawMessage
+	if code := doAPIRequest(t, "GET", srv.URL+"/debug/vars", &vars); code != http.StatusOK {
+		t.Fatalf("GET /debug/vars: status %d", code)
+	}
+	for _, name := range []string{"listings_scraped", "listings_scraped_by_city", "run_id"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("GET /debug/vars is missing %s", name)
+		}
+	}
+	for _, name := range []string{"cmdline", "memstats"} {
+		if _, ok := vars[name]; ok {
+			t.Errorf("GET /debug/vars publishes %s", name)
+		}
+	}
+}
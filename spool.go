@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// How often the spool retries what it holds
+const spoolRetryInterval = time.Minute
+
+// Returned by a spooled notifier when the notification was queued on disk
+// rather than delivered, for dispatch to report
+var errSpooled = errors.New("queued in -notify-spool")
+
+// The -notify-spool queue, or nil without it. Set by parseFlags and used by
+// loadConfig to wrap every notifier it builds.
+var notifySpool *fileQueue
+
+// Notifications that couldn't be delivered, kept in order in memory and in a
+// JSON lines file so they survive a restart. Once a notifier has something
+// queued, everything else for it queues behind, so nothing arrives out of
+// order when it comes back.
+type fileQueue struct {
+	mu        sync.Mutex
+	path      string
+	entries   []spoolEntry
+	nextID    int
+	notifiers map[string]Notifier // by key, as registered by spooled
+}
+
+// One line of the spool file
+type spoolEntry struct {
+	id           int          // in memory only, to tell entries apart across a drain
+	Key          string       `json:"key"`      // identifies the notifier, see notifierKey
+	Name         string       `json:"notifier"` // its name in the config, for the log
+	QueuedAt     time.Time    `json:"queued_at"`
+	Notification Notification `json:"notification"`
+}
+
+// Open the spool at path, loading whatever an earlier run left in it
+func openFileQueue(path string) (*fileQueue, error) {
+	q := &fileQueue{path: path, notifiers: make(map[string]Notifier)}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry spoolEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		entry.id = q.nextID
+		q.nextID++
+		q.entries = append(q.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(q.entries) > 0 {
+		fmt.Printf("Loaded %d undelivered notifications from %s\n", len(q.entries), path)
+	}
+	return q, nil
+}
+
+// Identify a notifier by its type and destination, so its queued
+// notifications find it again after a restart or a config reload. Hashed,
+// since the destination usually includes a token.
+func notifierKey(notifier Notifier) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%T %+v", notifier, notifier)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Wrap each of notifiers so that what it fails to deliver is spooled. A
+// no-op without -notify-spool.
+func spoolNotifiers(notifiers map[string]Notifier) {
+	if notifySpool == nil {
+		return
+	}
+	for name, notifier := range notifiers {
+		if _, ok := notifier.(spooledNotifier); !ok {
+			notifiers[name] = notifySpool.spooled(name, notifier)
+		}
+	}
+}
+
+// Sends through a notifier, queueing on the spool instead when the send
+// fails or earlier notifications are still waiting
+type spooledNotifier struct {
+	name     string
+	key      string
+	notifier Notifier
+	queue    *fileQueue
+}
+
+func (q *fileQueue) spooled(name string, notifier Notifier) spooledNotifier {
+	key := notifierKey(notifier)
+	q.mu.Lock()
+	q.notifiers[key] = notifier
+	q.mu.Unlock()
+	return spooledNotifier{name: name, key: key, notifier: notifier, queue: q}
+}
+
+func (sn spooledNotifier) Notify(ctx context.Context, n Notification) error {
+	if !sn.queue.waiting(sn.key) {
+		err := sn.notifier.Notify(ctx, n)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		fmt.Printf("Failed to send notification via %s: %v\n", sn.name, err)
+	}
+	if err := sn.queue.push(sn.key, sn.name, n); err != nil {
+		return fmt.Errorf("failed to queue in -notify-spool: %v", err)
+	}
+	return errSpooled
+}
+
+// Report whether anything is queued for the notifier with key
+func (q *fileQueue) waiting(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range q.entries {
+		if entry.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a notification to the end of the queue and the file
+func (q *fileQueue) push(key, name string, n Notification) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry := spoolEntry{id: q.nextID, Key: key, Name: name, QueuedAt: time.Now().UTC(), Notification: n}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(q.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	q.nextID++
+	q.entries = append(q.entries, entry)
+	return nil
+}
+
+// Retry the queue every spoolRetryInterval until ctx is done
+func (q *fileQueue) drain(ctx context.Context) {
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+	for {
+		q.retry(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Try to deliver everything queued, oldest first. Once a notifier fails, the
+// rest of its notifications wait for the next retry. Those for a notifier
+// that's no longer configured are dropped. Returns how many were delivered.
+func (q *fileQueue) retry(ctx context.Context) int {
+	q.mu.Lock()
+	entries := append([]spoolEntry(nil), q.entries...)
+	notifiers := make(map[string]Notifier, len(q.notifiers))
+	for key, notifier := range q.notifiers {
+		notifiers[key] = notifier
+	}
+	q.mu.Unlock()
+
+	// Sent without holding the lock, so the cycle can keep queueing meanwhile
+	done := make(map[int]bool)
+	failed := make(map[string]bool)
+	delivered := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		if failed[entry.Key] {
+			continue
+		}
+		notifier := notifiers[entry.Key]
+		if notifier == nil {
+			fmt.Printf("Dropping queued notification for %s, which is no longer configured: %s\n", entry.Name, entry.Notification.Message)
+			done[entry.id] = true
+			continue
+		}
+		if err := notifier.Notify(ctx, entry.Notification); err != nil {
+			debugf("Still failing to send queued notifications via %s: %v", entry.Name, err)
+			failed[entry.Key] = true
+			continue
+		}
+		fmt.Printf("Queued notification sent via %s: %s\n", entry.Name, entry.Notification.Message)
+		notifiedCount.Add(1)
+		done[entry.id] = true
+		delivered++
+	}
+	if len(done) == 0 {
+		return 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept := q.entries[:0]
+	for _, entry := range q.entries {
+		if !done[entry.id] {
+			kept = append(kept, entry)
+		}
+	}
+	q.entries = kept
+	if err := q.rewrite(); err != nil {
+		fmt.Printf("Failed to update %s: %v\n", q.path, err)
+	}
+	return delivered
+}
+
+// Replace the file with the entries still queued. Called with q.mu held.
+func (q *fileQueue) rewrite() error {
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, entry := range q.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		w.Write(append(line, '\n'))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), q.path)
+}
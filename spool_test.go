@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// A notifier that fails while its network is down
+type flakyNotifier struct {
+	url  string
+	down *bool
+	sent *[]string
+}
+
+func (fn flakyNotifier) Notify(ctx context.Context, n Notification) error {
+	if *fn.down {
+		return errors.New("dial tcp: network is unreachable")
+	}
+	*fn.sent = append(*fn.sent, n.Message)
+	return nil
+}
+
+// Notifications queue while the network is down, survive a restart, and are
+// delivered in order once it's back; nothing new jumps the queue meanwhile
+func TestFileQueue(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	q, err := openFileQueue(path)
+	if err != nil {
+		t.Fatalf("openFileQueue: %v", err)
+	}
+
+	down := true
+	var sent []string
+	notifier := flakyNotifier{url: "https://ntfy.example/deals", down: &down, sent: &sent}
+	spooled := q.spooled("ntfy", notifier)
+	for _, message := range []string{"first", "second"} {
+		if err := spooled.Notify(ctx, Notification{Message: message}); !errors.Is(err, errSpooled) {
+			t.Fatalf("Notify(%s) while down: %v, want errSpooled", message, err)
+		}
+	}
+	if n := q.retry(ctx); n != 0 {
+		t.Errorf("retry while down delivered %d", n)
+	}
+	down = false
+	if err := spooled.Notify(ctx, Notification{Message: "third"}); !errors.Is(err, errSpooled) {
+		t.Fatalf("Notify(third) with older ones waiting: %v, want errSpooled", err)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("sent %q ahead of the queue", sent)
+	}
+
+	// A restart picks up where the last run left off
+	q, err = openFileQueue(path)
+	if err != nil {
+		t.Fatalf("openFileQueue after restart: %v", err)
+	}
+	if len(q.entries) != 3 {
+		t.Fatalf("reloaded %d queued notifications, want 3", len(q.entries))
+	}
+	spooled = q.spooled("ntfy", notifier)
+	if n := q.retry(ctx); n != 3 {
+		t.Errorf("retry delivered %d, want 3", n)
+	}
+	if want := []string{"first", "second", "third"}; !slices.Equal(sent, want) {
+		t.Errorf("delivered %q, want %q", sent, want)
+	}
+	if data, err := os.ReadFile(path); err != nil || len(data) != 0 {
+		t.Errorf("spool file holds %q after draining, %v", data, err)
+	}
+
+	// With the queue empty, notifications go straight out
+	if err := spooled.Notify(ctx, Notification{Message: "fourth"}); err != nil {
+		t.Errorf("Notify(fourth) with nothing queued: %v", err)
+	}
+	if len(sent) != 4 {
+		t.Errorf("delivered %q, want the fourth sent directly", sent)
+	}
+}
+
+// A notifier's queue stops at its first failure and leaves other notifiers'
+// alone; notifications for a notifier that's gone are dropped
+func TestFileQueueRetryPerNotifier(t *testing.T) {
+	ctx := context.Background()
+	q, err := openFileQueue(filepath.Join(t.TempDir(), "spool.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	brokenDown, okDown := true, false
+	var brokenSent, okSent []string
+	broken := flakyNotifier{url: "https://ntfy.example/broken", down: &brokenDown, sent: &brokenSent}
+	ok := flakyNotifier{url: "https://ntfy.example/ok", down: &okDown, sent: &okSent}
+	q.spooled("broken", broken)
+	q.spooled("ok", ok)
+	for _, entry := range []struct {
+		notifier      Notifier
+		name, message string
+	}{
+		{broken, "broken", "b1"},
+		{ok, "ok", "o1"},
+		{broken, "broken", "b2"},
+		{ok, "ok", "o2"},
+	} {
+		if err := q.push(notifierKey(entry.notifier), entry.name, Notification{Message: entry.message}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.push("gone", "removed", Notification{Message: "lost"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := q.retry(ctx); n != 2 {
+		t.Errorf("retry delivered %d, want 2", n)
+	}
+	if want := []string{"o1", "o2"}; !slices.Equal(okSent, want) {
+		t.Errorf("ok notifier got %q, want %q", okSent, want)
+	}
+	var left []string
+	for _, entry := range q.entries {
+		left = append(left, entry.Notification.Message)
+	}
+	if want := []string{"b1", "b2"}; !slices.Equal(left, want) {
+		t.Errorf("still queued %q, want %q", left, want)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Maximum number of notifications waiting on -notify-rate; more are dropped
+const notifyQueueSize = 1000
+
+// A notification waiting its turn, with the notifiers it goes to
+type pendingNotification struct {
+	notifiers map[string]Notifier
+	names     []string
+	n         Notification
+}
+
+// Send a notification right away, or queue it when -notify-rate is set (queue
+// is non-nil). Returns how many notifiers it was sent or queued for.
+func sendOrQueue(ctx context.Context, notifiers map[string]Notifier, queue chan<- pendingNotification, names []string, n Notification) int {
+	if queue == nil {
+		sent := dispatch(ctx, notifiers, names, n)
+		notifiedCount.Add(int64(sent))
+		return sent
+	}
+	select {
+	case queue <- pendingNotification{notifiers: notifiers, names: names, n: n}:
+		return len(names)
+	default:
+		fmt.Printf("Notification queue full, dropping: %s\n", n.Message)
+		return 0
+	}
+}
+
+// Send queued notifications at no more than rate per minute, using a token
+// bucket: after a quiet spell up to rate can go out at once, and the rest are
+// spaced evenly. Returns when ctx is done, dropping whatever is still queued.
+func drainNotifications(ctx context.Context, queue <-chan pendingNotification, rate int) {
+	perToken := time.Minute / time.Duration(rate)
+	tokens := float64(rate)
+	last := time.Now()
+
+	for {
+		var p pendingNotification
+		select {
+		case <-ctx.Done():
+			dropPending(queue, 0)
+			return
+		case p = <-queue:
+		}
+
+		// Refill for the time since the last send, then wait for a token if none are left
+		now := time.Now()
+		tokens = min(float64(rate), tokens+float64(now.Sub(last))/float64(perToken))
+		last = now
+		if tokens < 1 {
+			wait := time.Duration((1 - tokens) * float64(perToken))
+			select {
+			case <-ctx.Done():
+				dropPending(queue, 1)
+				return
+			case <-time.After(wait):
+			}
+			tokens = 1
+			last = time.Now()
+		}
+		tokens--
+
+		sent := dispatch(ctx, p.notifiers, p.names, p.n)
+		notifiedCount.Add(int64(sent))
+	}
+}
+
+// Log how many notifications are being dropped at shutdown: those still in
+// the queue, plus any already taken off it
+func dropPending(queue <-chan pendingNotification, taken int) {
+	if dropped := taken + len(queue); dropped > 0 {
+		fmt.Printf("Dropping %d pending notifications on shutdown\n", dropped)
+	}
+}